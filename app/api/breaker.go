@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/quangdangfit/gosdk/utils/logger"
+
+	"message-queue/app/services"
+	"message-queue/pkg/app"
+)
+
+type Breaker struct {
+	service services.BreakerService
+}
+
+func NewBreaker(service services.BreakerService) *Breaker {
+	return &Breaker{service: service}
+}
+
+// Get List Circuit Breakers godoc
+// @Tags Circuit Breakers
+// @Summary get list circuit breakers
+// @Description get state of circuit breaker of each API host
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/breakers [get]
+func (b *Breaker) List(c *gin.Context) {
+	app.ResSuccess(c, b.service.List())
+}
+
+// Reset Circuit Breaker godoc
+// @Tags Circuit Breakers
+// @Summary api reset circuit breaker
+// @Description api closes circuit breaker of API host
+// @Produce json
+// @Param host path string true "API Host"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/breakers/{host}/reset [post]
+func (b *Breaker) Reset(c *gin.Context) {
+	host := c.Param("host")
+	if host == "" {
+		err := errors.New("missing host")
+		logger.Error(err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	err := b.service.Reset(host)
+	if err != nil {
+		logger.Errorf("Failed to reset circuit breaker %s, error: %s", host, err)
+		app.ResError(c, err, 404)
+		return
+	}
+
+	app.ResOK(c)
+}
@@ -6,7 +6,10 @@ func Inject(container *dig.Container) error {
 	_ = container.Provide(NewOutMsg)
 	_ = container.Provide(NewInMsg)
 	_ = container.Provide(NewRouting)
+	_ = container.Provide(NewParkedMsg)
 	_ = container.Provide(NewCron)
+	_ = container.Provide(NewHealth)
+	_ = container.Provide(NewBreaker)
 
 	return nil
 }
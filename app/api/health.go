@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"message-queue/app/queue"
+	"message-queue/app/services"
+	"message-queue/pkg/app"
+)
+
+type Health struct {
+	service services.HealthService
+}
+
+func NewHealth(service services.HealthService) *Health {
+	return &Health{service: service}
+}
+
+// Health Check godoc
+// @Tags Health
+// @Summary check broker connection
+// @Description api returns broker connection state and in-flight deliveries,
+// status is 503 when broker is not connected
+// @Produce json
+// @Success 200 {object} app.Response
+// @Failure 503 {object} app.Response
+// @Router /health [get]
+func (h *Health) Check(c *gin.Context) {
+	rs := h.service.Check()
+
+	switch rs.Status {
+	case queue.BrokerConnected, queue.BrokerUnknown:
+		app.ResSuccess(c, rs)
+	default:
+		app.ResJSON(c, http.StatusServiceUnavailable, app.Response{
+			Code: http.StatusServiceUnavailable,
+			Msg:  "broker is " + rs.Status,
+			Data: rs,
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
 	"github.com/quangdangfit/gosdk/utils/logger"
 
@@ -43,6 +45,9 @@ func (o *InMsg) List(c *gin.Context) {
 		return
 	}
 
+	for i := range *rs {
+		(*rs)[i].RoutingKey = (*rs)[i].RoutingKey.Redacted()
+	}
 	res := schema.ResponsePaging{
 		Data:   rs,
 		Paging: pageInfo,
@@ -50,3 +55,32 @@ func (o *InMsg) List(c *gin.Context) {
 
 	app.ResSuccess(c, res)
 }
+
+// Preview In Message godoc
+// @Tags In Messages
+// @Summary preview in message requests
+// @Description api renders API requests of in message without sending them
+// @Accept  json
+// @Produce json
+// @Param id path string true "Message ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/in_messages/{id}/preview [get]
+func (o *InMsg) Preview(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		err := errors.New("missing message id")
+		logger.Error(err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	rs, err := o.service.Preview(c, id)
+	if err != nil {
+		logger.Errorf("Failed to preview in message %s, error: %s", id, err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	app.ResSuccess(c, rs)
+}
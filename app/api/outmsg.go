@@ -2,6 +2,7 @@ package api
 
 import (
 	"errors"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 
@@ -13,6 +14,7 @@ import (
 	"message-queue/app/schema"
 	"message-queue/app/services"
 	"message-queue/pkg/app"
+	"message-queue/pkg/jsonschema"
 )
 
 type OutMsg struct {
@@ -57,6 +59,15 @@ func (o *OutMsg) Publish(c *gin.Context) {
 	}
 
 	err = o.service.Publish(c, message)
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		app.ResJSON(c, http.StatusBadRequest, app.Response{
+			Code: http.StatusBadRequest,
+			Msg:  "payload is invalid",
+			Data: validationErr.Errors,
+		})
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to publish message: ", err)
 		app.ResError(c, err, 400)
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/quangdangfit/gosdk/utils/logger"
+
+	"message-queue/app/schema"
+	"message-queue/app/services"
+	"message-queue/pkg/app"
+)
+
+type ParkedMsg struct {
+	service services.ParkedService
+}
+
+func NewParkedMsg(service services.ParkedService) *ParkedMsg {
+	return &ParkedMsg{service: service}
+}
+
+// Get List Parked Messages godoc
+// @Tags Parked Messages
+// @Summary get list parked messages
+// @Description get list messages rejected to the parking queue
+// @Accept  json
+// @Produce json
+// @Param Query query schema.ParkedMsgQueryParam true "Query"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Header 200 {string} Token "qwerty"
+// @Router /api/v1/parked_messages [get]
+func (p *ParkedMsg) List(c *gin.Context) {
+	var queryParam schema.ParkedMsgQueryParam
+	if err := c.Bind(&queryParam); err != nil {
+		logger.Error("Failed to bind body, error: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	rs, pageInfo, err := p.service.List(c, &queryParam)
+	if err != nil {
+		logger.Error("Failed to get list parked messages, error: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	res := schema.ResponsePaging{
+		Data:   rs,
+		Paging: pageInfo,
+	}
+
+	app.ResSuccess(c, res)
+}
+
+// Retrieve Parked Message godoc
+// @Tags Parked Messages
+// @Summary api retrieve parked message
+// @Description api retrieve parked message with its x-death headers
+// @Accept  json
+// @Produce json
+// @Param id path string true "Parked Message ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/parked_messages/{id} [get]
+func (p *ParkedMsg) Retrieve(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		err := errors.New("missing parked message id")
+		logger.Error(err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	rs, err := p.service.Retrieve(c, id)
+	if err != nil {
+		logger.Errorf("Failed to get parked message %s, error: %s", id, err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	app.ResSuccess(c, rs)
+}
+
+// Requeue Parked Message godoc
+// @Tags Parked Messages
+// @Summary api requeue parked message
+// @Description api publish parked message back with its routing key
+// @Accept  json
+// @Produce json
+// @Param id path string true "Parked Message ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/parked_messages/{id}/requeue [post]
+func (p *ParkedMsg) Requeue(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		err := errors.New("missing parked message id")
+		logger.Error(err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	err := p.service.Requeue(c, id)
+	if err != nil {
+		logger.Errorf("Failed to requeue parked message %s, error: %s", id, err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	app.ResOK(c)
+}
+
+// Purge Parked Messages godoc
+// @Tags Parked Messages
+// @Summary api purge parked messages
+// @Description api delete parked messages matched query, all of them if query is empty
+// @Accept  json
+// @Produce json
+// @Param Query query schema.ParkedMsgQueryParam false "Query"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/parked_messages [delete]
+func (p *ParkedMsg) Purge(c *gin.Context) {
+	var queryParam schema.ParkedMsgQueryParam
+	if err := c.BindQuery(&queryParam); err != nil {
+		logger.Error("Failed to bind query, error: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	err := p.service.Purge(c, &queryParam)
+	if err != nil {
+		logger.Error("Failed to purge parked messages, error: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	app.ResOK(c)
+}
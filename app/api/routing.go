@@ -2,16 +2,22 @@ package api
 
 import (
 	"errors"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/quangdangfit/gosdk/utils/logger"
 	"github.com/quangdangfit/gosdk/validator"
 
+	"message-queue/app/models"
 	"message-queue/app/schema"
 	"message-queue/app/services"
 	"message-queue/pkg/app"
 )
 
+const (
+	DefaultSecretOverlap = 24 * time.Hour
+)
+
 type Routing struct {
 	service services.RoutingService
 }
@@ -44,7 +50,7 @@ func (r *Routing) Retrieve(c *gin.Context) {
 		app.ResError(c, err, 400)
 	}
 
-	app.ResSuccess(c, rs)
+	app.ResSuccess(c, redacted(rs))
 }
 
 // Get List Routing Keys godoc
@@ -73,8 +79,12 @@ func (r *Routing) List(c *gin.Context) {
 		return
 	}
 
+	var routingKeys []models.RoutingKey
+	for _, routingKey := range *rs {
+		routingKeys = append(routingKeys, routingKey.Redacted())
+	}
 	res := schema.ResponsePaging{
-		Data:   rs,
+		Data:   routingKeys,
 		Paging: pageInfo,
 	}
 
@@ -114,7 +124,7 @@ func (r *Routing) Create(c *gin.Context) {
 		return
 	}
 
-	app.ResSuccess(c, rs)
+	app.ResSuccess(c, redacted(rs))
 }
 
 // Update Routing Key godoc
@@ -156,5 +166,94 @@ func (r *Routing) Update(c *gin.Context) {
 		app.ResError(c, err, 400)
 	}
 
+	app.ResSuccess(c, redacted(rs))
+}
+
+// Rotate Signing Secret godoc
+// @Tags Routing Keys
+// @Summary api rotate signing secret of routing key
+// @Description api adds a new signing secret of routing key, current secrets
+// keep signing for overlap seconds. The secret is only returned here.
+// @Accept  json
+// @Produce json
+// @Param id path string true "Routing Key ID"
+// @Param Body body schema.RotateSecretParam false "Body"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/routing_keys/{id}/rotate_secret [post]
+func (r *Routing) RotateSecret(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		err := errors.New("missing routing key id")
+		logger.Error(err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	var bodyParam schema.RotateSecretParam
+	if c.Request.ContentLength > 0 {
+		if err := c.Bind(&bodyParam); err != nil {
+			logger.Error("Failed to bind body: ", err)
+			app.ResError(c, err, 400)
+			return
+		}
+	}
+
+	overlap := time.Duration(bodyParam.Overlap) * time.Second
+	if overlap <= 0 {
+		overlap = DefaultSecretOverlap
+	}
+
+	rs, err := r.service.RotateSecret(c, id, overlap)
+	if err != nil {
+		logger.Errorf("Failed to rotate secret of routing key %s, error: %s", id, err)
+		app.ResError(c, err, 400)
+		return
+	}
+
 	app.ResSuccess(c, rs)
 }
+
+// Test Filter godoc
+// @Tags Routing Keys
+// @Summary api test filter
+// @Description api evaluates a filter expression against a sample message
+// @Accept  json
+// @Produce json
+// @Param Body body schema.FilterTestParam true "Body"
+// @Security ApiKeyAuth
+// @Success 200 {object} app.Response
+// @Router /api/v1/filters/test [post]
+func (r *Routing) TestFilter(c *gin.Context) {
+	var bodyParam schema.FilterTestParam
+	if err := c.Bind(&bodyParam); err != nil {
+		logger.Error("Failed to bind body: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Validate(bodyParam); err != nil {
+		logger.Error("Body is invalid: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	rs, err := r.service.TestFilter(c, &bodyParam)
+	if err != nil {
+		logger.Error("Failed to test filter: ", err)
+		app.ResError(c, err, 400)
+		return
+	}
+
+	app.ResSuccess(c, rs)
+}
+
+// redacted returns routing key without secrets of API calls for responses
+func redacted(routingKey *models.RoutingKey) *models.RoutingKey {
+	if routingKey == nil {
+		return nil
+	}
+	rs := routingKey.Redacted()
+	return &rs
+}
@@ -5,8 +5,11 @@ import (
 	"go.uber.org/dig"
 
 	"message-queue/app/api"
+	"message-queue/app/breaker"
 	"message-queue/app/dbs"
 	"message-queue/app/grpc"
+	"message-queue/app/httpclient"
+	"message-queue/app/limiter"
 	"message-queue/app/queue"
 	repoImpl "message-queue/app/repositories/impl"
 	serviceImpl "message-queue/app/services/impl"
@@ -27,6 +30,24 @@ func BuildContainer() *dig.Container {
 		logger.Error("Failed to inject repositories", err)
 	}
 
+	// Inject circuit breakers
+	err = breaker.Inject(container)
+	if err != nil {
+		logger.Error("Failed to inject circuit breakers", err)
+	}
+
+	// Inject rate limiters
+	err = limiter.Inject(container)
+	if err != nil {
+		logger.Error("Failed to inject rate limiters", err)
+	}
+
+	// Inject API clients
+	err = httpclient.Inject(container)
+	if err != nil {
+		logger.Error("Failed to inject API clients", err)
+	}
+
 	// Inject services
 	err = serviceImpl.Inject(container)
 	if err != nil {
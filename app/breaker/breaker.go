@@ -0,0 +1,200 @@
+package breaker
+
+import (
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quangdangfit/gosdk/utils/logger"
+
+	"message-queue/config"
+)
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 // seconds
+	DefaultHalfOpenProbes   = 1
+)
+
+var (
+	ErrOpen = errors.New("circuit breaker is open")
+)
+
+// metrics are published at /debug/vars as circuit_breakers
+var metrics = expvar.NewMap("circuit_breakers")
+
+// State is the state of breaker of a host
+type State struct {
+	Host             string    `json:"host"`
+	State            string    `json:"state"`
+	Failures         int       `json:"failures"`
+	OpenedAt         time.Time `json:"opened_at,omitempty"`
+	TotalOpened      int64     `json:"total_opened"`
+	TotalRejected    int64     `json:"total_rejected"`
+	TotalFailures    int64     `json:"total_failures"`
+	TotalSuccesses   int64     `json:"total_successes"`
+	halfOpenInFlight int
+	probeSuccesses   int
+}
+
+// Breakers keeps a circuit breaker per host. A breaker opens after
+// FailureThreshold consecutive failures and rejects calls until
+// OpenTimeout passes, then it lets HalfOpenProbes calls through; it is
+// closed when they all succeed and opened again when one fails.
+type Breakers struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenProbes   int
+
+	mu     sync.Mutex
+	states map[string]*State
+}
+
+func NewBreakers() *Breakers {
+	b := Breakers{
+		failureThreshold: config.Config.Breaker.FailureThreshold,
+		openTimeout:      time.Duration(config.Config.Breaker.OpenTimeout) * time.Second,
+		halfOpenProbes:   config.Config.Breaker.HalfOpenProbes,
+		states:           make(map[string]*State),
+	}
+	if b.failureThreshold <= 0 {
+		b.failureThreshold = DefaultFailureThreshold
+	}
+	if b.openTimeout <= 0 {
+		b.openTimeout = DefaultOpenTimeout * time.Second
+	}
+	if b.halfOpenProbes <= 0 {
+		b.halfOpenProbes = DefaultHalfOpenProbes
+	}
+
+	metrics.Set("breakers", expvar.Func(func() interface{} {
+		return b.States()
+	}))
+	return &b
+}
+
+// Allow returns ErrOpen when calls to host are short-circuited, every
+// allowed call must be followed by Success, Failure or Release
+func (b *Breakers) Allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.get(host)
+	if state.State == StateOpen && time.Since(state.OpenedAt) >= b.openTimeout {
+		logger.Infof("Circuit breaker of %s is half open", host)
+		state.State = StateHalfOpen
+		state.halfOpenInFlight = 0
+		state.probeSuccesses = 0
+	}
+
+	switch state.State {
+	case StateOpen:
+		state.TotalRejected++
+		metrics.Add("rejected", 1)
+		return ErrOpen
+	case StateHalfOpen:
+		if state.halfOpenInFlight >= b.halfOpenProbes {
+			state.TotalRejected++
+			metrics.Add("rejected", 1)
+			return ErrOpen
+		}
+		state.halfOpenInFlight++
+	}
+	return nil
+}
+
+func (b *Breakers) Success(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.get(host)
+	state.TotalSuccesses++
+	state.Failures = 0
+
+	if state.State == StateHalfOpen && state.halfOpenInFlight > 0 {
+		state.halfOpenInFlight--
+		state.probeSuccesses++
+		if state.probeSuccesses >= b.halfOpenProbes {
+			logger.Infof("Circuit breaker of %s is closed", host)
+			state.State = StateClosed
+		}
+	}
+}
+
+func (b *Breakers) Failure(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.get(host)
+	state.TotalFailures++
+	state.Failures++
+
+	if state.State == StateHalfOpen || state.State == StateClosed && state.Failures >= b.failureThreshold {
+		b.open(state)
+	}
+}
+
+// Release ends an allowed call which neither succeeded nor failed, e.g. it
+// is aborted or never sent, its half open probe is freed for another call
+func (b *Breakers) Release(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.get(host)
+	if state.State == StateHalfOpen && state.halfOpenInFlight > 0 {
+		state.halfOpenInFlight--
+	}
+}
+
+// Reset closes breaker of host, probes in flight are forgotten
+func (b *Breakers) Reset(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.states[host]
+	if !ok {
+		return false
+	}
+	state.State = StateClosed
+	state.Failures = 0
+	state.halfOpenInFlight = 0
+	state.probeSuccesses = 0
+	return true
+}
+
+func (b *Breakers) States() []State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make([]State, 0, len(b.states))
+	for _, state := range b.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
+
+func (b *Breakers) get(host string) *State {
+	state, ok := b.states[host]
+	if !ok {
+		state = &State{Host: host, State: StateClosed}
+		b.states[host] = state
+	}
+	return state
+}
+
+func (b *Breakers) open(state *State) {
+	logger.Warnf("Circuit breaker of %s is open after %d failures", state.Host, state.Failures)
+	state.State = StateOpen
+	state.OpenedAt = time.Now()
+	state.TotalOpened++
+	metrics.Add("opened", 1)
+}
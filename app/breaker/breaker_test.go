@@ -0,0 +1,94 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+const testHost = "api.test"
+
+func newTestBreakers() *Breakers {
+	return &Breakers{
+		failureThreshold: 2,
+		openTimeout:      time.Minute,
+		halfOpenProbes:   1,
+		states:           make(map[string]*State),
+	}
+}
+
+// halfOpen opens breaker of host and moves it past the open timeout
+func halfOpen(t *testing.T, b *Breakers) {
+	t.Helper()
+
+	for n := 0; n < b.failureThreshold; n++ {
+		b.Failure(testHost)
+	}
+	if err := b.Allow(testHost); err != ErrOpen {
+		t.Fatalf("expected open breaker, got %v", err)
+	}
+	b.states[testHost].OpenedAt = time.Now().Add(-b.openTimeout)
+}
+
+func TestBreakersResetForgetsProbes(t *testing.T) {
+	b := newTestBreakers()
+	halfOpen(t, b)
+	if err := b.Allow(testHost); err != nil {
+		t.Fatalf("expected probe allowed, got %v", err)
+	}
+
+	// The probe never finishes, e.g. its call is aborted
+	if !b.Reset(testHost) {
+		t.Fatal("expected breaker of host reset")
+	}
+	state := b.states[testHost]
+	if state.State != StateClosed || state.halfOpenInFlight != 0 || state.probeSuccesses != 0 {
+		t.Fatalf("expected closed breaker without probes, got %+v", *state)
+	}
+
+	// Probes of the next half open state are allowed and close the breaker
+	halfOpen(t, b)
+	if err := b.Allow(testHost); err != nil {
+		t.Fatalf("expected probe allowed, got %v", err)
+	}
+	b.Success(testHost)
+	if state.State != StateClosed {
+		t.Fatalf("expected breaker closed by probe, got %s", state.State)
+	}
+}
+
+func TestBreakersResetUnknownHost(t *testing.T) {
+	if newTestBreakers().Reset(testHost) {
+		t.Fatal("expected unknown host not reset")
+	}
+}
+
+func TestBreakersReleaseFreesProbe(t *testing.T) {
+	b := newTestBreakers()
+	halfOpen(t, b)
+	if err := b.Allow(testHost); err != nil {
+		t.Fatalf("expected probe allowed, got %v", err)
+	}
+	if err := b.Allow(testHost); err != ErrOpen {
+		t.Fatalf("expected second probe rejected, got %v", err)
+	}
+
+	// The probe is aborted, another call probes the host
+	b.Release(testHost)
+	if err := b.Allow(testHost); err != nil {
+		t.Fatalf("expected probe allowed after release, got %v", err)
+	}
+	state := b.states[testHost]
+	if state.State != StateHalfOpen || state.TotalSuccesses != 0 || state.TotalFailures != int64(b.failureThreshold) {
+		t.Fatalf("expected half open breaker without new results, got %+v", state)
+	}
+
+	b.Success(testHost)
+	if state.State != StateClosed {
+		t.Fatalf("expected closed breaker after probe success, got %s", state.State)
+	}
+	// Calls of closed breakers don't hold probes
+	b.Release(testHost)
+	if state.halfOpenInFlight != 0 {
+		t.Fatalf("expected no probes in flight, got %d", state.halfOpenInFlight)
+	}
+}
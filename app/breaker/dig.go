@@ -0,0 +1,9 @@
+package breaker
+
+import "go.uber.org/dig"
+
+func Inject(container *dig.Container) error {
+	_ = container.Provide(NewBreakers)
+
+	return nil
+}
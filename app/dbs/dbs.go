@@ -1,14 +1,25 @@
 package dbs
 
 import (
+	"strings"
+	"time"
+
 	"github.com/quangdangfit/gosdk/database"
-	"github.com/quangdangfit/gosdk/database/mongo"
+	"github.com/quangdangfit/gosdk/utils/logger"
+	"gopkg.in/mgo.v2"
 
 	"message-queue/config"
 )
 
+const (
+	DefaultConnectionTimeout = 10 * time.Second
+)
+
+// IDatabase is the mongo database of repositories, Close closes the session
+// dialed for it on shutdown.
 type IDatabase interface {
 	database.Mongo
+	Close()
 }
 
 func NewDatabase() IDatabase {
@@ -22,5 +33,38 @@ func NewDatabase() IDatabase {
 		Replica:      config.Config.MongoDB.Replica,
 	}
 
-	return mongo.New(dbConfig)
+	return &mongoDatabase{
+		session: dial(dbConfig),
+		name:    dbConfig.Database,
+	}
+}
+
+// dial connects mongodb as the gosdk mongo database does, the session is
+// held by the database so it can be closed.
+func dial(dbConfig database.Config) *mgo.Session {
+	timeout := DefaultConnectionTimeout
+	if dbConfig.ConnectionTimeout > 0 {
+		timeout = time.Duration(dbConfig.ConnectionTimeout) * time.Second
+	}
+	dialInfo := mgo.DialInfo{
+		Addrs:    []string{dbConfig.Hosts},
+		Timeout:  timeout,
+		Database: dbConfig.AuthDatabase,
+		Username: dbConfig.AuthUserName,
+		Password: dbConfig.AuthPassword,
+	}
+	if dbConfig.Env == "replica" {
+		dialInfo.Addrs = strings.Split(dbConfig.Hosts, ",")
+		dialInfo.ReplicaSetName = dbConfig.Replica
+	}
+
+	logger.Info("Connecting mongodb")
+	session, err := mgo.DialWithInfo(&dialInfo)
+	if err != nil {
+		logger.Fatal("Failed to connect mongodb: ", err)
+	}
+
+	session.SetSafe(&mgo.Safe{})
+	logger.Info("Mongodb connected")
+	return session
 }
@@ -0,0 +1,170 @@
+package dbs
+
+import (
+	"github.com/quangdangfit/gosdk/utils/logger"
+	"github.com/quangdangfit/gosdk/utils/paging"
+	"gopkg.in/mgo.v2"
+)
+
+// mongoDatabase implements the gosdk mongo interface on its own session,
+// each operation runs on a copy of the session like the gosdk one does.
+type mongoDatabase struct {
+	session *mgo.Session
+	name    string
+}
+
+// collection returns the collection of a session copy, the copy must be
+// closed after use
+func (db *mongoDatabase) collection(name string) (*mgo.Session, *mgo.Collection) {
+	session := db.session.Copy()
+	return session, session.DB(db.name).C(name)
+}
+
+func (db *mongoDatabase) Close() {
+	db.session.Close()
+}
+
+func (db *mongoDatabase) EnsureIndex(collectionName string, index mgo.Index) bool {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	err := collection.EnsureIndex(index)
+	if err != nil {
+		logger.Errorf("Failed to ensure index %s, error: %s", index.Name, err)
+		return false
+	}
+	return true
+}
+
+func (db *mongoDatabase) DropIndex(collectionName string, name string) bool {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	err := collection.DropIndexName(name)
+	if err != nil {
+		logger.Errorf("Failed to drop index %s, error: %s", name, err)
+		return false
+	}
+	return true
+}
+
+func (db *mongoDatabase) FindOne(collectionName string, query map[string]interface{}, sort string,
+	result interface{}) error {
+
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	cursor := collection.Find(query)
+	if sort != "" {
+		cursor = cursor.Sort(sort)
+	}
+	return cursor.One(result)
+}
+
+func (db *mongoDatabase) FindMany(collectionName string, query map[string]interface{}, sort string,
+	result interface{}) error {
+
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	cursor := collection.Find(query)
+	if sort != "" {
+		cursor = cursor.Sort(sort)
+	}
+	return cursor.All(result)
+}
+
+// FindManyPaging returns page of the documents, mgo.ErrNotFound if there is
+// none like the gosdk mongo database
+func (db *mongoDatabase) FindManyPaging(collectionName string, query map[string]interface{}, sort string,
+	page int, limit int, result interface{}) (*paging.Paging, error) {
+
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	cursor := collection.Find(query).Sort(sort)
+	total, _ := cursor.Count()
+	if total == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	pageInfo := paging.New(page, limit, total)
+	err := cursor.Skip(pageInfo.Skip).Limit(pageInfo.Limit).All(result)
+	if err == mgo.ErrNotFound {
+		return nil, err
+	}
+	return pageInfo, nil
+}
+
+func (db *mongoDatabase) PipeAll(collectionName string, pipeline interface{}, result interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	return collection.Pipe(pipeline).All(result)
+}
+
+func (db *mongoDatabase) InsertOne(collectionName string, payload interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	return collection.Insert(payload)
+}
+
+func (db *mongoDatabase) InsertMany(collectionName string, payload []interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	bulk := collection.Bulk()
+	bulk.Insert(payload...)
+	_, err := bulk.Run()
+	return err
+}
+
+func (db *mongoDatabase) Upsert(collectionName string, selector interface{}, payload interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	_, err := collection.Upsert(selector, payload)
+	return err
+}
+
+func (db *mongoDatabase) UpdateOne(collectionName string, selector interface{}, payload interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	return collection.Update(selector, payload)
+}
+
+func (db *mongoDatabase) UpdateMany(collectionName string, selector interface{}, payload interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	_, err := collection.UpdateAll(selector, payload)
+	return err
+}
+
+func (db *mongoDatabase) DeleteOne(collectionName string, selector interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	return collection.Remove(selector)
+}
+
+func (db *mongoDatabase) DeleteMany(collectionName string, selector interface{}) error {
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	_, err := collection.RemoveAll(selector)
+	return err
+}
+
+// ApplyDB updates the document of selector and returns the new document
+func (db *mongoDatabase) ApplyDB(collectionName string, selector interface{}, payload interface{},
+	result interface{}) error {
+
+	session, collection := db.collection(collectionName)
+	defer session.Close()
+
+	change := mgo.Change{Update: payload, ReturnNew: true}
+	_, err := collection.Find(selector).Apply(change, result)
+	return err
+}
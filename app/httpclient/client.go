@@ -0,0 +1,244 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"message-queue/app/models"
+)
+
+const (
+	DefaultTimeout      = 60 // seconds
+	DefaultAPIKeyHeader = "X-Api-Key"
+)
+
+var (
+	ErrInvalidCA = errors.New("failed to parse CA certificates")
+	ErrNotSent   = errors.New("request is not sent")
+)
+
+// NotSentError is returned by Do when it fails before the request is sent,
+// e.g. a header isn't rendered or the OAuth2 token isn't fetched, so the
+// API host isn't at fault.
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrNotSent, e.Err)
+}
+
+func (e *NotSentError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NotSentError) Is(target error) bool {
+	return target == ErrNotSent
+}
+
+// Clients calls APIs of routing keys. Transports are shared by routing keys
+// with the same TLS and proxy settings, so connections are reused.
+type Clients struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+	templates  map[string]*template.Template
+	tokens     *tokenCache
+}
+
+func NewClients() *Clients {
+	return &Clients{
+		transports: make(map[string]*http.Transport),
+		templates:  make(map[string]*template.Template),
+		tokens:     newTokenCache(),
+	}
+}
+
+// Do sends request by settings of config, headers are rendered with data
+func (c *Clients) Do(req *http.Request, config *models.HTTPConfig, data interface{}) (*http.Response, error) {
+	if config == nil {
+		config = &models.HTTPConfig{}
+	}
+
+	transport, err := c.transport(config)
+	if err != nil {
+		return nil, &NotSentError{Err: err}
+	}
+
+	err = c.SetHeaders(req, config, data)
+	if err != nil {
+		return nil, &NotSentError{Err: err}
+	}
+
+	err = c.authorize(req, config.Auth, transport)
+	if err != nil {
+		return nil, &NotSentError{Err: err}
+	}
+
+	client := http.Client{
+		Transport: transport,
+		Timeout:   Timeout(config),
+	}
+	return client.Do(req)
+}
+
+// Timeout returns timeout of calls by config
+func Timeout(config *models.HTTPConfig) time.Duration {
+	if config == nil || config.Timeout == 0 {
+		return DefaultTimeout * time.Second
+	}
+	return time.Duration(config.Timeout) * time.Second
+}
+
+// SetHeaders sets headers of config rendered with data, auth headers are set
+// when the request is sent
+func (c *Clients) SetHeaders(req *http.Request, config *models.HTTPConfig, data interface{}) error {
+	if config == nil {
+		return nil
+	}
+
+	for key, value := range config.Headers {
+		rendered, err := c.render(value, data)
+		if err != nil {
+			return fmt.Errorf("failed to render header %s: %w", key, err)
+		}
+		req.Header.Set(key, rendered)
+	}
+	return nil
+}
+
+func (c *Clients) authorize(req *http.Request, auth *models.HTTPAuth, transport http.RoundTripper) error {
+	if auth == nil {
+		return nil
+	}
+
+	switch auth.Type {
+	case models.HTTPAuthNone, "":
+	case models.HTTPAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	case models.HTTPAuthBasic:
+		req.SetBasicAuth(auth.Username, auth.Password)
+	case models.HTTPAuthAPIKey:
+		header := auth.Header
+		if header == "" {
+			header = DefaultAPIKeyHeader
+		}
+		req.Header.Set(header, auth.APIKey)
+	case models.HTTPAuthOAuth2:
+		token, err := c.tokens.get(auth, transport)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return fmt.Errorf("unknown auth type %s", auth.Type)
+	}
+	return nil
+}
+
+// render executes value as template when it has actions
+func (c *Clients) render(value string, data interface{}) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+
+	c.mu.Lock()
+	tmpl, ok := c.templates[value]
+	if !ok {
+		var err error
+		tmpl, err = parseTemplate(value)
+		if err != nil {
+			c.mu.Unlock()
+			return "", err
+		}
+		c.templates[value] = tmpl
+	}
+	c.mu.Unlock()
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (c *Clients) transport(config *models.HTTPConfig) (*http.Transport, error) {
+	key, err := json.Marshal(struct {
+		TLS   *models.HTTPTLS
+		Proxy string
+	}{config.TLS, config.Proxy})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if transport, ok := c.transports[string(key)]; ok {
+		return transport, nil
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	c.transports[string(key)] = transport
+	return transport, nil
+}
+
+func newTransport(config *models.HTTPConfig) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if config.TLS != nil {
+		tlsConfig := tls.Config{
+			ServerName:         config.TLS.ServerName,
+			InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+		}
+		if config.TLS.CA != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(config.TLS.CA)) {
+				return nil, ErrInvalidCA
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if config.TLS.Cert != "" || config.TLS.Key != "" {
+			cert, err := tls.X509KeyPair([]byte(config.TLS.Cert), []byte(config.TLS.Key))
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = &tlsConfig
+	}
+	return transport, nil
+}
@@ -0,0 +1,164 @@
+package httpclient
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"message-queue/app/models"
+)
+
+func TestClientsReuseTransportOfSameSettings(t *testing.T) {
+	c := NewClients()
+	transport := func(config *models.HTTPConfig) *http.Transport {
+		t.Helper()
+		transport, err := c.transport(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transport
+	}
+
+	plain := transport(&models.HTTPConfig{})
+	tlsConfig := &models.HTTPConfig{TLS: &models.HTTPTLS{ServerName: "api.test"}}
+	proxyConfig := &models.HTTPConfig{Proxy: "http://proxy.test:3128"}
+
+	// Timeout, headers and auth don't change the transport
+	if got := transport(&models.HTTPConfig{Timeout: 5, Headers: map[string]string{"X-Test": "1"},
+		Auth: &models.HTTPAuth{Type: models.HTTPAuthBearer, Token: "token"}}); got != plain {
+		t.Fatal("expected transport reused by config without TLS and proxy")
+	}
+	if got := transport(tlsConfig); got == plain || got != transport(tlsConfig) {
+		t.Fatal("expected one transport of TLS settings")
+	}
+	if got := transport(&models.HTTPConfig{TLS: &models.HTTPTLS{ServerName: "other.test"}}); got == transport(tlsConfig) {
+		t.Fatal("expected transport of other TLS settings")
+	}
+	if got := transport(proxyConfig); got == plain || got != transport(proxyConfig) {
+		t.Fatal("expected one transport of proxy")
+	}
+	if len(c.transports) != 4 {
+		t.Fatalf("expected 4 transports, got %d", len(c.transports))
+	}
+
+	if server := transport(tlsConfig).TLSClientConfig.ServerName; server != "api.test" {
+		t.Fatalf("expected server name api.test, got %s", server)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://api.test", nil)
+	proxy, err := transport(proxyConfig).Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.test:3128" {
+		t.Fatalf("expected proxy.test:3128, got %v, %v", proxy, err)
+	}
+}
+
+func TestClientsInvalidTransport(t *testing.T) {
+	c := NewClients()
+	if _, err := c.transport(&models.HTTPConfig{TLS: &models.HTTPTLS{CA: "not a certificate"}}); err != ErrInvalidCA {
+		t.Fatalf("expected %s, got %v", ErrInvalidCA, err)
+	}
+	if _, err := c.transport(&models.HTTPConfig{TLS: &models.HTTPTLS{Cert: "cert", Key: "key"}}); err == nil {
+		t.Fatal("expected error of invalid client certificate")
+	}
+	if len(c.transports) != 0 {
+		t.Fatalf("invalid transports are cached: %v", c.transports)
+	}
+}
+
+func TestClientsDoTrustsCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	c := NewClients()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := c.Do(req, nil, nil); err == nil {
+		t.Fatal("expected unknown certificate authority")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	res, err := c.Do(req, &models.HTTPConfig{TLS: &models.HTTPTLS{CA: string(ca)}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestClientsDoAuthorizes(t *testing.T) {
+	var fetches int32
+	tokenServer := newTestTokenServer(t, 3600, &fetches)
+	defer tokenServer.Close()
+
+	tests := []struct {
+		name   string
+		auth   *models.HTTPAuth
+		header string
+		value  string
+	}{
+		{name: "bearer", auth: &models.HTTPAuth{Type: models.HTTPAuthBearer, Token: "token"},
+			header: "Authorization", value: "Bearer token"},
+		{name: "basic", auth: &models.HTTPAuth{Type: models.HTTPAuthBasic, Username: "user", Password: "password"},
+			header: "Authorization", value: "Basic dXNlcjpwYXNzd29yZA=="},
+		{name: "api key", auth: &models.HTTPAuth{Type: models.HTTPAuthAPIKey, APIKey: "key"},
+			header: DefaultAPIKeyHeader, value: "key"},
+		{name: "api key header", auth: &models.HTTPAuth{Type: models.HTTPAuthAPIKey, Header: "X-Key", APIKey: "key"},
+			header: "X-Key", value: "key"},
+		{name: "oauth2", auth: newTestAuth(tokenServer.URL), header: "Authorization", value: "Bearer token-1"},
+		{name: "none", auth: &models.HTTPAuth{Type: models.HTTPAuthNone}, header: "Authorization"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := make(chan http.Header, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header
+			}))
+			defer server.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+			res, err := NewClients().Do(req, &models.HTTPConfig{Auth: test.auth}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if got := (<-headers).Get(test.header); got != test.value {
+				t.Fatalf("expected %s %q, got %q", test.header, test.value, got)
+			}
+		})
+	}
+}
+
+func TestClientsDoNotSent(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer tokenServer.Close()
+
+	tests := []struct {
+		name   string
+		config *models.HTTPConfig
+	}{
+		{name: "transport", config: &models.HTTPConfig{TLS: &models.HTTPTLS{CA: "not a certificate"}}},
+		{name: "header", config: &models.HTTPConfig{Headers: map[string]string{"X-Code": "{{.Code.Missing}}"}}},
+		{name: "auth type", config: &models.HTTPConfig{Auth: &models.HTTPAuth{Type: "digest"}}},
+		{name: "oauth2 token", config: &models.HTTPConfig{Auth: newTestAuth(tokenServer.URL)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+			_, err := NewClients().Do(req, test.config, map[string]interface{}{"Code": "1"})
+			var notSent *NotSentError
+			if !errors.Is(err, ErrNotSent) || !errors.As(err, &notSent) || notSent.Err == nil {
+				t.Fatalf("expected %s, got %v", ErrNotSent, err)
+			}
+		})
+	}
+	if calls != 0 {
+		t.Fatalf("expected API isn't called, got %d calls", calls)
+	}
+}
@@ -0,0 +1,9 @@
+package httpclient
+
+import "go.uber.org/dig"
+
+func Inject(container *dig.Container) error {
+	_ = container.Provide(NewClients)
+
+	return nil
+}
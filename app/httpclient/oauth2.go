@@ -0,0 +1,103 @@
+package httpclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"message-queue/app/models"
+)
+
+const (
+	TokenRequestTimeout = 30 * time.Second
+	TokenExpiryDelta    = 30 * time.Second // tokens are renewed before they expire
+)
+
+type token struct {
+	accessToken string
+	expiry      time.Time // zero if token doesn't expire
+}
+
+// tokenCache fetches OAuth2 client credentials tokens and caches them by
+// token url, client and scopes
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*token
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[string]*token)}
+}
+
+func (c *tokenCache) get(auth *models.HTTPAuth, transport http.RoundTripper) (string, error) {
+	key := strings.Join([]string{auth.TokenURL, auth.ClientID, auth.ClientSecret,
+		strings.Join(auth.Scopes, " ")}, "\n")
+
+	c.mu.Lock()
+	cached, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && (cached.expiry.IsZero() || time.Now().Add(TokenExpiryDelta).Before(cached.expiry)) {
+		return cached.accessToken, nil
+	}
+
+	fetched, err := fetchToken(auth, transport)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.tokens[key] = fetched
+	c.mu.Unlock()
+	return fetched.accessToken, nil
+}
+
+func fetchToken(auth *models.HTTPAuth, transport http.RoundTripper) (*token, error) {
+	if auth.TokenURL == "" || auth.ClientID == "" {
+		return nil, errors.New("oauth2 auth requires token_url and client_id")
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.ClientSecret))
+
+	client := http.Client{Transport: transport, Timeout: TokenRequestTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch oauth2 token: %s", res.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("oauth2 token response has no access_token")
+	}
+
+	fetched := token{accessToken: body.AccessToken}
+	if body.ExpiresIn > 0 {
+		fetched.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return &fetched, nil
+}
@@ -0,0 +1,148 @@
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"message-queue/app/models"
+)
+
+// newTestTokenServer issues numbered tokens which expire in expiresIn
+// seconds, fetches counts the issued tokens
+func newTestTokenServer(t *testing.T, expiresIn int64, fetches *int32) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(fetches, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "scope": %q, "expires_in": %d}`,
+			n, r.FormValue("scope"), expiresIn)
+	}))
+}
+
+func newTestAuth(tokenURL string, scopes ...string) *models.HTTPAuth {
+	return &models.HTTPAuth{Type: models.HTTPAuthOAuth2, TokenURL: tokenURL, ClientID: "client",
+		ClientSecret: "secret", Scopes: scopes}
+}
+
+func TestTokenCacheReusesToken(t *testing.T) {
+	var fetches int32
+	server := newTestTokenServer(t, 3600, &fetches)
+	defer server.Close()
+
+	cache := newTokenCache()
+	for n := 0; n < 3; n++ {
+		token, err := cache.get(newTestAuth(server.URL, "read"), http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token-1" {
+			t.Fatalf("expected cached token-1, got %s", token)
+		}
+	}
+
+	// Tokens are cached by client and scopes
+	token, err := cache.get(newTestAuth(server.URL, "read", "write"), http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token-2" || atomic.LoadInt32(&fetches) != 2 {
+		t.Fatalf("expected token-2 of other scopes, got %s after %d fetches", token, fetches)
+	}
+}
+
+func TestTokenCacheRenewsExpiringToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int64
+		renewed   bool
+	}{
+		{name: "expiring", expiresIn: 10, renewed: true}, // within TokenExpiryDelta
+		{name: "valid", expiresIn: 60, renewed: false},
+		{name: "without expiry", expiresIn: 0, renewed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fetches int32
+			server := newTestTokenServer(t, test.expiresIn, &fetches)
+			defer server.Close()
+
+			cache := newTokenCache()
+			auth := newTestAuth(server.URL)
+			first, err := cache.get(auth, http.DefaultTransport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := cache.get(auth, http.DefaultTransport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if renewed := first != second; renewed != test.renewed {
+				t.Fatalf("expected renewed %t, got %s then %s", test.renewed, first, second)
+			}
+		})
+	}
+}
+
+func TestTokenCacheRenewsExpiredToken(t *testing.T) {
+	var fetches int32
+	server := newTestTokenServer(t, 3600, &fetches)
+	defer server.Close()
+
+	cache := newTokenCache()
+	auth := newTestAuth(server.URL)
+	if _, err := cache.get(auth, http.DefaultTransport); err != nil {
+		t.Fatal(err)
+	}
+	for _, cached := range cache.tokens {
+		cached.expiry = time.Now().Add(-time.Second)
+	}
+
+	token, err := cache.get(auth, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token-2" {
+		t.Fatalf("expected renewed token-2, got %s", token)
+	}
+}
+
+func TestTokenCacheErrors(t *testing.T) {
+	var fetches int32
+	server := newTestTokenServer(t, 3600, &fetches)
+	defer server.Close()
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"expires_in": 3600}`))
+	}))
+	defer empty.Close()
+
+	unauthorized := newTestAuth(server.URL)
+	unauthorized.ClientSecret = "wrong"
+	tests := []struct {
+		name string
+		auth *models.HTTPAuth
+	}{
+		{name: "without token url", auth: newTestAuth("")},
+		{name: "unauthorized", auth: unauthorized},
+		{name: "without access token", auth: newTestAuth(empty.URL)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newTokenCache()
+			if _, err := cache.get(test.auth, http.DefaultTransport); err == nil {
+				t.Fatal("expected error")
+			}
+			if len(cache.tokens) != 0 {
+				t.Fatalf("failed token is cached: %v", cache.tokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package httpclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"message-queue/app/models"
+)
+
+var funcs = template.FuncMap{
+	// json writes value as a JSON literal, e.g. `{"id": {{json .Payload.id}}}`
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// ValidateTemplate returns an error when value is not a valid template
+func ValidateTemplate(value string) error {
+	_, err := parseTemplate(value)
+	return err
+}
+
+func parseTemplate(value string) (*template.Template, error) {
+	return template.New("").Funcs(funcs).Option("missingkey=zero").Parse(value)
+}
+
+// NewRequest returns the API request of message transformed by transform,
+// with its body which is signed by the caller
+func (c *Clients) NewRequest(method, rawURL string, transform *models.Transform,
+	message *models.InMessage) (*http.Request, []byte, error) {
+
+	if transform == nil {
+		transform = &models.Transform{}
+	}
+
+	body, err := json.Marshal(message.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if transform.Body != "" {
+		rendered, err := c.render(transform.Body, message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render body: %w", err)
+		}
+		body = []byte(rendered)
+	}
+
+	apiURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if transform.Path != "" {
+		path, err := c.render(transform.Path, message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render path: %w", err)
+		}
+		apiURL.Path = strings.TrimSuffix(apiURL.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	if len(transform.Query) > 0 {
+		query := apiURL.Query()
+		for key, value := range transform.Query {
+			rendered, err := c.render(value, message)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to render query %s: %w", key, err)
+			}
+			query.Set(key, rendered)
+		}
+		apiURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequest(method, apiURL.String(), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range transform.Headers {
+		rendered, err := c.render(value, message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render header %s: %w", key, err)
+		}
+		req.Header.Set(key, rendered)
+	}
+	return req, body, nil
+}
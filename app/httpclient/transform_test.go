@@ -0,0 +1,118 @@
+package httpclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"message-queue/app/models"
+)
+
+func newTestMessage() *models.InMessage {
+	return &models.InMessage{
+		RoutingKey: models.RoutingKey{Name: "order.created"},
+		Payload:    map[string]interface{}{"id": "1", "total": 120, "customer": map[string]interface{}{"name": "An"}},
+		Headers:    models.Headers{OriginModel: "order", OriginCode: "1"},
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		transform   *models.Transform
+		expectedURL string
+		body        string
+		contentType string
+		headers     map[string]string
+	}{
+		{name: "payload", url: "http://api.test/orders", expectedURL: "http://api.test/orders",
+			body: `{"customer":{"name":"An"},"id":"1","total":120}`, contentType: "application/json"},
+		{name: "body", url: "http://api.test/orders",
+			transform: &models.Transform{
+				Body: `{"order_id": {{json .Payload.id}}, "customer": {{json .Payload.customer}}, "code": "{{.OriginCode}}"}`},
+			expectedURL: "http://api.test/orders",
+			body:        `{"order_id": "1", "customer": {"name":"An"}, "code": "1"}`,
+			contentType: "application/json"},
+		{name: "path and query", url: "http://api.test/orders/?source=gomq",
+			transform: &models.Transform{Path: "/{{.Payload.id}}/confirm",
+				Query: map[string]string{"model": "{{.OriginModel}}", "key": "{{.RoutingKey.Name}}"}},
+			expectedURL: "http://api.test/orders/1/confirm?key=order.created&model=order&source=gomq",
+			body:        `{"customer":{"name":"An"},"id":"1","total":120}`,
+			contentType: "application/json"},
+		{name: "headers", url: "http://api.test/orders",
+			transform: &models.Transform{Body: `id={{.Payload.id}}`, Headers: map[string]string{
+				"Content-Type": "application/x-www-form-urlencoded", "X-Origin": "{{.OriginModel}}-{{.OriginCode}}"}},
+			expectedURL: "http://api.test/orders", body: "id=1",
+			contentType: "application/x-www-form-urlencoded",
+			headers:     map[string]string{"X-Origin": "order-1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, body, err := NewClients().NewRequest(http.MethodPost, test.url, test.transform, newTestMessage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.URL.String() != test.expectedURL {
+				t.Fatalf("expected url %s, got %s", test.expectedURL, req.URL)
+			}
+			if string(body) != test.body {
+				t.Fatalf("expected body %s, got %s", test.body, body)
+			}
+			// The request sends the body which is signed
+			if sent, _ := ioutil.ReadAll(req.Body); string(sent) != test.body {
+				t.Fatalf("expected request body %s, got %s", test.body, sent)
+			}
+			if got := req.Header.Get("Content-Type"); got != test.contentType {
+				t.Fatalf("expected content type %s, got %s", test.contentType, got)
+			}
+			for key, value := range test.headers {
+				if got := req.Header.Get(key); got != value {
+					t.Fatalf("expected header %s %q, got %q", key, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRequestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform *models.Transform
+		error     string
+	}{
+		{name: "body", transform: &models.Transform{Body: `{{.Payload.id.missing}}`}, error: "render body"},
+		{name: "path", transform: &models.Transform{Path: `{{.Missing}}`}, error: "render path"},
+		{name: "query", transform: &models.Transform{Query: map[string]string{"id": `{{.Payload.id`}},
+			error: "render query id"},
+		{name: "header", transform: &models.Transform{Headers: map[string]string{"X-Id": `{{json}}`}},
+			error: "render header X-Id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := NewClients().NewRequest(http.MethodPost, "http://api.test", test.transform, newTestMessage())
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected error to %s, got %v", test.error, err)
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{value: "static", valid: true},
+		{value: `{"id": {{json .Payload.id}}}`, valid: true},
+		{value: `{{.Payload.id`, valid: false},
+		{value: `{{unknown .Payload}}`, valid: false},
+		{value: `{{end}}`, valid: false},
+	}
+	for _, test := range tests {
+		if err := ValidateTemplate(test.value); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t, got %v", test.value, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package limiter
+
+import "go.uber.org/dig"
+
+func Inject(container *dig.Container) error {
+	_ = container.Provide(NewLimiters)
+
+	return nil
+}
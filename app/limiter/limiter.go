@@ -0,0 +1,140 @@
+package limiter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quangdangfit/gosdk/utils/logger"
+
+	"message-queue/config"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+
+	DefaultLeaseTimeout = 120 // seconds
+	DefaultRedisPrefix  = "gomq:limit:"
+
+	LeaseMargin    = 10 * time.Second
+	SlotRetryAfter = time.Second
+)
+
+var (
+	ErrLimited = errors.New("rate limit or max in-flight of routing key is exceeded")
+)
+
+// LimitedError is ErrLimited with the wait before the key may be called again
+type LimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return ErrLimited.Error()
+}
+
+func (e *LimitedError) Is(target error) bool {
+	return target == ErrLimited
+}
+
+// Limiter keeps token buckets and in-flight slots of keys
+type Limiter interface {
+	// Take takes a token of the bucket of key, it returns the wait before a
+	// token is available when the bucket is empty
+	Take(key string, rate float64, burst int) (time.Duration, error)
+	// Acquire takes an in-flight slot of key for a call of timeout, it
+	// returns false when max slots are taken
+	Acquire(key, lease string, max int, timeout time.Duration) (bool, error)
+	Release(key, lease string) error
+}
+
+// Limiters limits calls of routing keys across replicas by the shared
+// limiter, the in-process limiter is used while the shared one fails.
+type Limiters struct {
+	shared Limiter
+	local  Limiter
+}
+
+func NewLimiters() *Limiters {
+	l := Limiters{
+		local: newMemoryLimiter(),
+	}
+
+	switch config.Config.Limiter.Backend {
+	case BackendRedis:
+		l.shared = newRedisLimiter()
+	case BackendMemory, "":
+	default:
+		logger.Warnf("Unknown limiter backend %s, limit in process", config.Config.Limiter.Backend)
+	}
+	return &l
+}
+
+// Acquire takes an in-flight slot and a token of rate limit of key for a
+// call of timeout without waiting, it returns a LimitedError when either is
+// not available. Release must be called when the call is done. Zero rate or
+// max in-flight is unlimited.
+func (l *Limiters) Acquire(key string, rate float64, burst, maxInFlight int, timeout time.Duration) (release func(), err error) {
+	release = func() {}
+
+	// The slot is taken first, so tokens aren't used by calls which can't run
+	if maxInFlight > 0 {
+		lease := uuid.New().String()
+		ok, err := l.acquire(key, lease, maxInFlight, timeout)
+		if err != nil {
+			return release, err
+		}
+		if !ok {
+			return release, &LimitedError{RetryAfter: SlotRetryAfter}
+		}
+		release = func() { l.release(key, lease) }
+	}
+
+	if rate > 0 {
+		if burst <= 0 {
+			burst = 1
+		}
+		wait, err := l.take(key, rate, burst)
+		if err == nil && wait > 0 {
+			err = &LimitedError{RetryAfter: wait}
+		}
+		if err != nil {
+			release()
+			return func() {}, err
+		}
+	}
+	return release, nil
+}
+
+func (l *Limiters) take(key string, rate float64, burst int) (time.Duration, error) {
+	if l.shared != nil {
+		wait, err := l.shared.Take(key, rate, burst)
+		if err == nil {
+			return wait, nil
+		}
+		logger.Error("Failed to take token from shared limiter, limit in process: ", err)
+	}
+	return l.local.Take(key, rate, burst)
+}
+
+func (l *Limiters) acquire(key, lease string, max int, timeout time.Duration) (bool, error) {
+	if l.shared != nil {
+		ok, err := l.shared.Acquire(key, lease, max, timeout)
+		if err == nil {
+			return ok, nil
+		}
+		logger.Error("Failed to acquire slot from shared limiter, limit in process: ", err)
+	}
+	return l.local.Acquire(key, lease, max, timeout)
+}
+
+// release releases lease from both limiters as it may be acquired by any
+func (l *Limiters) release(key, lease string) {
+	if l.shared != nil {
+		if err := l.shared.Release(key, lease); err != nil {
+			logger.Error("Failed to release slot of shared limiter: ", err)
+		}
+	}
+	l.local.Release(key, lease)
+}
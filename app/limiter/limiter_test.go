@@ -0,0 +1,105 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestLimitersAcquireDoesntWait(t *testing.T) {
+	l := &Limiters{local: newMemoryLimiter()}
+
+	tests := []struct {
+		name        string
+		rate        float64
+		maxInFlight int
+		retryAfter  time.Duration
+	}{
+		{name: "rate limit", rate: 0.5, retryAfter: 2 * time.Second},
+		{name: "max in-flight", maxInFlight: 1, retryAfter: SlotRetryAfter},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release, err := l.Acquire(test.name, test.rate, 1, test.maxInFlight, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+
+			start := time.Now()
+			_, err = l.Acquire(test.name, test.rate, 1, test.maxInFlight, time.Minute)
+			var limited *LimitedError
+			if !errors.As(err, &limited) || !errors.Is(err, ErrLimited) {
+				t.Fatalf("expected limited error, got %v", err)
+			}
+			if time.Since(start) > 100*time.Millisecond {
+				t.Fatalf("acquire waits %s", time.Since(start))
+			}
+			if limited.RetryAfter <= 0 || limited.RetryAfter > test.retryAfter {
+				t.Fatalf("expected retry after at most %s, got %s", test.retryAfter, limited.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestLimitersAcquireKeepsTokenWhenSlotIsTaken(t *testing.T) {
+	l := &Limiters{local: newMemoryLimiter()}
+
+	release, err := l.Acquire("key", 0.1, 2, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("key", 0.1, 2, 1, time.Minute); !errors.Is(err, ErrLimited) {
+		t.Fatalf("expected limited by max in-flight, got %v", err)
+	}
+	release()
+
+	// The second token of the burst wasn't used by the rejected call
+	release, err = l.Acquire("key", 0.1, 2, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("expected token left, got %v", err)
+	}
+	release()
+}
+
+func TestRedisLimiterKeepsSlotForCallTimeout(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	l := &redisLimiter{client: client, prefix: DefaultRedisPrefix, leaseTimeout: DefaultLeaseTimeout * time.Second}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ttl     time.Duration
+	}{
+		{name: "lease timeout", timeout: time.Minute, ttl: DefaultLeaseTimeout * time.Second},
+		{name: "call timeout", timeout: 5 * time.Minute, ttl: 5*time.Minute + LeaseMargin},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := l.Acquire(test.name, "lease", 1, test.timeout)
+			if err != nil || !ok {
+				t.Fatalf("expected slot acquired, got %v, %v", ok, err)
+			}
+
+			key := DefaultRedisPrefix + "inflight:" + test.name
+			expiry, err := client.ZScore(context.Background(), key, "lease").Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ttl := time.Until(time.Unix(0, int64(expiry)*int64(time.Millisecond)))
+			if ttl < test.ttl-time.Second || ttl > test.ttl+time.Second {
+				t.Fatalf("expected slot kept for %s, got %s", test.ttl, ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryLimiter limits calls of this process only
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	slots   map[string]map[string]bool // key -> leases
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{
+		buckets: make(map[string]*memoryBucket),
+		slots:   make(map[string]map[string]bool),
+	}
+}
+
+func (l *memoryLimiter) Take(key string, rate float64, burst int) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, nil
+	}
+	return time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), nil
+}
+
+// Acquire doesn't expire slots, they are released by this process
+func (l *memoryLimiter) Acquire(key, lease string, max int, timeout time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	leases, ok := l.slots[key]
+	if !ok {
+		leases = make(map[string]bool)
+		l.slots[key] = leases
+	}
+	if len(leases) >= max {
+		return false, nil
+	}
+	leases[lease] = true
+	return true, nil
+}
+
+func (l *memoryLimiter) Release(key, lease string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.slots[key], lease)
+	return nil
+}
@@ -0,0 +1,106 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"message-queue/config"
+)
+
+// takeScript refills the bucket by elapsed time of redis clock, then takes a
+// token or returns milliseconds to wait for one
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return wait
+`)
+
+// acquireScript keeps leases in a sorted set scored by expiry, so slots of
+// crashed replicas are freed after their ttl
+var acquireScript = redis.NewScript(`
+local max = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= max then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// redisLimiter shares buckets and slots between replicas
+type redisLimiter struct {
+	client       *redis.Client
+	prefix       string
+	leaseTimeout time.Duration
+}
+
+func newRedisLimiter() *redisLimiter {
+	l := redisLimiter{
+		client: redis.NewClient(&redis.Options{
+			Addr:     config.Config.Redis.Addr,
+			Password: config.Config.Redis.Password,
+			DB:       config.Config.Redis.DB,
+		}),
+		prefix:       config.Config.Limiter.Prefix,
+		leaseTimeout: time.Duration(config.Config.Limiter.LeaseTimeout) * time.Second,
+	}
+	if l.prefix == "" {
+		l.prefix = DefaultRedisPrefix
+	}
+	if l.leaseTimeout <= 0 {
+		l.leaseTimeout = DefaultLeaseTimeout * time.Second
+	}
+	return &l
+}
+
+func (l *redisLimiter) Take(key string, rate float64, burst int) (time.Duration, error) {
+	wait, err := takeScript.Run(context.Background(), l.client,
+		[]string{l.prefix + "rate:" + key}, rate, burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// Acquire keeps the slot for lease timeout, or longer than timeout of the
+// call so slots of running calls don't expire
+func (l *redisLimiter) Acquire(key, lease string, max int, timeout time.Duration) (bool, error) {
+	ttl := l.leaseTimeout
+	if timeout+LeaseMargin > ttl {
+		ttl = timeout + LeaseMargin
+	}
+
+	ok, err := acquireScript.Run(context.Background(), l.client,
+		[]string{l.prefix + "inflight:" + key}, lease, max, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return ok == 1, nil
+}
+
+func (l *redisLimiter) Release(key, lease string) error {
+	return l.client.ZRem(context.Background(), l.prefix+"inflight:"+key, lease).Err()
+}
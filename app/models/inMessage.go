@@ -10,11 +10,13 @@ const (
 	InMessageStatusReceived    = "received"
 	InMessageStatusSuccess     = "success"
 	InMessageStatusWaitRetry   = "wait_retry"
+	InMessageStatusRetrying    = "retrying"
 	InMessageStatusWorking     = "working"
 	InMessageStatusFailed      = "failed"
 	InMessageStatusInvalid     = "invalid"
 	InMessageStatusWaitPrevMsg = "wait_prev_msg"
 	InMessageStatusCanceled    = "canceled"
+	InMessageStatusFiltered    = "filtered"
 )
 
 type InMessage struct {
@@ -26,6 +28,26 @@ type InMessage struct {
 	Attempts   uint          `json:"attempts" bson:"attempts"`
 	Headers    `json:",inline" bson:",inline"`
 
+	// LastAttemptAt is when the API was called last, NextAttemptAt is when
+	// a wait_retry message is due for the retry cronjob
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty" bson:"last_attempt_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty" bson:"next_attempt_at,omitempty"`
+
+	// Deliveries are states of subscriptions of routing key, the message is
+	// wait_retry while any subscription is
+	Deliveries []SubscriptionDelivery `json:"deliveries,omitempty" bson:"deliveries,omitempty"`
+
 	CreatedTime time.Time `json:"created_time" bson:"created_time"`
 	UpdatedTime time.Time `json:"updated_time" bson:"updated_time"`
 }
+
+// SubscriptionDelivery is the delivery state of in message to a subscription,
+// only subscriptions which are not done are called again on retry
+type SubscriptionDelivery struct {
+	SubscriptionID string        `json:"subscription_id" bson:"subscription_id"`
+	Status         string        `json:"status,omitempty" bson:"status,omitempty"`
+	Attempts       uint          `json:"attempts" bson:"attempts"`
+	Logs           []interface{} `json:"logs,omitempty" bson:"logs,omitempty"`
+	LastAttemptAt  *time.Time    `json:"last_attempt_at,omitempty" bson:"last_attempt_at,omitempty"`
+	NextAttemptAt  *time.Time    `json:"next_attempt_at,omitempty" bson:"next_attempt_at,omitempty"`
+}
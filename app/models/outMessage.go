@@ -13,6 +13,9 @@ const (
 	OutMessageStatusFailed   = "failed"
 	OutMessageStatusCanceled = "canceled"
 	OutMessageStatusInvalid  = "invalid"
+
+	// OutMessageStatusUnroutable means no queue is bound for the routing key
+	OutMessageStatusUnroutable = "unroutable"
 )
 
 type OutMessage struct {
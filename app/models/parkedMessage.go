@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	CollectionParkedMessage = "parked_messages"
+)
+
+// ParkedMessage is a delivery rejected by the consumer and dead lettered to
+// the parking queue, BrokerHeaders keep the x-death history of the broker.
+// Body is kept when payload is not a valid json.
+type ParkedMessage struct {
+	ID            string                 `json:"id,omitempty" bson:"id,omitempty"`
+	Exchange      string                 `json:"exchange,omitempty" bson:"exchange,omitempty"`
+	RoutingKey    string                 `json:"routing_key,omitempty" bson:"routing_key,omitempty"`
+	Queue         string                 `json:"queue,omitempty" bson:"queue,omitempty"`
+	Reason        string                 `json:"reason,omitempty" bson:"reason,omitempty"`
+	Payload       interface{}            `json:"payload,omitempty" bson:"payload,omitempty"`
+	Body          string                 `json:"body,omitempty" bson:"body,omitempty"`
+	BrokerHeaders map[string]interface{} `json:"broker_headers,omitempty" bson:"broker_headers,omitempty"`
+	Headers       `json:",inline" bson:",inline"`
+
+	CreatedTime time.Time `json:"created_time" bson:"created_time"`
+}
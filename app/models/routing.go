@@ -1,7 +1,34 @@
 package models
 
+import (
+	"time"
+)
+
 const (
 	CollectionRoutingKey = "routing_keys"
+
+	SigningSecretPrefix = "gomq_"
+
+	SubscriptionStatusActive   = "active"
+	SubscriptionStatusInactive = "inactive"
+
+	RoutingQueueModeShared = "shared"
+	RoutingQueueModeKey    = "key"
+	RoutingQueueModeGroup  = "group"
+
+	RetryBackoffFixed             = "fixed"
+	RetryBackoffExponential       = "exponential"
+	RetryBackoffExponentialJitter = "exponential_jitter"
+
+	HTTPAuthNone   = "none"
+	HTTPAuthBearer = "bearer"
+	HTTPAuthBasic  = "basic"
+	HTTPAuthAPIKey = "api_key"
+	HTTPAuthOAuth2 = "oauth2"
+
+	// RedactedSecret replaces secrets in API responses, secrets which are
+	// sent back as it are kept
+	RedactedSecret = "******"
 )
 
 type RoutingKey struct {
@@ -12,4 +39,252 @@ type RoutingKey struct {
 	APIMethod string `json:"api_method,omitempty" bson:"api_method,omitempty"`
 	APIUrl    string `json:"api_url,omitempty" bson:"api_url,omitempty"`
 	Active    bool   `json:"active,omitempty" bson:"active,omitempty"`
+
+	// Filter is a JMESPath expression of messages the API is called for,
+	// others are filtered, see package filter
+	Filter string `json:"filter,omitempty" bson:"filter,omitempty"`
+
+	// PayloadSchema is a JSON Schema of payloads, messages which don't match
+	// it are rejected when they are published and invalid when consumed. It's
+	// stored as text because mongo keys can't start with `$`.
+	PayloadSchema string `json:"payload_schema,omitempty" bson:"payload_schema,omitempty"`
+
+	// RetryDelays are seconds before each retry by broker, retry config is
+	// used when it's empty
+	RetryDelays []uint       `json:"retry_delays,omitempty" bson:"retry_delays,omitempty"`
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty" bson:"retry_policy,omitempty"`
+
+	// QueueMode consumes messages of the key from the shared queue, or from
+	// a dedicated queue of the key or of its group with own prefetch and
+	// workers, so a slow API doesn't block other keys. Other replicas than
+	// the updating one consume a new dedicated queue from their next sync.
+	QueueMode string `json:"queue_mode,omitempty" bson:"queue_mode,omitempty"`
+	Prefetch  uint   `json:"prefetch,omitempty" bson:"prefetch,omitempty"`
+	Workers   uint   `json:"workers,omitempty" bson:"workers,omitempty"`
+
+	// RateLimit is API calls per second with RateBurst calls at once, and
+	// MaxInFlight caps concurrent calls, limits are shared by replicas
+	RateLimit   float64 `json:"rate_limit,omitempty" bson:"rate_limit,omitempty"`
+	RateBurst   uint    `json:"rate_burst,omitempty" bson:"rate_burst,omitempty"`
+	MaxInFlight uint    `json:"max_in_flight,omitempty" bson:"max_in_flight,omitempty"`
+
+	HTTP      *HTTPConfig `json:"http,omitempty" bson:"http,omitempty"`
+	Transform *Transform  `json:"transform,omitempty" bson:"transform,omitempty"`
+
+	// SigningSecrets sign API calls, rotated secrets keep signing until they
+	// expire so receivers can switch to the new one
+	SigningSecrets []SigningSecret `json:"signing_secrets,omitempty" bson:"signing_secrets,omitempty"`
+
+	// Subscriptions fan messages out to several APIs, API of the routing key
+	// is not called when it has subscriptions
+	Subscriptions []Subscription `json:"subscriptions,omitempty" bson:"subscriptions,omitempty"`
+}
+
+// RetryPolicy decides how failed calls of a routing key are retried. Calls
+// are retried when the status code is in RetryableStatuses, or any non 200
+// status when it's empty; network errors are retried unless
+// RetryNetworkErrors is false. Other failures are terminal.
+type RetryPolicy struct {
+	MaxAttempts        uint   `json:"max_attempts,omitempty" bson:"max_attempts,omitempty"`
+	Backoff            string `json:"backoff,omitempty" bson:"backoff,omitempty"`
+	Delay              uint   `json:"delay,omitempty" bson:"delay,omitempty"`         // seconds before first retry
+	MaxDelay           uint   `json:"max_delay,omitempty" bson:"max_delay,omitempty"` // seconds, 0 is unlimited
+	RetryableStatuses  []int  `json:"retryable_statuses,omitempty" bson:"retryable_statuses,omitempty"`
+	RetryNetworkErrors *bool  `json:"retry_network_errors,omitempty" bson:"retry_network_errors,omitempty"`
+}
+
+// Transform shapes the API request of in message. Fields are text/template
+// executed with the in message, e.g. `{"id": {{json .Payload.id}}}`; Path
+// is appended to the API url and Query is added to its query string. The
+// payload is sent as JSON when Body is empty.
+type Transform struct {
+	Body    string            `json:"body,omitempty" bson:"body,omitempty"`
+	Path    string            `json:"path,omitempty" bson:"path,omitempty"`
+	Query   map[string]string `json:"query,omitempty" bson:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+}
+
+// HTTPConfig is how API of routing key is called. Header values may be
+// text/template executed with the in message, e.g. `{{.OriginCode}}`.
+type HTTPConfig struct {
+	Timeout uint              `json:"timeout,omitempty" bson:"timeout,omitempty"` // seconds
+	Headers map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	Auth    *HTTPAuth         `json:"auth,omitempty" bson:"auth,omitempty"`
+	TLS     *HTTPTLS          `json:"tls,omitempty" bson:"tls,omitempty"`
+	Proxy   string            `json:"proxy,omitempty" bson:"proxy,omitempty"`
+}
+
+// HTTPAuth authenticates API calls, fields are used by auth type
+type HTTPAuth struct {
+	Type string `json:"type,omitempty" bson:"type,omitempty"`
+
+	// bearer
+	Token string `json:"token,omitempty" bson:"token,omitempty"`
+
+	// basic
+	Username string `json:"username,omitempty" bson:"username,omitempty"`
+	Password string `json:"password,omitempty" bson:"password,omitempty"`
+
+	// api_key, header is X-Api-Key when it's empty
+	Header string `json:"header,omitempty" bson:"header,omitempty"`
+	APIKey string `json:"api_key,omitempty" bson:"api_key,omitempty"`
+
+	// oauth2 client credentials, tokens are cached until they expire
+	TokenURL     string   `json:"token_url,omitempty" bson:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty" bson:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty" bson:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty" bson:"scopes,omitempty"`
+}
+
+// HTTPTLS configures TLS of API calls, certificates and key are PEM encoded
+type HTTPTLS struct {
+	CA                 string `json:"ca,omitempty" bson:"ca,omitempty"`
+	Cert               string `json:"cert,omitempty" bson:"cert,omitempty"`
+	Key                string `json:"key,omitempty" bson:"key,omitempty"`
+	ServerName         string `json:"server_name,omitempty" bson:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty" bson:"insecure_skip_verify,omitempty"`
+}
+
+// SigningSecret signs API calls between CreatedAt and ExpiresAt, the secret
+// is only returned by rotation, responses of routing keys have its id
+type SigningSecret struct {
+	ID        string     `json:"id,omitempty" bson:"id,omitempty"`
+	Secret    string     `json:"secret,omitempty" bson:"secret"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+// ActiveSecrets returns secrets which are not expired at now
+func (r *RoutingKey) ActiveSecrets(now time.Time) []string {
+	var secrets []string
+	for _, secret := range r.SigningSecrets {
+		if secret.ExpiresAt == nil || now.Before(*secret.ExpiresAt) {
+			secrets = append(secrets, secret.Secret)
+		}
+	}
+	return secrets
+}
+
+// Subscription is an API receiving messages of routing key, retry policy
+// and HTTP settings of the routing key are used when they are empty
+type Subscription struct {
+	ID          string       `json:"id,omitempty" bson:"id,omitempty"`
+	Name        string       `json:"name,omitempty" bson:"name,omitempty"`
+	APIMethod   string       `json:"api_method,omitempty" bson:"api_method,omitempty"`
+	APIUrl      string       `json:"api_url,omitempty" bson:"api_url,omitempty"`
+	Status      string       `json:"status,omitempty" bson:"status,omitempty"`
+	Filter      string       `json:"filter,omitempty" bson:"filter,omitempty"`
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty" bson:"retry_policy,omitempty"`
+	HTTP        *HTTPConfig  `json:"http,omitempty" bson:"http,omitempty"`
+	Transform   *Transform   `json:"transform,omitempty" bson:"transform,omitempty"`
+}
+
+// Active reports the subscription receives messages, subscriptions without
+// status are active
+func (s *Subscription) Active() bool {
+	return s.Status == "" || s.Status == SubscriptionStatusActive
+}
+
+// Target returns the API of routing key as a subscription
+func (r *RoutingKey) Target() Subscription {
+	return Subscription{
+		Name:        r.Name,
+		APIMethod:   r.APIMethod,
+		APIUrl:      r.APIUrl,
+		RetryPolicy: r.RetryPolicy,
+		HTTP:        r.HTTP,
+		Transform:   r.Transform,
+	}
+}
+
+// Redacted returns a copy of routing key for API responses, secrets of API
+// calls of the routing key and its subscriptions are replaced and signing
+// secrets only have their ids and validity
+func (r RoutingKey) Redacted() RoutingKey {
+	r.HTTP = r.HTTP.Redacted()
+	if r.SigningSecrets != nil {
+		secrets := make([]SigningSecret, len(r.SigningSecrets))
+		for i, secret := range r.SigningSecrets {
+			secret.Secret = ""
+			secrets[i] = secret
+		}
+		r.SigningSecrets = secrets
+	}
+	if r.Subscriptions != nil {
+		subscriptions := make([]Subscription, len(r.Subscriptions))
+		for i, subscription := range r.Subscriptions {
+			subscription.HTTP = subscription.HTTP.Redacted()
+			subscriptions[i] = subscription
+		}
+		r.Subscriptions = subscriptions
+	}
+	return r
+}
+
+// KeepSecrets restores secrets of stored routing key which are sent back
+// redacted, secrets of subscriptions are restored by subscription id
+func (r *RoutingKey) KeepSecrets(stored *RoutingKey) {
+	r.HTTP.KeepSecrets(stored.HTTP)
+
+	storedSubscriptions := make(map[string]*Subscription, len(stored.Subscriptions))
+	for i := range stored.Subscriptions {
+		storedSubscriptions[stored.Subscriptions[i].ID] = &stored.Subscriptions[i]
+	}
+	for i := range r.Subscriptions {
+		if subscription, ok := storedSubscriptions[r.Subscriptions[i].ID]; ok && subscription.ID != "" {
+			r.Subscriptions[i].HTTP.KeepSecrets(subscription.HTTP)
+		}
+	}
+}
+
+// Redacted returns a copy of config with secrets replaced
+func (c *HTTPConfig) Redacted() *HTTPConfig {
+	if c == nil {
+		return nil
+	}
+
+	config := *c
+	if c.Auth != nil {
+		auth := *c.Auth
+		redact(&auth.Token)
+		redact(&auth.Password)
+		redact(&auth.APIKey)
+		redact(&auth.ClientSecret)
+		config.Auth = &auth
+	}
+	if c.TLS != nil {
+		tls := *c.TLS
+		redact(&tls.Key)
+		config.TLS = &tls
+	}
+	return &config
+}
+
+// KeepSecrets restores secrets of stored config which are redacted in c
+func (c *HTTPConfig) KeepSecrets(stored *HTTPConfig) {
+	if c == nil || stored == nil {
+		return
+	}
+
+	if c.Auth != nil && stored.Auth != nil {
+		keep(&c.Auth.Token, stored.Auth.Token)
+		keep(&c.Auth.Password, stored.Auth.Password)
+		keep(&c.Auth.APIKey, stored.Auth.APIKey)
+		keep(&c.Auth.ClientSecret, stored.Auth.ClientSecret)
+	}
+	if c.TLS != nil && stored.TLS != nil {
+		keep(&c.TLS.Key, stored.TLS.Key)
+	}
+}
+
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = RedactedSecret
+	}
+}
+
+func keep(secret *string, stored string) {
+	if *secret == RedactedSecret {
+		*secret = stored
+	}
 }
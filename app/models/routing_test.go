@@ -0,0 +1,128 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHTTPConfig() *HTTPConfig {
+	return &HTTPConfig{
+		Auth: &HTTPAuth{Type: HTTPAuthOAuth2, Token: "token", Password: "password", APIKey: "key",
+			ClientID: "client", ClientSecret: "client secret"},
+		TLS: &HTTPTLS{Cert: "cert", Key: "private key"},
+	}
+}
+
+func TestRoutingKeyRedacted(t *testing.T) {
+	routingKey := RoutingKey{
+		HTTP:          newTestHTTPConfig(),
+		Subscriptions: []Subscription{{ID: "billing", HTTP: newTestHTTPConfig()}, {ID: "search"}},
+	}
+
+	redacted := routingKey.Redacted()
+	for _, config := range []*HTTPConfig{redacted.HTTP, redacted.Subscriptions[0].HTTP} {
+		auth := config.Auth
+		for _, secret := range []string{auth.Token, auth.Password, auth.APIKey, auth.ClientSecret, config.TLS.Key} {
+			if secret != RedactedSecret {
+				t.Fatalf("expected redacted secret, got %s", secret)
+			}
+		}
+		if auth.ClientID != "client" || config.TLS.Cert != "cert" {
+			t.Fatalf("expected settings other than secrets, got %+v", *auth)
+		}
+	}
+	if redacted.Subscriptions[1].HTTP != nil {
+		t.Fatal("expected subscription without config")
+	}
+
+	// The routing key is not changed, it's still used to call APIs
+	if routingKey.HTTP.Auth.Token != "token" || routingKey.Subscriptions[0].HTTP.TLS.Key != "private key" {
+		t.Fatal("secrets of routing key are redacted")
+	}
+}
+
+func TestRoutingKeyKeepSecrets(t *testing.T) {
+	stored := RoutingKey{
+		HTTP:          newTestHTTPConfig(),
+		Subscriptions: []Subscription{{ID: "billing", HTTP: newTestHTTPConfig()}},
+	}
+
+	// Secrets sent back redacted are kept, changed ones are updated
+	update := stored.Redacted()
+	update.HTTP.Auth.Password = "new password"
+	update.KeepSecrets(&stored)
+
+	if update.HTTP.Auth.Token != "token" || update.HTTP.Auth.Password != "new password" ||
+		update.HTTP.TLS.Key != "private key" {
+		t.Fatalf("unexpected secrets %+v", *update.HTTP.Auth)
+	}
+	if update.Subscriptions[0].HTTP.Auth.ClientSecret != "client secret" {
+		t.Fatalf("secret of subscription is not kept, got %s", update.Subscriptions[0].HTTP.Auth.ClientSecret)
+	}
+}
+
+func TestRoutingKeyRedactedSigningSecrets(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	routingKey := RoutingKey{SigningSecrets: []SigningSecret{
+		{ID: "new", Secret: "gomq_new", CreatedAt: time.Now()},
+		{ID: "old", Secret: "gomq_old", CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: &expiresAt},
+	}}
+
+	data, err := json.Marshal(routingKey.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "gomq_") || strings.Contains(string(data), `"secret"`) {
+		t.Fatalf("signing secrets in response %s", data)
+	}
+
+	var redacted RoutingKey
+	json.Unmarshal(data, &redacted)
+	secrets := redacted.SigningSecrets
+	if len(secrets) != 2 || secrets[0].ID != "new" || secrets[1].ID != "old" ||
+		secrets[1].ExpiresAt == nil || !secrets[1].ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected ids and validity of secrets, got %s", data)
+	}
+	if routingKey.SigningSecrets[0].Secret != "gomq_new" {
+		t.Fatal("signing secrets of routing key are redacted")
+	}
+}
+
+func TestHTTPConfigRedacted(t *testing.T) {
+	if (*HTTPConfig)(nil).Redacted() != nil {
+		t.Fatal("expected nil config")
+	}
+
+	// Empty secrets aren't redacted, they aren't set
+	config := HTTPConfig{Auth: &HTTPAuth{Type: HTTPAuthBearer, Token: "token"}, TLS: &HTTPTLS{Cert: "cert"}}
+	redacted := config.Redacted()
+	if redacted.Auth.Token != RedactedSecret || redacted.Auth.Password != "" || redacted.TLS.Key != "" {
+		t.Fatalf("expected only set secrets redacted, got %+v %+v", *redacted.Auth, *redacted.TLS)
+	}
+}
+
+func TestHTTPConfigKeepSecrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		stored   *HTTPConfig
+		expected string
+	}{
+		{name: "redacted", token: RedactedSecret, stored: newTestHTTPConfig(), expected: "token"},
+		{name: "changed", token: "new token", stored: newTestHTTPConfig(), expected: "new token"},
+		{name: "removed", token: "", stored: newTestHTTPConfig(), expected: ""},
+		{name: "without stored config", token: RedactedSecret, expected: RedactedSecret},
+		{name: "without stored auth", token: RedactedSecret, stored: &HTTPConfig{}, expected: RedactedSecret},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := HTTPConfig{Auth: &HTTPAuth{Type: HTTPAuthBearer, Token: test.token}}
+			config.KeepSecrets(test.stored)
+			if config.Auth.Token != test.expected {
+				t.Fatalf("expected token %q, got %q", test.expected, config.Auth.Token)
+			}
+		})
+	}
+}
@@ -0,0 +1,657 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quangdangfit/gosdk/utils/logger"
+	"github.com/streadway/amqp"
+)
+
+const (
+	WaitTimeReconnect          = 5 // seconds, used by drivers dialing at startup
+	DefaultPublisherChannels   = 10
+	PublisherConfirmBufferSize = 1000
+)
+
+// amqpBroker keeps a single connection supervised by NotifyClose, it is
+// reconnected with exponential backoff and subscriptions are resumed after
+// reconnect handlers are done.
+type amqpBroker struct {
+	config     *AMQPConfig
+	dial       func(url string) (amqpConnection, error)
+	mu         sync.Mutex
+	connection amqpConnection
+	channels   []*amqp.Channel // consuming channels, closed with broker
+
+	pool []*amqpPublishChannel
+	next uint64
+
+	management *management
+
+	health      Health
+	closed      bool
+	done        chan struct{}
+	reconnected chan struct{} // closed and replaced on every reconnection
+	onReconnect []func()
+}
+
+// amqpConnection is the part of amqp.Connection the broker uses
+type amqpConnection interface {
+	Channel() (*amqp.Channel, error)
+	IsClosed() bool
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+func dialAMQP(url string) (amqpConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func NewAMQPBroker(config *AMQPConfig) Broker {
+	return newAMQPBroker(config, dialAMQP)
+}
+
+func newAMQPBroker(config *AMQPConfig, dial func(url string) (amqpConnection, error)) *amqpBroker {
+	if config.Channels <= 0 {
+		config.Channels = DefaultPublisherChannels
+	}
+
+	b := amqpBroker{
+		config:      config,
+		dial:        dial,
+		management:  newManagement(config.ManagementURL, config.AMQPUrl),
+		done:        make(chan struct{}),
+		reconnected: make(chan struct{}),
+	}
+	_, err := b.newConnection()
+	if err != nil {
+		logger.Error("AMQP broker create new connection failed!")
+	}
+
+	b.pool = make([]*amqpPublishChannel, config.Channels)
+	for i := range b.pool {
+		b.pool[i] = &amqpPublishChannel{broker: &b}
+	}
+
+	return &b
+}
+
+// DeadLetters reports rejected deliveries are dead lettered by the server
+// following x-dead-letter-exchange argument of the queue
+func (b *amqpBroker) DeadLetters() bool {
+	return true
+}
+
+func (b *amqpBroker) OnReconnect(handler func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onReconnect = append(b.onReconnect, handler)
+}
+
+func (b *amqpBroker) Health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health
+}
+
+func (b *amqpBroker) setHealth(state string, err error) {
+	b.health = Health{State: state, Since: time.Now()}
+	if err != nil {
+		b.health.Error = err.Error()
+	}
+}
+
+// newConnection dials until success or the broker is closed
+func (b *amqpBroker) newConnection() (amqpConnection, error) {
+	wait := newBackoff()
+	conn, err := b.dial(b.config.AMQPUrl)
+	for err != nil {
+		logger.Error("Failed to create new connection to AMQP: ", err)
+		b.mu.Lock()
+		b.setHealth(BrokerReconnecting, err)
+		b.mu.Unlock()
+
+		delay := wait.next()
+		logger.Infof("Sleep %s to reconnect", delay)
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return nil, ErrBrokerClosed
+		}
+		conn, err = b.dial(b.config.AMQPUrl)
+	}
+
+	b.mu.Lock()
+	b.connection = conn
+	b.setHealth(BrokerConnected, nil)
+	b.mu.Unlock()
+
+	notify := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go b.supervise(notify)
+	return conn, nil
+}
+
+// supervise waits the connection is closed by the server or network error,
+// then reconnects and runs reconnect handlers before waking subscriptions
+func (b *amqpBroker) supervise(notify chan *amqp.Error) {
+	amqpErr, ok := <-notify
+	if !ok || amqpErr == nil {
+		return
+	}
+
+	logger.Error("AMQP connection is closed: ", amqpErr)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.setHealth(BrokerReconnecting, amqpErr)
+	b.mu.Unlock()
+
+	if _, err := b.newConnection(); err != nil {
+		return
+	}
+	logger.Info("Reconnected to AMQP")
+
+	b.mu.Lock()
+	handlers := append([]func(){}, b.onReconnect...)
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler()
+	}
+
+	b.mu.Lock()
+	close(b.reconnected)
+	b.reconnected = make(chan struct{})
+	b.mu.Unlock()
+}
+
+func (b *amqpBroker) newChannel() (*amqp.Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.connection == nil || b.connection.IsClosed() {
+		logger.Error("Connection is not open, cannot create new channel")
+		return nil, fmt.Errorf("Connection is not open")
+	}
+
+	channel, err := b.connection.Channel()
+	if err != nil {
+		logger.Error("Failed to new channel: ", err)
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (b *amqpBroker) DeclareExchange(spec ExchangeSpec) error {
+	channel, err := b.newChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err := channel.ExchangeDeclare(
+		spec.Name,             // name
+		spec.Kind,             // type
+		spec.Durable,          // durable
+		spec.AutoDelete,       // auto-deleted
+		false,                 // internal
+		false,                 // noWait
+		amqp.Table(spec.Args), // arguments
+	); err != nil {
+		logger.Error("Failed to declare exchange: ", err)
+		return err
+	}
+
+	logger.Info("Declared exchange: ", spec.Name)
+	return nil
+}
+
+func (b *amqpBroker) DeclareQueue(spec QueueSpec) error {
+	channel, err := b.newChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if _, err := channel.QueueDeclare(
+		spec.Name,             // name
+		spec.Durable,          // durable
+		spec.AutoDelete,       // auto-deleted
+		false,                 // exclusive
+		false,                 // noWait
+		amqp.Table(spec.Args), // arguments
+	); err != nil {
+		logger.Error("Failed to declare queue: ", err)
+		return err
+	}
+
+	logger.Info("Declared queue: ", spec.Name)
+	return nil
+}
+
+// ExchangeExists checks exchange by a passive declare, the channel is closed
+// by the server when the exchange doesn't exist.
+func (b *amqpBroker) ExchangeExists(name string) (bool, error) {
+	channel, err := b.newChannel()
+	if err != nil {
+		return false, err
+	}
+	defer channel.Close()
+
+	err = channel.ExchangeDeclarePassive(name, "", false, false, false, false, nil)
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *amqpBroker) QueueExists(name string) (bool, error) {
+	channel, err := b.newChannel()
+	if err != nil {
+		return false, err
+	}
+	defer channel.Close()
+
+	_, err = channel.QueueInspect(name)
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ExchangeMatches redeclares the existing exchange, the server refuses it
+// with PRECONDITION_FAILED when its kind, options or arguments differ.
+func (b *amqpBroker) ExchangeMatches(spec ExchangeSpec) (bool, string, error) {
+	channel, err := b.newChannel()
+	if err != nil {
+		return false, "", err
+	}
+	defer channel.Close()
+
+	err = channel.ExchangeDeclare(spec.Name, spec.Kind, spec.Durable, spec.AutoDelete,
+		false, false, amqp.Table(spec.Args))
+	return preconditionMatches(err)
+}
+
+// QueueMatches redeclares the existing queue, the server refuses it with
+// PRECONDITION_FAILED when its options or arguments differ.
+func (b *amqpBroker) QueueMatches(spec QueueSpec) (bool, string, error) {
+	channel, err := b.newChannel()
+	if err != nil {
+		return false, "", err
+	}
+	defer channel.Close()
+
+	_, err = channel.QueueDeclare(spec.Name, spec.Durable, spec.AutoDelete,
+		false, false, amqp.Table(spec.Args))
+	return preconditionMatches(err)
+}
+
+func preconditionMatches(err error) (bool, string, error) {
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		return false, amqpErr.Reason, nil
+	}
+	return err == nil, "", err
+}
+
+func (b *amqpBroker) BindQueue(queue, exchange, routingKey string) error {
+	channel, err := b.newChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err := channel.QueueBind(
+		queue,      // name
+		routingKey, // key
+		exchange,   // exchange
+		false,      // noWait
+		nil,        // args
+	); err != nil {
+		logger.Error("Failed to bind queue: ", err)
+		return err
+	}
+	return nil
+}
+
+// Bindings lists bindings of exchange from the management API, it fails with
+// ErrManagementNotConfigured when management url is not set
+func (b *amqpBroker) Bindings(exchange string) ([]Binding, error) {
+	return b.management.bindings(exchange)
+}
+
+func (b *amqpBroker) UnbindQueue(queue, exchange, routingKey string) error {
+	channel, err := b.newChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err := channel.QueueUnbind(
+		queue,      // name
+		routingKey, // key
+		exchange,   // exchange
+		nil,        // args
+	); err != nil {
+		logger.Error("Failed to unbind queue: ", err)
+		return err
+	}
+	return nil
+}
+
+// Publish sends message on a pooled confirm mode channel, confirm is called
+// from the channel's confirm listener when the broker acks or nacks it.
+func (b *amqpBroker) Publish(exchange string, msg *Message, confirm ConfirmFunc) error {
+	index := atomic.AddUint64(&b.next, 1)
+	return b.pool[index%uint64(len(b.pool))].publish(exchange, msg, confirm)
+}
+
+// Subscribe consumes queue on a dedicated channel, the subscription is
+// resumed when the channel or connection is closed until broker is closed.
+func (b *amqpBroker) Subscribe(queue string, prefetch int) (<-chan Delivery, error) {
+	channel, msgs, err := b.consume(queue, prefetch)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			for msg := range msgs {
+				select {
+				case deliveries <- newAMQPDelivery(msg):
+				case <-b.done:
+					return
+				}
+			}
+
+			b.removeChannel(channel)
+			channel, msgs = b.resubscribe(queue, prefetch)
+			if msgs == nil {
+				return
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+func newAMQPDelivery(msg amqp.Delivery) Delivery {
+	return Delivery{
+		Message: Message{
+			ID:          msg.MessageId,
+			RoutingKey:  msg.RoutingKey,
+			Headers:     msg.Headers,
+			ContentType: msg.ContentType,
+			Body:        msg.Body,
+		},
+		Redelivered:  msg.Redelivered,
+		Acknowledger: &amqpAcknowledger{delivery: msg},
+	}
+}
+
+func (b *amqpBroker) consume(queue string, prefetch int) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := b.newChannel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = channel.Qos(prefetch, 0, false)
+	if err != nil {
+		logger.Error("Error setting qos: ", err)
+		channel.Close()
+		return nil, nil, err
+	}
+
+	msgs, err := channel.Consume(
+		queue, // name
+		"",    // consumerTag,
+		false, // noAck
+		false, // exclusive
+		false, // noLocal
+		false, // noWait
+		nil,   // arguments
+	)
+	if err != nil {
+		logger.Error("Failed to consume queue: ", err)
+		channel.Close()
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	b.channels = append(b.channels, channel)
+	b.mu.Unlock()
+
+	return channel, msgs, nil
+}
+
+// resubscribe consumes queue again after its channel is closed, it retries
+// on reconnection or backoff, and returns nil when broker is closed
+func (b *amqpBroker) resubscribe(queue string, prefetch int) (*amqp.Channel, <-chan amqp.Delivery) {
+	wait := newBackoff()
+	for {
+		b.mu.Lock()
+		closed, reconnected := b.closed, b.reconnected
+		b.mu.Unlock()
+		if closed {
+			return nil, nil
+		}
+
+		channel, msgs, err := b.consume(queue, prefetch)
+		if err == nil {
+			logger.Info("Resubscribed queue: ", queue)
+			return channel, msgs
+		}
+
+		select {
+		case <-reconnected:
+		case <-time.After(wait.next()):
+		case <-b.done:
+			return nil, nil
+		}
+	}
+}
+
+func (b *amqpBroker) removeChannel(channel *amqp.Channel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, c := range b.channels {
+		if c == channel {
+			b.channels = append(b.channels[:i:i], b.channels[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *amqpBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+
+	channels := b.channels
+	b.channels = nil
+	connection := b.connection
+	b.connection = nil
+	b.setHealth(BrokerClosed, nil)
+	b.mu.Unlock()
+
+	for _, channel := range channels {
+		_ = channel.Close()
+	}
+	for _, channel := range b.pool {
+		channel.close()
+	}
+
+	if connection != nil {
+		return connection.Close()
+	}
+	return nil
+}
+
+type amqpAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+func (a *amqpAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a *amqpAcknowledger) Nack(requeue bool) error {
+	return a.delivery.Reject(requeue)
+}
+
+type amqpPendingConfirm struct {
+	messageID string
+	confirm   ConfirmFunc
+}
+
+// amqpPublishChannel is a long-lived confirm mode channel, it tracks delivery
+// tags of published messages to map broker confirmations back to messages.
+type amqpPublishChannel struct {
+	broker *amqpBroker
+
+	mu      sync.Mutex
+	channel *amqp.Channel
+	tag     uint64
+	pending map[uint64]amqpPendingConfirm
+}
+
+func (c *amqpPublishChannel) open() error {
+	channel, err := c.broker.newChannel()
+	if err != nil {
+		return err
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		logger.Errorf("Channel could not be put into confirm mode: %s", err)
+		channel.Close()
+		return err
+	}
+
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, PublisherConfirmBufferSize))
+	returns := channel.NotifyReturn(make(chan amqp.Return, PublisherConfirmBufferSize))
+	c.channel = channel
+	c.tag = 0
+	c.pending = make(map[uint64]amqpPendingConfirm)
+
+	go c.listen(channel, confirms, returns)
+	return nil
+}
+
+func (c *amqpPublishChannel) publish(exchange string, msg *Message, confirm ConfirmFunc) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channel == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.channel.Publish(
+		exchange, // publish to an exchange
+		msg.RoutingKey,
+		true,  // mandatory, unroutable messages are returned
+		false, // immediate
+		amqp.Publishing{
+			Headers:         amqp.Table(msg.Headers),
+			ContentType:     msg.ContentType,
+			ContentEncoding: "",
+			Body:            msg.Body,
+			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
+			Priority:        0,              // 0-9
+			MessageId:       msg.ID,
+		},
+	); err != nil {
+		return err
+	}
+
+	c.tag++
+	c.pending[c.tag] = amqpPendingConfirm{messageID: msg.ID, confirm: confirm}
+	return nil
+}
+
+// listen dispatches confirmations of channel, when the channel is closed all
+// pending messages are reported as failed. The broker sends basic.return of
+// an unroutable message before its ack, so returns are drained before each
+// confirmation is dispatched.
+func (c *amqpPublishChannel) listen(channel *amqp.Channel, confirms chan amqp.Confirmation,
+	returns chan amqp.Return) {
+
+	returned := make(map[string]string) // message ID -> reply text
+	for confirmed := range confirms {
+		c.drainReturns(returns, returned)
+
+		c.mu.Lock()
+		pending, ok := c.pending[confirmed.DeliveryTag]
+		delete(c.pending, confirmed.DeliveryTag)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		reason, unroutable := returned[pending.messageID]
+		delete(returned, pending.messageID)
+		if pending.confirm != nil {
+			pending.confirm(Confirmation{
+				MessageID:  pending.messageID,
+				Ack:        confirmed.Ack,
+				Unroutable: unroutable,
+				Reason:     reason,
+			})
+		}
+	}
+
+	c.mu.Lock()
+	var pending map[uint64]amqpPendingConfirm
+	if c.channel == channel {
+		pending = c.pending
+		c.channel = nil
+		c.pending = nil
+	}
+	c.mu.Unlock()
+
+	for _, p := range pending {
+		if p.confirm != nil {
+			p.confirm(Confirmation{MessageID: p.messageID, Err: ErrChannelClosed})
+		}
+	}
+}
+
+func (c *amqpPublishChannel) drainReturns(returns chan amqp.Return, returned map[string]string) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return
+			}
+			returned[r.MessageId] = r.ReplyText
+		default:
+			return
+		}
+	}
+}
+
+func (c *amqpPublishChannel) close() {
+	c.mu.Lock()
+	channel := c.channel
+	c.mu.Unlock()
+
+	if channel != nil {
+		_ = channel.Close()
+	}
+}
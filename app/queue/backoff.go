@@ -0,0 +1,34 @@
+package queue
+
+import (
+	"time"
+)
+
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// backoff returns exponentially growing waits between min and max
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{min: DefaultMinBackoff, max: DefaultMaxBackoff}
+}
+
+func (b *backoff) next() time.Duration {
+	if b.current < b.min {
+		b.current = b.min
+		return b.current
+	}
+
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
@@ -0,0 +1,211 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"message-queue/config"
+)
+
+const (
+	DriverAMQP   = "amqp"
+	DriverMemory = "memory"
+	DriverRedis  = "redis"
+	DriverNATS   = "nats"
+	DriverKafka  = "kafka"
+
+	// ReplyNoRoute is the AMQP reply text of returned unroutable messages
+	ReplyNoRoute = "NO_ROUTE"
+)
+
+var (
+	ErrChannelClosed = errors.New("channel is closed before message is confirmed")
+)
+
+// Broker is a transport driver, publisher and consumer are built on top of it
+type Broker interface {
+	DeclareExchange(spec ExchangeSpec) error
+	DeclareQueue(spec QueueSpec) error
+	BindQueue(queue, exchange, routingKey string) error
+	UnbindQueue(queue, exchange, routingKey string) error
+	// Publish sends message to exchange, confirm is called asynchronously
+	// when the broker acks or nacks the message, it can be nil
+	Publish(exchange string, msg *Message, confirm ConfirmFunc) error
+	Subscribe(queue string, prefetch int) (<-chan Delivery, error)
+	Close() error
+}
+
+// ExchangeSpec describes an exchange, Args are AMQP arguments and are ignored
+// by drivers which don't support them
+type ExchangeSpec struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Args       map[string]interface{}
+}
+
+// QueueSpec describes a queue, Args are AMQP arguments such as x-message-ttl,
+// x-max-length, x-queue-type and x-dead-letter-exchange
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Args       map[string]interface{}
+}
+
+type BindingSpec struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+}
+
+type Message struct {
+	ID          string
+	Key         string // ordering key, drivers may use it to keep order
+	RoutingKey  string
+	Headers     map[string]interface{}
+	ContentType string
+	Body        []byte
+}
+
+// Confirmation is the broker's answer for a published message. Unroutable
+// is set when no queue is bound for the routing key, Reason is the broker's
+// reply text. Kafka and NATS drivers don't report unroutable messages.
+type Confirmation struct {
+	MessageID  string
+	Ack        bool
+	Unroutable bool
+	Reason     string
+	Err        error
+}
+
+type ConfirmFunc func(confirmation Confirmation)
+
+// ack confirms message of drivers which write synchronously
+func (f ConfirmFunc) ack(msg *Message) {
+	if f != nil {
+		f(Confirmation{MessageID: msg.ID, Ack: true})
+	}
+}
+
+// unroutable confirms message which no queue is bound for
+func (f ConfirmFunc) unroutable(msg *Message) {
+	if f != nil {
+		f(Confirmation{
+			MessageID:  msg.ID,
+			Ack:        true,
+			Unroutable: true,
+			Reason:     ReplyNoRoute,
+		})
+	}
+}
+
+const (
+	BrokerConnected    = "connected"
+	BrokerReconnecting = "reconnecting"
+	BrokerClosed       = "closed"
+	BrokerUnknown      = "unknown"
+)
+
+// Health is the connection state of broker
+type Health struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	Error string    `json:"error,omitempty"`
+}
+
+// HealthChecker is implemented by drivers which report connection state
+type HealthChecker interface {
+	Health() Health
+}
+
+// Reconnector is implemented by drivers which reconnect by themselves,
+// handlers are called after every reconnection before subscriptions resume.
+type Reconnector interface {
+	OnReconnect(handler func())
+}
+
+// Binding is a queue bound to an exchange for a routing key pattern
+type Binding struct {
+	Queue      string
+	RoutingKey string
+}
+
+// BindingLister is implemented by drivers which can list bindings of an
+// exchange, stale bindings of deleted routing keys are removed on sync.
+type BindingLister interface {
+	Bindings(exchange string) ([]Binding, error)
+}
+
+// Unsubscriber is implemented by drivers which take a message off the queue
+// before the subscriber reads it, Unsubscribe stops the subscription and
+// returns the message to the queue so it isn't lost.
+type Unsubscriber interface {
+	Unsubscribe(deliveries <-chan Delivery) error
+}
+
+// Acknowledger is implemented by drivers to settle a single delivery
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+type Delivery struct {
+	Message
+	Redelivered  bool
+	Acknowledger Acknowledger
+}
+
+func (d Delivery) Ack() error {
+	return d.Acknowledger.Ack()
+}
+
+func (d Delivery) Nack(requeue bool) error {
+	return d.Acknowledger.Nack(requeue)
+}
+
+func NewBroker() (Broker, error) {
+	switch config.Config.Broker {
+	case "", DriverAMQP:
+		return NewAMQPBroker(&AMQPConfig{
+			AMQPUrl:       config.Config.AMQP.URL,
+			ExchangeName:  config.Config.AMQP.ExchangeName,
+			ExchangeType:  config.Config.AMQP.ExchangeType,
+			QueueName:     config.Config.AMQP.QueueName,
+			Channels:      config.Config.AMQP.PublisherChannels,
+			ManagementURL: config.Config.AMQP.ManagementURL,
+		}), nil
+	case DriverMemory:
+		return NewMemoryBroker(), nil
+	case DriverRedis:
+		return NewRedisBroker(&RedisConfig{
+			Addr:          config.Config.Redis.Addr,
+			Password:      config.Config.Redis.Password,
+			DB:            config.Config.Redis.DB,
+			Prefix:        config.Config.Redis.Prefix,
+			MaxLen:        config.Config.Redis.MaxLen,
+			Consumer:      config.Config.Redis.Consumer,
+			ClaimMinIdle:  time.Duration(config.Config.Redis.ClaimMinIdle) * time.Second,
+			ClaimInterval: time.Duration(config.Config.Redis.ClaimInterval) * time.Second,
+		}), nil
+	case DriverNATS:
+		return NewJetStreamBroker(&NATSConfig{
+			URL:        config.Config.NATS.URL,
+			Workers:    config.Config.AMQP.ConsumerThreads,
+			AckWait:    time.Duration(config.Config.NATS.AckWait) * time.Second,
+			MaxDeliver: config.Config.NATS.MaxDeliver,
+			NakDelay:   time.Duration(config.Config.NATS.NakDelay) * time.Second,
+			MaxAge:     time.Duration(config.Config.NATS.MaxAge) * time.Second,
+		}), nil
+	case DriverKafka:
+		return NewKafkaBroker(&KafkaConfig{
+			Brokers:           config.Config.Kafka.Brokers,
+			Partitions:        config.Config.Kafka.Partitions,
+			ReplicationFactor: config.Config.Kafka.ReplicationFactor,
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unsupported broker driver: %s", config.Config.Broker)
+}
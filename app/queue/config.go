@@ -1,13 +1,44 @@
 package queue
 
+import "time"
+
 type AMQPConfig struct {
-	AMQPUrl      string
-	Host         string
-	Port         string
-	Vhost        string
-	Username     string
-	Password     string
-	ExchangeName string
-	ExchangeType string
-	QueueName    string
+	AMQPUrl       string
+	Host          string
+	Port          string
+	Vhost         string
+	Username      string
+	Password      string
+	ExchangeName  string
+	ExchangeType  string
+	QueueName     string
+	Channels      int    // publishing channels in pool
+	ManagementURL string // RabbitMQ management API, bindings are listed through it
+}
+
+type RedisConfig struct {
+	Addr          string
+	Password      string
+	DB            int
+	Prefix        string
+	MaxLen        int64
+	Consumer      string
+	ClaimMinIdle  time.Duration
+	ClaimInterval time.Duration
+	ReadBlock     time.Duration // longest wait of a read for new entries
+}
+
+type NATSConfig struct {
+	URL        string
+	Workers    int
+	AckWait    time.Duration
+	MaxDeliver int
+	NakDelay   time.Duration
+	MaxAge     time.Duration
+}
+
+type KafkaConfig struct {
+	Brokers           []string
+	Partitions        int
+	ReplicationFactor int
 }
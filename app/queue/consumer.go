@@ -3,13 +3,12 @@ package queue
 import (
 	"encoding/json"
 	"errors"
-	"sync/atomic"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/copier"
-	"github.com/manucorporat/try"
 	"github.com/quangdangfit/gosdk/utils/logger"
-	"github.com/streadway/amqp"
 
 	"message-queue/app/models"
 	"message-queue/config"
@@ -17,168 +16,418 @@ import (
 
 const (
 	DefaultConsumerThreads = 10
+	DefaultPrefetch        = 50
 )
 
+// ConsumerQueue is a queue consumed by its own pool of workers, routing
+// keys with a dedicated queue are not blocked by slow keys of other queues.
+type ConsumerQueue struct {
+	Name     string
+	Prefetch int
+	Workers  int
+}
+
 type Consumer interface {
-	Consume() chan *models.InMessage
+	// Queues returns the shared queue first, then dedicated queues as routing
+	// keys are bound to them. It is closed when the consumer is stopped.
+	Queues() <-chan ConsumerQueue
+	// Queue returns the queue consuming messages of routing key
+	Queue(routingKey *models.RoutingKey) ConsumerQueue
+	// Consume subscribes queue, the channel is closed when consumer is stopped
+	Consume(queue ConsumerQueue) <-chan *InDelivery
+	// Stop stops forwarding deliveries and closes the consume channels,
+	// deliveries which are not forwarded are requeued
+	Stop()
+	// Bind subscribes the queue of routing key to its messages, dedicated
+	// queues are declared on first bind
+	Bind(routingKey *models.RoutingKey) error
+	// Unbind stops routing messages of routing key to its queue
+	Unbind(routingKey *models.RoutingKey) error
+	// Prune unbinds routing keys from consumer queues unless they are in
+	// routingKeys, e.g. keys which are deleted or renamed. Bindings of
+	// topology config are kept, drivers which can't list bindings are skipped.
+	Prune(routingKeys []models.RoutingKey) error
+	// Retries reports failed deliveries are retried through broker delay
+	// queues instead of the retry cronjob
+	Retries() bool
+	// Retry republishes delivery to the delay queue, it is delivered again
+	// after delay with the attempts of its message
+	Retry(delivery *InDelivery, delay time.Duration) error
+}
+
+// InDelivery is an in message waiting for acknowledgement, it must be acked
+// after the message is stored, or nacked to let the broker redeliver it.
+// Nack without requeue parks the delivery if dead letter exchange is set.
+type InDelivery struct {
+	Message  *models.InMessage
+	Delivery Delivery
+
+	queue    string
+	consumer *consumer
+}
+
+func (d *InDelivery) Ack() error {
+	return d.Delivery.Ack()
+}
+
+func (d *InDelivery) Nack(requeue bool) error {
+	if !requeue && d.consumer != nil {
+		return d.consumer.reject(d.Delivery, d.queue)
+	}
+	return d.Delivery.Nack(requeue)
 }
 
 type consumer struct {
-	messageQueue
+	broker             Broker
+	shared             ConsumerQueue
+	exchange           string
+	deadLetterExchange string
+	retrier            *retrier
 
-	done            chan error
-	consumerTag     string // Name that consumer identifies itself to the server
-	lastRecoverTime int64
-	//track service current status
-	currentStatus atomic.Value
+	mu      sync.Mutex
+	queues  map[string]ConsumerQueue
+	pending []ConsumerQueue // queues not sent to Queues channel yet
+	added   chan struct{}
+	out     chan ConsumerQueue
 
-	threads int
-	msgChan chan *models.InMessage
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-func NewConsumer() Consumer {
+func NewConsumer(broker Broker) Consumer {
+	threads := config.Config.AMQP.ConsumerThreads
+	if threads <= 0 {
+		threads = DefaultConsumerThreads
+	}
+	prefetch := config.Config.AMQP.Prefetch
+	if prefetch <= 0 {
+		prefetch = DefaultPrefetch
+	}
+
 	var sub = consumer{
-		done:            make(chan error),
-		lastRecoverTime: time.Now().Unix(),
+		broker: broker,
+		shared: ConsumerQueue{
+			Name:     config.Config.AMQP.QueueName,
+			Prefetch: prefetch,
+			Workers:  threads,
+		},
+		exchange:           config.Config.AMQP.ExchangeName,
+		deadLetterExchange: config.Config.AMQP.DeadLetterExchange,
+		queues:             make(map[string]ConsumerQueue),
+		added:              make(chan struct{}, 1),
+		out:                make(chan ConsumerQueue),
+		done:               make(chan struct{}),
+	}
+	sub.queues[sub.shared.Name] = sub.shared
+	sub.pending = append(sub.pending, sub.shared)
+
+	if config.Config.Retry.Mode == RetryModeBroker {
+		if deadLetterer, ok := broker.(DeadLetterer); !ok || !deadLetterer.DeadLetters() {
+			logger.Warn("Broker driver doesn't support delay queues, retry by cronjob")
+		} else if len(RetryDelays()) == 0 {
+			logger.Warn("No retry delays are configured, retry by cronjob")
+		} else {
+			sub.retrier = &retrier{broker: broker}
+		}
+	}
+
+	go sub.sendQueues()
+	return &sub
+}
+
+func (c *consumer) Queues() <-chan ConsumerQueue {
+	return c.out
+}
+
+// Queue returns the shared queue unless routing key has a dedicated queue
+// mode. Keys of a group share the prefetch and workers of the first bound
+// key of the group.
+func (c *consumer) Queue(routingKey *models.RoutingKey) ConsumerQueue {
+	var name string
+	switch routingKey.QueueMode {
+	case models.RoutingQueueModeKey:
+		name = c.shared.Name + ".key." + routingKey.Name
+	case models.RoutingQueueModeGroup:
+		name = c.shared.Name + ".group." + routingKey.Group
+	default:
+		return c.shared
+	}
+
+	c.mu.Lock()
+	queue, ok := c.queues[name]
+	c.mu.Unlock()
+	if ok {
+		return queue
 	}
 
-	sub.config = &AMQPConfig{
-		AMQPUrl:      config.Config.AMQP.URL,
-		QueueName:    config.Config.AMQP.QueueName,
-		ExchangeName: config.Config.AMQP.ExchangeName,
-		ExchangeType: config.Config.AMQP.ExchangeType,
+	queue = ConsumerQueue{
+		Name:     name,
+		Prefetch: int(routingKey.Prefetch),
+		Workers:  int(routingKey.Workers),
+	}
+	if queue.Prefetch <= 0 {
+		queue.Prefetch = c.shared.Prefetch
 	}
-	_, err := sub.newConnection()
+	if queue.Workers <= 0 {
+		queue.Workers = c.shared.Workers
+	}
+	return queue
+}
+
+func (c *consumer) Consume(queue ConsumerQueue) <-chan *InDelivery {
+	msgChan := make(chan *InDelivery, queue.Workers)
+	deliveries, err := c.broker.Subscribe(queue.Name, queue.Prefetch)
 	if err != nil {
-		logger.Error("Consumer create new connection failed!")
+		logger.Errorf("Failed to subscribe queue %s: %s", queue.Name, err)
+		close(msgChan)
+		return msgChan
 	}
 
-	err = sub.declareQueue()
+	logger.Info("Starting consume queue: ", queue.Name)
+	go c.startConsuming(queue.Name, deliveries, msgChan)
+	return msgChan
+}
+
+func (c *consumer) Bind(routingKey *models.RoutingKey) error {
+	queue := c.Queue(routingKey)
+	err := c.declare(queue)
 	if err != nil {
-		logger.Error("Consumer declare queue failed!")
+		return err
 	}
 
-	threads := config.Config.AMQP.ConsumerThreads
-	if threads <= 0 {
-		threads = DefaultConsumerThreads
+	err = c.broker.BindQueue(queue.Name, c.exchange, routingKey.Name)
+	if err != nil {
+		return err
 	}
 
-	sub.threads = threads
-	sub.msgChan = make(chan *models.InMessage, sub.threads)
+	logger.Infof("Bound queue %s with routing key %s", queue.Name, routingKey.Name)
+	return nil
+}
 
-	return &sub
+func (c *consumer) Unbind(routingKey *models.RoutingKey) error {
+	queue := c.Queue(routingKey)
+	err := c.broker.UnbindQueue(queue.Name, c.exchange, routingKey.Name)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Unbound queue %s from routing key %s", queue.Name, routingKey.Name)
+	return nil
 }
 
-func (c *consumer) Consume() chan *models.InMessage {
-	c.ensureConnection()
-	c.newChannel()
-	deliveries, _ := c.subscribe()
-	go c.startConsuming(deliveries)
+func (c *consumer) Prune(routingKeys []models.RoutingKey) error {
+	lister, ok := c.broker.(BindingLister)
+	if !ok {
+		return nil
+	}
+	bindings, err := lister.Bindings(c.exchange)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[Binding]bool, len(routingKeys))
+	for i := range routingKeys {
+		keep[Binding{Queue: c.Queue(&routingKeys[i]).Name, RoutingKey: routingKeys[i].Name}] = true
+	}
+	for _, binding := range config.Config.Topology.Bindings {
+		if binding.Exchange == c.exchange {
+			keep[Binding{Queue: binding.Queue, RoutingKey: binding.RoutingKey}] = true
+		}
+	}
+
+	for _, binding := range bindings {
+		if keep[binding] || !c.owns(binding.Queue) {
+			continue
+		}
+
+		err := c.broker.UnbindQueue(binding.Queue, c.exchange, binding.RoutingKey)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Unbound stale routing key %s from queue %s", binding.RoutingKey, binding.Queue)
+	}
+	return nil
+}
 
-	// retry consume failed messages
-	go c.startConsuming(c.failedChan)
-	return c.msgChan
+// owns reports queue is the shared queue or a dedicated queue of consumer
+func (c *consumer) owns(queue string) bool {
+	return queue == c.shared.Name ||
+		strings.HasPrefix(queue, c.shared.Name+".key.") ||
+		strings.HasPrefix(queue, c.shared.Name+".group.")
 }
 
-func (c *consumer) parseMessageFromDelivery(msg amqp.Delivery) (*models.InMessage, error) {
+// declare declares a dedicated queue and its delay queues on first use,
+// rejected deliveries are dead lettered to the parking queue like the shared
+// queue
+func (c *consumer) declare(queue ConsumerQueue) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.queues[queue.Name]; ok {
+		return nil
+	}
+
+	spec := QueueSpec{Name: queue.Name, Durable: true}
+	if c.deadLetterExchange != "" {
+		spec.Args = map[string]interface{}{HeaderDeadLetterExchange: c.deadLetterExchange}
+	}
+	err := c.broker.DeclareQueue(spec)
+	if err != nil {
+		return err
+	}
+	if c.retrier != nil {
+		err = c.retrier.declare(queue.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.queues[queue.Name] = queue
+	c.pending = append(c.pending, queue)
+	select {
+	case c.added <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendQueues sends declared queues to Queues channel until consumer is
+// stopped, queues bound before consuming starts are kept pending.
+func (c *consumer) sendQueues() {
+	defer close(c.out)
+
+	for {
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+
+		for _, queue := range pending {
+			select {
+			case c.out <- queue:
+			case <-c.done:
+				return
+			}
+		}
+
+		select {
+		case <-c.added:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// reject nacks delivery without requeue. For drivers which don't dead letter
+// by themselves, the delivery is published to the dead letter exchange first
+// and it is requeued if the publishing fails.
+func (c *consumer) reject(delivery Delivery, queue string) error {
+	if deadLetterer, ok := c.broker.(DeadLetterer); c.deadLetterExchange == "" || ok && deadLetterer.DeadLetters() {
+		return delivery.Nack(false)
+	}
+
+	msg := delivery.Message
+	msg.Headers = deadLetterHeaders(delivery, queue, c.exchange)
+	err := c.broker.Publish(c.deadLetterExchange, &msg, nil)
+	if err != nil {
+		logger.Error("Failed to dead letter message: ", err)
+		return delivery.Nack(true)
+	}
+	return delivery.Nack(false)
+}
+
+func (c *consumer) parseMessageFromDelivery(msg Delivery) (*models.InMessage, error) {
 	var payload interface{}
-	json.Unmarshal(msg.Body, &payload)
+	err := json.Unmarshal(msg.Body, &payload)
+	if err != nil {
+		return nil, err
+	}
 	var headers models.Headers
 	data, err := json.Marshal(msg.Headers)
 	if err != nil {
 		return nil, err
 	}
-	json.Unmarshal(data, &headers)
+	err = json.Unmarshal(data, &headers)
+	if err != nil {
+		return nil, err
+	}
 
 	message := models.InMessage{
 		Payload: payload,
 	}
 	copier.Copy(&message, &headers)
 	message.RoutingKey.Name = msg.RoutingKey
+
+	// Retried deliveries come back from delay queues with retry headers
+	if routingKey, ok := msg.Headers[HeaderOriginalRoutingKey].(string); ok && routingKey != "" {
+		message.RoutingKey.Name = routingKey
+	}
+	if id, ok := msg.Headers[HeaderInMessageID].(string); ok {
+		message.ID = id
+	}
+	message.Attempts = headerUint(msg.Headers[HeaderRetryAttempts])
 	return &message, nil
 }
 
-func (c *consumer) reconnect(retryTime int) (<-chan amqp.Delivery, error) {
-	c.closeConnection()
-	time.Sleep(time.Duration(TimeoutRetry) * time.Second)
-	logger.Info("Try reConnect with times:", retryTime)
-
-	c.ensureConnection()
-
-	deliveries, err := c.subscribe()
-	if err != nil {
-		return deliveries, errors.New("cannot connect")
-	}
-	return deliveries, nil
+func (c *consumer) Retries() bool {
+	return c.retrier != nil
 }
 
-// subscribe sets the queue that will be listened to for this connection
-func (c *consumer) subscribe() (<-chan amqp.Delivery, error) {
-	err := c.channel.Qos(50, 0, false)
-	if err != nil {
-		logger.Error("Error setting qos: ", err)
-		return nil, err
+func (c *consumer) Retry(delivery *InDelivery, delay time.Duration) error {
+	if c.retrier == nil {
+		return errors.New("retry by broker is not enabled")
 	}
+	return c.retrier.retry(delivery, delay)
+}
 
-	logger.Info("Queue bound to Exchange, starting Consume consumer tag:",
-		c.consumerTag)
-
-	deliveries, err := c.channel.Consume(
-		c.config.QueueName, // name
-		c.consumerTag,      // consumerTag,
-		false,              // noAck
-		false,              // exclusive
-		false,              // noLocal
-		false,              // noWait
-		nil,                // arguments
-	)
-	if err != nil {
-		logger.Error("Failed to consume queue: ", err)
-		return nil, err
-	}
-	return deliveries, nil
+func (c *consumer) Stop() {
+	c.stopOnce.Do(func() {
+		logger.Info("Stopping consumer")
+		close(c.done)
+	})
 }
 
-func (c *consumer) startConsuming(deliveries <-chan amqp.Delivery) {
+func (c *consumer) startConsuming(queue string, deliveries <-chan Delivery, msgChan chan<- *InDelivery) {
+	defer close(msgChan)
+
 	logger.Info("Enter with deliveries ", deliveries)
-	for msg := range deliveries {
-		logger.Info("Enter deliver message: ", msg.RoutingKey)
-		ret := false
-		try.This(func() {
-			c.pushToMsgChan(msg)
-		}).Finally(func() {
-			if ret == true {
-				msg.Ack(false)
-				currentTime := time.Now().Unix()
-				if currentTime-c.lastRecoverTime > RecoverIntervalTime &&
-					!c.currentStatus.Load().(bool) {
-
-					logger.Info("Try to Recover Unack Messages!")
-					c.currentStatus.Store(true)
-					c.lastRecoverTime = currentTime
-					c.channel.Recover(true)
-				}
-
-			} else {
-				// this really a litter dangerous. if the worker is panic very
-				//quickly, it will ddos our sentry server......plz,
-				//add [retry-ttl] in header.
-				//msg.Nack(false, true)
-				msg.Reject(false)
-				//c.currentStatus.Store(true)
+	for {
+		var msg Delivery
+		var ok bool
+		select {
+		case msg, ok = <-deliveries:
+			if !ok {
+				return
 			}
-		}).Catch(func(e try.E) {
-			logger.Error(e)
-		})
+		case <-c.done:
+			c.unsubscribe(deliveries)
+			return
+		}
+
+		logger.Info("Enter deliver message: ", msg.RoutingKey)
+		message, err := c.parseMessageFromDelivery(msg)
+		if err != nil {
+			logger.Error("Failed to parse message: ", err)
+			c.reject(msg, queue)
+			continue
+		}
+
+		select {
+		case msgChan <- &InDelivery{Message: message, Delivery: msg, queue: queue, consumer: c}:
+		case <-c.done:
+			msg.Nack(true)
+			c.unsubscribe(deliveries)
+			return
+		}
 	}
 }
 
-func (c *consumer) pushToMsgChan(msg amqp.Delivery) {
-	message, err := c.parseMessageFromDelivery(msg)
-	if err != nil {
-		c.failedChan <- msg
-		logger.Error("Failed to parse message: ", err)
+// unsubscribe lets drivers requeue the message they hold for the stopped
+// consumer
+func (c *consumer) unsubscribe(deliveries <-chan Delivery) {
+	if unsubscriber, ok := c.broker.(Unsubscriber); ok {
+		if err := unsubscriber.Unsubscribe(deliveries); err != nil {
+			logger.Error("Failed to unsubscribe: ", err)
+		}
 	}
-
-	c.msgChan <- message
 }
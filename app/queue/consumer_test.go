@@ -0,0 +1,168 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"message-queue/app/models"
+	"message-queue/config"
+)
+
+func TestConsumerPruneRemovesStaleBindings(t *testing.T) {
+	config.Config.AMQP.ExchangeName = "test"
+	config.Config.AMQP.QueueName = "orders"
+	broker := newTestMemoryBroker(t, "orders", "order.created")
+	defer broker.Close()
+	broker.DeclareQueue(QueueSpec{Name: "other"})
+	broker.BindQueue("other", "test", "order.deleted")
+
+	consumer := NewConsumer(broker)
+	defer consumer.Stop()
+	kept := models.RoutingKey{Name: "order.paid", Active: true}
+	renamed := models.RoutingKey{Name: "order.refunded", QueueMode: models.RoutingQueueModeKey, Active: true}
+	for _, routingKey := range []*models.RoutingKey{&kept, &renamed} {
+		if err := consumer.Bind(routingKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := consumer.Prune([]models.RoutingKey{kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	bindings, _ := broker.(BindingLister).Bindings("test")
+	expected := map[Binding]bool{
+		{Queue: "orders", RoutingKey: "order.paid"}:   true,
+		{Queue: "other", RoutingKey: "order.deleted"}: true, // not a consumer queue
+	}
+	if len(bindings) != len(expected) {
+		t.Fatalf("unexpected bindings %+v", bindings)
+	}
+	for _, binding := range bindings {
+		if !expected[binding] {
+			t.Fatalf("unexpected binding %+v", binding)
+		}
+	}
+}
+
+func TestConsumerRejectsUnparsableDelivery(t *testing.T) {
+	config.Config.AMQP.ExchangeName = "test"
+	config.Config.AMQP.QueueName = "orders"
+	config.Config.AMQP.DeadLetterExchange = "test.dlx"
+	defer func() { config.Config.AMQP.DeadLetterExchange = "" }()
+
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+	broker.DeclareExchange(ExchangeSpec{Name: "test.dlx", Kind: ExchangeTypeFanout})
+	broker.DeclareQueue(QueueSpec{Name: "parking"})
+	broker.BindQueue("parking", "test.dlx", "#")
+
+	consumer := NewConsumer(broker)
+	defer consumer.Stop()
+	broker.Publish("test", &Message{RoutingKey: "order", Body: []byte("not json")}, nil)
+	broker.Publish("test", &Message{RoutingKey: "order", Body: []byte(`{"id": 1}`)}, nil)
+
+	select {
+	case delivery := <-consumer.Consume(<-consumer.Queues()):
+		if string(delivery.Delivery.Body) != `{"id": 1}` {
+			t.Fatalf("unexpected delivery %s", delivery.Delivery.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no delivery in time")
+	}
+
+	parked, _ := broker.Subscribe("parking", 1)
+	if delivery := receive(t, parked); string(delivery.Body) != "not json" {
+		t.Fatalf("expected unparsable message parked, got %s", delivery.Body)
+	}
+}
+
+func TestConsumerDedicatedQueues(t *testing.T) {
+	config.Config.AMQP.ExchangeName = "test"
+	config.Config.AMQP.QueueName = "orders"
+	config.Config.AMQP.Prefetch = 10
+	defer func() { config.Config.AMQP.Prefetch = 0 }()
+
+	broker := newTestMemoryBroker(t, "orders", "order.created")
+	defer broker.Close()
+	consumer := NewConsumer(broker)
+	defer consumer.Stop()
+
+	// Keys of a group share the prefetch and workers of the first bound key
+	paid := models.RoutingKey{Name: "order.paid", QueueMode: models.RoutingQueueModeKey, Prefetch: 2, Workers: 1}
+	shipped := models.RoutingKey{Name: "order.shipped", Group: "shipping", QueueMode: models.RoutingQueueModeGroup, Prefetch: 1}
+	delivered := models.RoutingKey{Name: "order.delivered", Group: "shipping", QueueMode: models.RoutingQueueModeGroup, Prefetch: 5}
+	for _, routingKey := range []*models.RoutingKey{&paid, &shipped, &delivered} {
+		if err := consumer.Bind(routingKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queues := make(map[string]ConsumerQueue)
+	for i := 0; i < 3; i++ {
+		select {
+		case queue := <-consumer.Queues():
+			queues[queue.Name] = queue
+		case <-time.After(time.Second):
+			t.Fatalf("expected 3 queues, got %+v", queues)
+		}
+	}
+	expected := map[string]ConsumerQueue{
+		"orders":                {Name: "orders", Prefetch: 10, Workers: DefaultConsumerThreads},
+		"orders.key.order.paid": {Name: "orders.key.order.paid", Prefetch: 2, Workers: 1},
+		"orders.group.shipping": {Name: "orders.group.shipping", Prefetch: 1, Workers: DefaultConsumerThreads},
+	}
+	for name, queue := range expected {
+		if queues[name] != queue {
+			t.Errorf("queue %s: expected %+v, got %+v", name, queue, queues[name])
+		}
+	}
+	if queue := consumer.Queue(&delivered); queue != expected["orders.group.shipping"] {
+		t.Errorf("expected group queue for order.delivered, got %+v", queue)
+	}
+
+	bindings, _ := broker.(BindingLister).Bindings("test")
+	bound := make(map[Binding]bool)
+	for _, binding := range bindings {
+		bound[binding] = true
+	}
+	for _, binding := range []Binding{
+		{Queue: "orders.key.order.paid", RoutingKey: "order.paid"},
+		{Queue: "orders.group.shipping", RoutingKey: "order.shipped"},
+		{Queue: "orders.group.shipping", RoutingKey: "order.delivered"},
+	} {
+		if !bound[binding] {
+			t.Errorf("expected binding %+v, got %+v", binding, bindings)
+		}
+	}
+
+	// The dedicated queue gets messages of its key only, up to its prefetch
+	for _, routingKey := range []string{"order.paid", "order.paid", "order.paid", "order.created"} {
+		broker.Publish("test", &Message{RoutingKey: routingKey, Body: []byte(`{"id": 1}`)}, nil)
+	}
+	deliveries := consumer.Consume(queues["orders.key.order.paid"])
+	var received []*InDelivery
+	for i := 0; i < 2; i++ {
+		select {
+		case delivery := <-deliveries:
+			if delivery.Message.RoutingKey.Name != "order.paid" {
+				t.Fatalf("unexpected delivery of %s", delivery.Message.RoutingKey.Name)
+			}
+			received = append(received, delivery)
+		case <-time.After(time.Second):
+			t.Fatal("no delivery in time")
+		}
+	}
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("prefetch of the queue exceeded by %s", delivery.Message.RoutingKey.Name)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	received[0].Ack()
+	select {
+	case <-deliveries:
+	case <-time.After(time.Second):
+		t.Fatal("no delivery after ack")
+	}
+}
@@ -5,7 +5,10 @@ import (
 )
 
 func Inject(container *dig.Container) error {
+	_ = container.Provide(NewBroker)
+	_ = container.Provide(NewTopology)
 	_ = container.Provide(NewPublisher)
 	_ = container.Provide(NewConsumer)
+	_ = container.Provide(NewParking)
 	return nil
 }
@@ -0,0 +1,431 @@
+package queue
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/quangdangfit/gosdk/utils/logger"
+)
+
+const (
+	NATSHeaders           = "Gomq-Headers"
+	NATSFetchWait         = 2 * time.Second
+	NATSRescanInterval    = 5 * time.Second
+	DefaultNATSAckWait    = 60 * time.Second
+	DefaultNATSMaxDeliver = -1
+)
+
+// jetStreamBroker maps exchanges to JetStream streams listening on
+// `<exchange>.>` subjects. Each queue binding is a durable pull consumer
+// named `<queue>_<hash>` which filters the routing key subject.
+type jetStreamBroker struct {
+	config *NATSConfig
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewJetStreamBroker(config *NATSConfig) Broker {
+	if config.AckWait <= 0 {
+		config.AckWait = DefaultNATSAckWait
+	}
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = DefaultNATSMaxDeliver
+	}
+	if config.Workers <= 0 {
+		config.Workers = DefaultConsumerThreads
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := jetStreamBroker{
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	conn, err := nats.Connect(config.URL, nats.MaxReconnects(-1))
+	for err != nil {
+		logger.Error("Failed to create new connection to NATS: ", err)
+
+		logger.Infof("Sleep %d seconds to reconnect", WaitTimeReconnect)
+		time.Sleep(WaitTimeReconnect * time.Second)
+		conn, err = nats.Connect(config.URL, nats.MaxReconnects(-1))
+	}
+	b.conn = conn
+
+	b.js, err = conn.JetStream()
+	if err != nil {
+		logger.Error("Failed to get JetStream context: ", err)
+	}
+	return &b
+}
+
+// streamName converts exchange name to a valid stream name
+func (b *jetStreamBroker) streamName(exchange string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(exchange)
+}
+
+// consumerName returns durable name of a queue binding
+func (b *jetStreamBroker) consumerName(queue, routingKey string) string {
+	hash := sha1.Sum([]byte(routingKey))
+	return b.streamName(queue) + "_" + hex.EncodeToString(hash[:4])
+}
+
+// filterSubject converts AMQP topic pattern to NATS subject, `#` is only
+// supported as the last word.
+func (b *jetStreamBroker) filterSubject(exchange, routingKey string) (string, error) {
+	words := strings.Split(routingKey, ".")
+	for i, word := range words {
+		if word != "#" {
+			continue
+		}
+		if i != len(words)-1 {
+			return "", fmt.Errorf("unsupported routing pattern: %s", routingKey)
+		}
+		words[i] = ">"
+	}
+	return exchange + "." + strings.Join(words, "."), nil
+}
+
+func (b *jetStreamBroker) DeclareExchange(spec ExchangeSpec) error {
+	name := b.streamName(spec.Name)
+	_, err := b.js.StreamInfo(name)
+	if err == nil {
+		logger.Info("Declared exchange: ", spec.Name)
+		return nil
+	}
+	if err != nats.ErrStreamNotFound {
+		logger.Error("Failed to declare exchange: ", err)
+		return err
+	}
+
+	storage := nats.FileStorage
+	if !spec.Durable {
+		storage = nats.MemoryStorage
+	}
+	_, err = b.js.AddStream(&nats.StreamConfig{
+		Name:     name,
+		Subjects: []string{spec.Name + ".>"},
+		Storage:  storage,
+		MaxAge:   b.config.MaxAge,
+	})
+	if err != nil {
+		logger.Error("Failed to declare exchange: ", err)
+		return err
+	}
+
+	logger.Info("Declared exchange: ", spec.Name)
+	return nil
+}
+
+// DeclareQueue is a no-op, durable consumers are created when the queue is
+// bound to an exchange.
+func (b *jetStreamBroker) DeclareQueue(spec QueueSpec) error {
+	logger.Info("Declared queue: ", spec.Name)
+	return nil
+}
+
+func (b *jetStreamBroker) BindQueue(queue, exchange, routingKey string) error {
+	subject, err := b.filterSubject(exchange, routingKey)
+	if err != nil {
+		logger.Error("Failed to bind queue: ", err)
+		return err
+	}
+
+	stream := b.streamName(exchange)
+	durable := b.consumerName(queue, routingKey)
+	_, err = b.js.ConsumerInfo(stream, durable)
+	if err == nil {
+		return nil
+	}
+
+	_, err = b.js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       durable,
+		Description:   queue,
+		DeliverPolicy: nats.DeliverNewPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       b.config.AckWait,
+		MaxDeliver:    b.config.MaxDeliver,
+		FilterSubject: subject,
+	})
+	if err != nil {
+		logger.Error("Failed to bind queue: ", err)
+		return err
+	}
+	return nil
+}
+
+// UnbindQueue deletes the durable consumer of the binding, pull workers of
+// the consumer stop when their fetch fails.
+func (b *jetStreamBroker) UnbindQueue(queue, exchange, routingKey string) error {
+	err := b.js.DeleteConsumer(b.streamName(exchange), b.consumerName(queue, routingKey))
+	if err != nil && err != nats.ErrConsumerNotFound {
+		logger.Error("Failed to unbind queue: ", err)
+		return err
+	}
+	return nil
+}
+
+// Bindings returns durable consumers of the exchange stream, routing keys are
+// converted back from their filter subjects
+func (b *jetStreamBroker) Bindings(exchange string) ([]Binding, error) {
+	var bindings []Binding
+	for info := range b.js.ConsumersInfo(b.streamName(exchange)) {
+		if info == nil || info.Config.Description == "" {
+			continue
+		}
+
+		words := strings.Split(strings.TrimPrefix(info.Config.FilterSubject, exchange+"."), ".")
+		if words[len(words)-1] == ">" {
+			words[len(words)-1] = "#"
+		}
+		bindings = append(bindings, Binding{
+			Queue:      info.Config.Description,
+			RoutingKey: strings.Join(words, "."),
+		})
+	}
+	return bindings, nil
+}
+
+func (b *jetStreamBroker) Publish(exchange string, msg *Message, confirm ConfirmFunc) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	m := nats.NewMsg(exchange + "." + msg.RoutingKey)
+	m.Header.Set(NATSHeaders, string(headers))
+	m.Header.Set("Content-Type", msg.ContentType)
+	m.Data = msg.Body
+
+	if _, err = b.js.PublishMsg(m); err != nil {
+		return err
+	}
+
+	confirm.ack(msg)
+	return nil
+}
+
+func (b *jetStreamBroker) Subscribe(queue string, prefetch int) (<-chan Delivery, error) {
+	if prefetch <= 0 {
+		prefetch = DefaultPrefetch
+	}
+
+	sub := jetStreamSubscription{
+		broker:     b,
+		queue:      queue,
+		credits:    make(chan struct{}, prefetch),
+		pulling:    make(map[string]bool),
+		deliveries: make(chan Delivery),
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		sub.run()
+	}()
+
+	return sub.deliveries, nil
+}
+
+// Health maps the connection status, reconnection is handled by nats client
+func (b *jetStreamBroker) Health() Health {
+	health := Health{Since: time.Now()}
+	switch b.conn.Status() {
+	case nats.CONNECTED:
+		health.State = BrokerConnected
+	case nats.CLOSED:
+		health.State = BrokerClosed
+	default:
+		health.State = BrokerReconnecting
+	}
+	if err := b.conn.LastError(); err != nil && health.State != BrokerConnected {
+		health.Error = err.Error()
+	}
+	return health
+}
+
+func (b *jetStreamBroker) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	b.conn.Close()
+	return nil
+}
+
+type jetStreamSubscription struct {
+	broker     *jetStreamBroker
+	queue      string
+	credits    chan struct{}
+	mu         sync.Mutex
+	pulling    map[string]bool // stream/durable consumers being pulled
+	wg         sync.WaitGroup
+	deliveries chan Delivery
+}
+
+// run starts pull workers for every durable consumer of the queue, new
+// bindings are picked up on the next rescan.
+func (s *jetStreamSubscription) run() {
+	b := s.broker
+	ticker := time.NewTicker(NATSRescanInterval)
+	defer ticker.Stop()
+
+	for {
+		s.rescan()
+
+		select {
+		case <-b.ctx.Done():
+			s.wg.Wait()
+			close(s.deliveries)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *jetStreamSubscription) rescan() {
+	b := s.broker
+	prefix := b.streamName(s.queue) + "_"
+
+	for stream := range b.js.StreamNames() {
+		streamInfo, err := b.js.StreamInfo(stream)
+		if err != nil || len(streamInfo.Config.Subjects) == 0 {
+			continue
+		}
+		exchange := strings.TrimSuffix(streamInfo.Config.Subjects[0], ".>")
+
+		for durable := range b.js.ConsumerNames(stream) {
+			key := stream + "/" + durable
+			if !strings.HasPrefix(durable, prefix) || s.isPulling(key) {
+				continue
+			}
+
+			info, err := b.js.ConsumerInfo(stream, durable)
+			if err != nil || info.Config.Description != s.queue {
+				continue
+			}
+
+			sub, err := b.js.PullSubscribe(info.Config.FilterSubject, durable,
+				nats.Bind(stream, durable))
+			if err != nil {
+				logger.Error("Failed to subscribe consumer: ", err)
+				continue
+			}
+
+			s.mu.Lock()
+			s.pulling[key] = true
+			s.mu.Unlock()
+			for i := 0; i < b.config.Workers; i++ {
+				s.wg.Add(1)
+				go func() {
+					defer s.wg.Done()
+					s.pull(sub, exchange, stream, durable)
+				}()
+			}
+			logger.Infof("Pulling %s with %d workers", key, b.config.Workers)
+		}
+	}
+}
+
+func (s *jetStreamSubscription) isPulling(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pulling[key]
+}
+
+// pull fetches messages of the durable consumer until the broker is closed or
+// the consumer is deleted by unbinding the queue.
+func (s *jetStreamSubscription) pull(sub *nats.Subscription, exchange, stream, durable string) {
+	b := s.broker
+	for {
+		select {
+		case s.credits <- struct{}{}:
+		case <-b.ctx.Done():
+			return
+		}
+
+		msgs, err := sub.Fetch(1, nats.MaxWait(NATSFetchWait))
+		if err != nil || len(msgs) == 0 {
+			<-s.credits
+			if err != nil && err != nats.ErrTimeout && !errors.Is(err, context.DeadlineExceeded) {
+				if b.ctx.Err() != nil {
+					return
+				}
+				if _, err := b.js.ConsumerInfo(stream, durable); err == nats.ErrConsumerNotFound {
+					s.mu.Lock()
+					delete(s.pulling, stream+"/"+durable)
+					s.mu.Unlock()
+					sub.Unsubscribe()
+					return
+				}
+				logger.Error("Failed to fetch messages: ", err)
+				s.sleep(NATSFetchWait)
+			}
+			continue
+		}
+
+		m := msgs[0]
+		delivery := Delivery{
+			Message: Message{
+				RoutingKey:  strings.TrimPrefix(m.Subject, exchange+"."),
+				ContentType: m.Header.Get("Content-Type"),
+				Body:        m.Data,
+			},
+			Acknowledger: &jetStreamAcknowledger{
+				subscription: s,
+				msg:          m,
+			},
+		}
+		json.Unmarshal([]byte(m.Header.Get(NATSHeaders)), &delivery.Headers)
+		if meta, err := m.Metadata(); err == nil {
+			delivery.Redelivered = meta.NumDelivered > 1
+		}
+
+		select {
+		case s.deliveries <- delivery:
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *jetStreamSubscription) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-s.broker.ctx.Done():
+	}
+}
+
+type jetStreamAcknowledger struct {
+	subscription *jetStreamSubscription
+	msg          *nats.Msg
+}
+
+func (a *jetStreamAcknowledger) Ack() error {
+	defer func() { <-a.subscription.credits }()
+	return a.msg.Ack()
+}
+
+// Nack with requeue asks the server to redeliver after NakDelay, otherwise
+// the message is terminated and never redelivered.
+func (a *jetStreamAcknowledger) Nack(requeue bool) error {
+	defer func() { <-a.subscription.credits }()
+	if !requeue {
+		return a.msg.Term()
+	}
+
+	delay := a.subscription.broker.config.NakDelay
+	if delay > 0 {
+		return a.msg.NakWithDelay(delay)
+	}
+	return a.msg.Nak()
+}
@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestJetStreamBroker connects to the JetStream enabled server of NATS_URL,
+// e.g. `nats-server -js`, tests are skipped when it isn't set. The exchange
+// has a unique name and its stream is deleted after the test.
+func newTestJetStreamBroker(t *testing.T, queue, pattern string) (Broker, string) {
+	t.Helper()
+
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		t.Skip("NATS_URL is not set")
+	}
+
+	broker := NewJetStreamBroker(&NATSConfig{
+		URL:        url,
+		Workers:    1,
+		AckWait:    time.Second,
+		MaxDeliver: 3,
+	})
+	exchange := fmt.Sprintf("test%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		broker.(*jetStreamBroker).js.DeleteStream(broker.(*jetStreamBroker).streamName(exchange))
+		broker.Close()
+	})
+
+	if err := broker.DeclareExchange(ExchangeSpec{Name: exchange, Kind: ExchangeTypeTopic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.DeclareQueue(QueueSpec{Name: queue}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.BindQueue(queue, exchange, pattern); err != nil {
+		t.Fatal(err)
+	}
+	return broker, exchange
+}
+
+func TestJetStreamBrokerPublishConsume(t *testing.T) {
+	broker, exchange := newTestJetStreamBroker(t, "orders", "order.*")
+
+	msg := Message{
+		RoutingKey:  "order.created",
+		Headers:     map[string]interface{}{"origin_code": "1"},
+		ContentType: "application/json",
+		Body:        []byte(`{"id": "1"}`),
+	}
+	if err := broker.Publish(exchange, &msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish(exchange, &Message{RoutingKey: "user.created", Body: []byte("user")}, nil)
+
+	deliveries, err := broker.Subscribe("orders", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := receive(t, deliveries)
+	if delivery.RoutingKey != msg.RoutingKey || string(delivery.Body) != string(msg.Body) ||
+		delivery.ContentType != msg.ContentType || delivery.Headers["origin_code"] != "1" {
+		t.Fatalf("unexpected delivery %+v", delivery.Message)
+	}
+	if err := delivery.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery %s of unbound routing key", delivery.RoutingKey)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestJetStreamBrokerRedeliversNackedMessage(t *testing.T) {
+	broker, exchange := newTestJetStreamBroker(t, "orders", "#")
+
+	broker.Publish(exchange, &Message{RoutingKey: "order", Body: []byte("1")}, nil)
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	first := receive(t, deliveries)
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	redelivered := receive(t, deliveries)
+	if string(redelivered.Body) != "1" || !redelivered.Redelivered {
+		t.Fatalf("expected redelivered message 1, got %s (redelivered %v)", redelivered.Body, redelivered.Redelivered)
+	}
+	if err := redelivered.Nack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery %s after reject", delivery.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestJetStreamBrokerRedeliversAfterAckWait(t *testing.T) {
+	broker, exchange := newTestJetStreamBroker(t, "orders", "#")
+
+	broker.Publish(exchange, &Message{RoutingKey: "order", Body: []byte("1")}, nil)
+
+	deliveries, _ := broker.Subscribe("orders", 2)
+	receive(t, deliveries)
+
+	// The first delivery is never settled, the server redelivers it after AckWait
+	select {
+	case delivery := <-deliveries:
+		if !delivery.Redelivered {
+			t.Fatal("expected redelivered message")
+		}
+		delivery.Ack()
+	case <-time.After(3 * time.Second):
+		t.Fatal("message is not redelivered after ack wait")
+	}
+}
+
+func TestJetStreamBrokerUnbind(t *testing.T) {
+	broker, exchange := newTestJetStreamBroker(t, "orders", "order.*")
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	if err := broker.UnbindQueue("orders", exchange, "order.*"); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish(exchange, &Message{RoutingKey: "order.created", Body: []byte("1")}, nil)
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery %s after unbind", delivery.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,479 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quangdangfit/gosdk/utils/logger"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	KafkaHeaderRoutingKey   = "gomq-routing-key"
+	KafkaHeaderHeaders      = "gomq-headers"
+	KafkaHeaderContentType  = "gomq-content-type"
+	DefaultKafkaPartitions  = 10
+	DefaultKafkaReplication = 1
+	KafkaFetchWait          = time.Second
+)
+
+// kafkaBroker maps exchanges to topics and queues to consumer groups. The
+// message key is the ordering key (origin model and code), so messages of the
+// same entity land on the same partition and are delivered in order.
+// Bindings are kept in process and matched by the consumer, unmatched
+// messages are committed without delivery.
+type kafkaBroker struct {
+	config *KafkaConfig
+	writer *kafka.Writer
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu            sync.Mutex
+	exchanges     map[string]ExchangeSpec
+	bindings      map[string]map[string][]string // queue -> exchange -> patterns
+	subscriptions map[string]*kafkaSubscription
+}
+
+func NewKafkaBroker(config *KafkaConfig) Broker {
+	if config.Partitions <= 0 {
+		config.Partitions = DefaultKafkaPartitions
+	}
+	if config.ReplicationFactor <= 0 {
+		config.ReplicationFactor = DefaultKafkaReplication
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaBroker{
+		config: config,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+		ctx:           ctx,
+		cancel:        cancel,
+		exchanges:     make(map[string]ExchangeSpec),
+		bindings:      make(map[string]map[string][]string),
+		subscriptions: make(map[string]*kafkaSubscription),
+	}
+}
+
+func (b *kafkaBroker) DeclareExchange(spec ExchangeSpec) error {
+	err := b.createTopic(spec.Name)
+	if err != nil {
+		logger.Error("Failed to declare exchange: ", err)
+		return err
+	}
+
+	b.mu.Lock()
+	b.exchanges[spec.Name] = spec
+	b.mu.Unlock()
+
+	logger.Info("Declared exchange: ", spec.Name)
+	return nil
+}
+
+func (b *kafkaBroker) createTopic(topic string) error {
+	if len(b.config.Brokers) == 0 {
+		return errors.New("missing kafka brokers")
+	}
+
+	conn, err := kafka.Dial("tcp", b.config.Brokers[0])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	controller, err := conn.Controller()
+	if err != nil {
+		return err
+	}
+	controllerConn, err := kafka.Dial("tcp", controller.Host+":"+strconv.Itoa(controller.Port))
+	if err != nil {
+		return err
+	}
+	defer controllerConn.Close()
+
+	err = controllerConn.CreateTopics(kafka.TopicConfig{
+		Topic:             topic,
+		NumPartitions:     b.config.Partitions,
+		ReplicationFactor: b.config.ReplicationFactor,
+	})
+	if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// DeclareQueue is a no-op, consumer group of a queue is joined when the
+// queue is subscribed.
+func (b *kafkaBroker) DeclareQueue(spec QueueSpec) error {
+	logger.Info("Declared queue: ", spec.Name)
+	return nil
+}
+
+func (b *kafkaBroker) BindQueue(queue, exchange, routingKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.bindings[queue] == nil {
+		b.bindings[queue] = make(map[string][]string)
+	}
+	for _, pattern := range b.bindings[queue][exchange] {
+		if pattern == routingKey {
+			return nil
+		}
+	}
+	b.bindings[queue][exchange] = append(b.bindings[queue][exchange], routingKey)
+
+	if sub, ok := b.subscriptions[queue]; ok {
+		sub.startReader(exchange)
+	}
+	return nil
+}
+
+// Bindings returns bindings of this process, they aren't shared with other
+// replicas which sync them from routing keys by themselves.
+func (b *kafkaBroker) Bindings(exchange string) ([]Binding, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var bindings []Binding
+	for queue, exchanges := range b.bindings {
+		for _, pattern := range exchanges[exchange] {
+			bindings = append(bindings, Binding{Queue: queue, RoutingKey: pattern})
+		}
+	}
+	return bindings, nil
+}
+
+// UnbindQueue removes the routing pattern, the reader of the exchange keeps
+// running and commits unmatched messages without delivery.
+func (b *kafkaBroker) UnbindQueue(queue, exchange, routingKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	patterns := b.bindings[queue][exchange]
+	for i, pattern := range patterns {
+		if pattern == routingKey {
+			b.bindings[queue][exchange] = append(patterns[:i:i], patterns[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (b *kafkaBroker) matches(queue, exchange, routingKey string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kind := b.exchanges[exchange].Kind
+	if kind == "" {
+		kind = ExchangeTypeTopic
+	}
+	for _, pattern := range b.bindings[queue][exchange] {
+		if matchRouting(kind, pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *kafkaBroker) Publish(exchange string, msg *Message, confirm ConfirmFunc) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	if msg.Key != "" {
+		key = []byte(msg.Key)
+	}
+
+	err = b.writer.WriteMessages(b.ctx, kafka.Message{
+		Topic: exchange,
+		Key:   key,
+		Value: msg.Body,
+		Headers: []kafka.Header{
+			{Key: KafkaHeaderRoutingKey, Value: []byte(msg.RoutingKey)},
+			{Key: KafkaHeaderHeaders, Value: headers},
+			{Key: KafkaHeaderContentType, Value: []byte(msg.ContentType)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	confirm.ack(msg)
+	return nil
+}
+
+func (b *kafkaBroker) Subscribe(queue string, prefetch int) (<-chan Delivery, error) {
+	if prefetch <= 0 {
+		prefetch = DefaultPrefetch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscriptions[queue]; ok {
+		return nil, errors.New("queue is already subscribed")
+	}
+
+	sub := &kafkaSubscription{
+		broker:       b,
+		queue:        queue,
+		credits:      make(chan struct{}, prefetch),
+		readers:      make(map[string]kafkaReader),
+		partitions:   make(map[kafkaPartitionKey]*kafkaPartition),
+		redeliveries: make(map[string][]kafka.Message),
+		deliveries:   make(chan Delivery),
+	}
+	b.subscriptions[queue] = sub
+	for exchange := range b.bindings[queue] {
+		sub.startReader(exchange)
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		<-b.ctx.Done()
+		sub.wg.Wait()
+		close(sub.deliveries)
+	}()
+
+	return sub.deliveries, nil
+}
+
+func (b *kafkaBroker) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return b.writer.Close()
+}
+
+type kafkaPartitionKey struct {
+	topic     string
+	partition int
+}
+
+// kafkaPartition tracks delivered offsets of a partition, offsets are
+// committed only when all previous offsets are settled.
+type kafkaPartition struct {
+	pending []int64
+	settled map[int64]bool
+}
+
+// kafkaReader is the part of kafka.Reader a subscription uses
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaSubscription struct {
+	broker  *kafkaBroker
+	queue   string
+	credits chan struct{}
+	wg      sync.WaitGroup
+
+	mu           sync.Mutex
+	readers      map[string]kafkaReader
+	partitions   map[kafkaPartitionKey]*kafkaPartition
+	redeliveries map[string][]kafka.Message // nacked messages by topic
+
+	deliveries chan Delivery
+}
+
+func (s *kafkaSubscription) startReader(exchange string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.readers[exchange]; ok || s.broker.ctx.Err() != nil {
+		return
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  s.broker.config.Brokers,
+		GroupID:  s.queue,
+		Topic:    exchange,
+		MinBytes: 1,
+		MaxBytes: 10e6,
+		MaxWait:  time.Second,
+	})
+	s.readers[exchange] = reader
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer reader.Close()
+		s.read(reader, exchange)
+	}()
+	logger.Infof("Reading topic %s with group %s", exchange, s.queue)
+}
+
+// read delivers nacked messages of the topic before fetching new ones, so a
+// requeued message isn't overtaken by later messages of its partition.
+func (s *kafkaSubscription) read(reader kafkaReader, exchange string) {
+	b := s.broker
+	for {
+		if m, ok := s.nextRedelivery(exchange); ok {
+			delivery := s.parse(m)
+			delivery.Redelivered = true
+			s.deliver(delivery)
+			continue
+		}
+
+		// Credits of nacked messages are held until they are redelivered,
+		// waiting for a credit times out to pick up redeliveries
+		select {
+		case s.credits <- struct{}{}:
+		case <-time.After(KafkaFetchWait):
+			continue
+		case <-b.ctx.Done():
+			return
+		}
+
+		// Fetching waits for new messages, it times out to pick up redeliveries
+		ctx, cancel := context.WithTimeout(b.ctx, KafkaFetchWait)
+		m, err := reader.FetchMessage(ctx)
+		cancel()
+		if err != nil {
+			<-s.credits
+			if b.ctx.Err() != nil {
+				return
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				logger.Error("Failed to fetch message: ", err)
+			}
+			continue
+		}
+
+		s.track(m)
+		delivery := s.parse(m)
+		if !b.matches(s.queue, exchange, delivery.RoutingKey) {
+			s.settle(m)
+			continue
+		}
+
+		s.deliver(delivery)
+	}
+}
+
+func (s *kafkaSubscription) parse(m kafka.Message) Delivery {
+	delivery := Delivery{
+		Message: Message{
+			Key:  string(m.Key),
+			Body: m.Value,
+		},
+		Acknowledger: &kafkaAcknowledger{
+			subscription: s,
+			msg:          m,
+		},
+	}
+	for _, header := range m.Headers {
+		switch header.Key {
+		case KafkaHeaderRoutingKey:
+			delivery.RoutingKey = string(header.Value)
+		case KafkaHeaderContentType:
+			delivery.ContentType = string(header.Value)
+		case KafkaHeaderHeaders:
+			json.Unmarshal(header.Value, &delivery.Headers)
+		}
+	}
+	return delivery
+}
+
+func (s *kafkaSubscription) nextRedelivery(topic string) (kafka.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	redeliveries := s.redeliveries[topic]
+	if len(redeliveries) == 0 {
+		return kafka.Message{}, false
+	}
+	s.redeliveries[topic] = redeliveries[1:]
+	return redeliveries[0], true
+}
+
+func (s *kafkaSubscription) deliver(delivery Delivery) {
+	select {
+	case s.deliveries <- delivery:
+	case <-s.broker.ctx.Done():
+	}
+}
+
+func (s *kafkaSubscription) track(m kafka.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := kafkaPartitionKey{topic: m.Topic, partition: m.Partition}
+	partition, ok := s.partitions[key]
+	if !ok {
+		partition = &kafkaPartition{settled: make(map[int64]bool)}
+		s.partitions[key] = partition
+	}
+	partition.pending = append(partition.pending, m.Offset)
+}
+
+// settle marks message offset as done and commits the highest offset which
+// all previous offsets of the partition are settled
+func (s *kafkaSubscription) settle(m kafka.Message) error {
+	defer func() { <-s.credits }()
+
+	s.mu.Lock()
+	key := kafkaPartitionKey{topic: m.Topic, partition: m.Partition}
+	partition, ok := s.partitions[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+
+	partition.settled[m.Offset] = true
+	commit := int64(-1)
+	for len(partition.pending) > 0 && partition.settled[partition.pending[0]] {
+		commit = partition.pending[0]
+		delete(partition.settled, commit)
+		partition.pending = partition.pending[1:]
+	}
+	reader := s.readers[m.Topic]
+	s.mu.Unlock()
+
+	if commit < 0 || reader == nil {
+		return nil
+	}
+
+	return reader.CommitMessages(context.Background(), kafka.Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    commit,
+	})
+}
+
+type kafkaAcknowledger struct {
+	subscription *kafkaSubscription
+	msg          kafka.Message
+}
+
+func (a *kafkaAcknowledger) Ack() error {
+	return a.subscription.settle(a.msg)
+}
+
+// Nack with requeue redelivers the message without committing its offset,
+// otherwise the offset is committed and message is dropped. The reader of the
+// topic redelivers it ahead of new messages, it keeps its prefetch credit.
+func (a *kafkaAcknowledger) Nack(requeue bool) error {
+	if !requeue {
+		return a.subscription.settle(a.msg)
+	}
+
+	s := a.subscription
+	s.mu.Lock()
+	s.redeliveries[a.msg.Topic] = append(s.redeliveries[a.msg.Topic], a.msg)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaReader fetches messages of its channel and records commits
+type fakeKafkaReader struct {
+	messages chan kafka.Message
+
+	mu      sync.Mutex
+	commits []int64
+}
+
+func (r *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case m := <-r.messages:
+		return m, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range msgs {
+		r.commits = append(r.commits, m.Offset)
+	}
+	return nil
+}
+
+func (r *fakeKafkaReader) Close() error {
+	return nil
+}
+
+func (r *fakeKafkaReader) committed() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int64(nil), r.commits...)
+}
+
+func newTestKafkaSubscription(prefetch int) (*kafkaSubscription, *fakeKafkaReader) {
+	broker := NewKafkaBroker(&KafkaConfig{}).(*kafkaBroker)
+	broker.bindings["orders"] = map[string][]string{"test": {"order.*"}}
+
+	reader := &fakeKafkaReader{messages: make(chan kafka.Message, 10)}
+	sub := &kafkaSubscription{
+		broker:       broker,
+		queue:        "orders",
+		credits:      make(chan struct{}, prefetch),
+		readers:      map[string]kafkaReader{"test": reader},
+		partitions:   make(map[kafkaPartitionKey]*kafkaPartition),
+		redeliveries: make(map[string][]kafka.Message),
+		deliveries:   make(chan Delivery),
+	}
+	return sub, reader
+}
+
+func newTestKafkaMessage(offset int64) kafka.Message {
+	return kafka.Message{
+		Topic:   "test",
+		Offset:  offset,
+		Value:   []byte(`{"id": "1"}`),
+		Headers: []kafka.Header{{Key: KafkaHeaderRoutingKey, Value: []byte("order.created")}},
+	}
+}
+
+func TestKafkaSubscriptionCommitsSettledOffsetsInOrder(t *testing.T) {
+	sub, reader := newTestKafkaSubscription(3)
+
+	messages := []kafka.Message{newTestKafkaMessage(1), newTestKafkaMessage(2), newTestKafkaMessage(3)}
+	for _, m := range messages {
+		sub.credits <- struct{}{}
+		sub.track(m)
+	}
+
+	// Offset 2 is settled first, it waits for offset 1
+	if err := sub.settle(messages[1]); err != nil {
+		t.Fatal(err)
+	}
+	if commits := reader.committed(); len(commits) != 0 {
+		t.Fatalf("expected no commit before offset 1 is settled, got %v", commits)
+	}
+
+	if err := sub.settle(messages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if commits := reader.committed(); len(commits) != 1 || commits[0] != 2 {
+		t.Fatalf("expected commit of offset 2, got %v", commits)
+	}
+
+	if err := sub.settle(messages[2]); err != nil {
+		t.Fatal(err)
+	}
+	if commits := reader.committed(); len(commits) != 2 || commits[1] != 3 {
+		t.Fatalf("expected commit of offset 3, got %v", commits)
+	}
+	if len(sub.credits) != 0 {
+		t.Fatalf("expected credits released, %d are held", len(sub.credits))
+	}
+}
+
+func TestKafkaSubscriptionRedeliversRequeuedMessage(t *testing.T) {
+	sub, reader := newTestKafkaSubscription(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.read(reader, "test")
+	}()
+	defer func() {
+		sub.broker.Close()
+		<-done
+	}()
+
+	reader.messages <- newTestKafkaMessage(1)
+	reader.messages <- newTestKafkaMessage(2)
+
+	receive := func() Delivery {
+		select {
+		case delivery := <-sub.deliveries:
+			return delivery
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for delivery")
+			return Delivery{}
+		}
+	}
+
+	first := receive()
+	if first.RoutingKey != "order.created" || first.Redelivered {
+		t.Fatalf("expected new delivery of order.created, got %+v", first)
+	}
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The requeued message keeps the credit and comes before offset 2
+	redelivered := receive()
+	if !redelivered.Redelivered || redelivered.Acknowledger.(*kafkaAcknowledger).msg.Offset != 1 {
+		t.Fatalf("expected redelivery of offset 1, got %+v", redelivered)
+	}
+	if commits := reader.committed(); len(commits) != 0 {
+		t.Fatalf("expected no commit of requeued message, got %v", commits)
+	}
+	if err := redelivered.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if commits := reader.committed(); len(commits) != 1 || commits[0] != 1 {
+		t.Fatalf("expected commit of offset 1, got %v", commits)
+	}
+
+	second := receive()
+	if second.Redelivered || second.Acknowledger.(*kafkaAcknowledger).msg.Offset != 2 {
+		t.Fatalf("expected new delivery of offset 2, got %+v", second)
+	}
+	if err := second.Nack(false); err != nil {
+		t.Fatal(err)
+	}
+	if commits := reader.committed(); len(commits) != 2 || commits[1] != 2 {
+		t.Fatalf("expected commit of dropped offset 2, got %v", commits)
+	}
+}
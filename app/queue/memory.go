@@ -0,0 +1,437 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	ExchangeTypeDirect = "direct"
+	ExchangeTypeFanout = "fanout"
+	ExchangeTypeTopic  = "topic"
+)
+
+var (
+	ErrBrokerClosed     = errors.New("broker is closed")
+	ErrExchangeNotFound = errors.New("exchange not found")
+	ErrQueueNotFound    = errors.New("queue not found")
+)
+
+// memoryBroker is an in-process broker, messages live as long as the process.
+// It is used for tests and single node development.
+type memoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]ExchangeSpec
+	queues    map[string]*memoryQueue
+	bindings  map[string][]memoryBinding // exchange name -> bindings
+	stops     map[<-chan Delivery]memoryStop
+	closed    bool
+	done      chan struct{}
+}
+
+// memoryStop stops a subscription, queue is woken up to stop a subscriber
+// waiting for messages.
+type memoryStop struct {
+	stop  chan struct{}
+	queue *memoryQueue
+}
+
+type memoryBinding struct {
+	queue      string
+	routingKey string
+}
+
+func NewMemoryBroker() Broker {
+	return &memoryBroker{
+		exchanges: make(map[string]ExchangeSpec),
+		queues:    make(map[string]*memoryQueue),
+		bindings:  make(map[string][]memoryBinding),
+		stops:     make(map[<-chan Delivery]memoryStop),
+		done:      make(chan struct{}),
+	}
+}
+
+func (b *memoryBroker) DeclareExchange(spec ExchangeSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	if _, ok := b.exchanges[spec.Name]; !ok {
+		b.exchanges[spec.Name] = spec
+	}
+	return nil
+}
+
+func (b *memoryBroker) DeclareQueue(spec QueueSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	if _, ok := b.queues[spec.Name]; !ok {
+		b.queues[spec.Name] = newMemoryQueue()
+	}
+	return nil
+}
+
+func (b *memoryBroker) ExchangeExists(name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.exchanges[name]
+	return ok, nil
+}
+
+func (b *memoryBroker) QueueExists(name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.queues[name]
+	return ok, nil
+}
+
+func (b *memoryBroker) BindQueue(queue, exchange, routingKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[exchange]; !ok {
+		return ErrExchangeNotFound
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return ErrQueueNotFound
+	}
+
+	for _, binding := range b.bindings[exchange] {
+		if binding.queue == queue && binding.routingKey == routingKey {
+			return nil
+		}
+	}
+	b.bindings[exchange] = append(b.bindings[exchange], memoryBinding{
+		queue:      queue,
+		routingKey: routingKey,
+	})
+	return nil
+}
+
+func (b *memoryBroker) UnbindQueue(queue, exchange, routingKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bindings := b.bindings[exchange]
+	for i, binding := range bindings {
+		if binding.queue == queue && binding.routingKey == routingKey {
+			b.bindings[exchange] = append(bindings[:i:i], bindings[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Bindings(exchange string) ([]Binding, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var bindings []Binding
+	for _, binding := range b.bindings[exchange] {
+		bindings = append(bindings, Binding{Queue: binding.queue, RoutingKey: binding.routingKey})
+	}
+	return bindings, nil
+}
+
+// Publish routes message to all bound queues, unroutable messages are dropped
+// and confirmed as unroutable as AMQP does for mandatory publishing.
+func (b *memoryBroker) Publish(exchange string, msg *Message, confirm ConfirmFunc) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	if _, ok := b.exchanges[exchange]; !ok && exchange != "" {
+		return ErrExchangeNotFound
+	}
+
+	queues := b.route(exchange, msg.RoutingKey)
+	if len(queues) == 0 {
+		confirm.unroutable(msg)
+		return nil
+	}
+
+	for _, queue := range queues {
+		queue.push(memoryMessage{Message: *msg}, false)
+	}
+	confirm.ack(msg)
+	return nil
+}
+
+// route returns queues matched routing key, the default exchange ("") routes
+// directly to the queue named as routing key.
+func (b *memoryBroker) route(exchange, routingKey string) []*memoryQueue {
+	if exchange == "" {
+		if queue, ok := b.queues[routingKey]; ok {
+			return []*memoryQueue{queue}
+		}
+		return nil
+	}
+
+	spec := b.exchanges[exchange]
+	var queues []*memoryQueue
+	matched := make(map[string]bool)
+	for _, binding := range b.bindings[exchange] {
+		if matched[binding.queue] || !matchRouting(spec.Kind, binding.routingKey, routingKey) {
+			continue
+		}
+		matched[binding.queue] = true
+		queues = append(queues, b.queues[binding.queue])
+	}
+	return queues
+}
+
+func (b *memoryBroker) Subscribe(queue string, prefetch int) (<-chan Delivery, error) {
+	b.mu.Lock()
+	q, ok := b.queues[queue]
+	b.mu.Unlock()
+	if !ok {
+		return nil, ErrQueueNotFound
+	}
+
+	var credits chan struct{}
+	if prefetch > 0 {
+		credits = make(chan struct{}, prefetch)
+	}
+
+	deliveries := make(chan Delivery)
+	stop := make(chan struct{})
+	b.mu.Lock()
+	b.stops[deliveries] = memoryStop{stop: stop, queue: q}
+	b.mu.Unlock()
+
+	go func() {
+		defer close(deliveries)
+		for {
+			if credits != nil {
+				select {
+				case credits <- struct{}{}:
+				case <-stop:
+					return
+				case <-b.done:
+					return
+				}
+			}
+			msg, ok := q.pop(stop)
+			if !ok {
+				return
+			}
+
+			delivery := Delivery{
+				Message:     msg.Message,
+				Redelivered: msg.redelivered,
+				Acknowledger: &memoryAcknowledger{
+					queue:   q,
+					msg:     msg,
+					credits: credits,
+				},
+			}
+
+			// Nobody reads the message any more, put it back in front
+			select {
+			case deliveries <- delivery:
+			case <-stop:
+				q.push(msg, true)
+				return
+			case <-b.done:
+				q.push(msg, true)
+				return
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// Unsubscribe stops the subscription of deliveries, the message waiting to
+// be read is put back to the queue. Deliveries already read are settled by
+// their acknowledger as usual.
+func (b *memoryBroker) Unsubscribe(deliveries <-chan Delivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stop, ok := b.stops[deliveries]
+	if !ok {
+		return nil
+	}
+	delete(b.stops, deliveries)
+	close(stop.stop)
+	stop.queue.wake()
+	return nil
+}
+
+func (b *memoryBroker) Health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return Health{State: BrokerClosed}
+	}
+	return Health{State: BrokerConnected}
+}
+
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for _, queue := range b.queues {
+		queue.close()
+	}
+	return nil
+}
+
+type memoryMessage struct {
+	Message
+	redelivered bool
+}
+
+type memoryQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	messages []memoryMessage
+	closed   bool
+}
+
+func newMemoryQueue() *memoryQueue {
+	q := memoryQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return &q
+}
+
+func (q *memoryQueue) push(msg memoryMessage, front bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if front {
+		q.messages = append([]memoryMessage{msg}, q.messages...)
+	} else {
+		q.messages = append(q.messages, msg)
+	}
+	q.cond.Signal()
+}
+
+// pop blocks until a message is available, it returns false when queue is
+// closed or stop is closed
+func (q *memoryQueue) pop(stop <-chan struct{}) (memoryMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.messages) == 0 && !q.closed && !isClosed(stop) {
+		q.cond.Wait()
+	}
+	if q.closed || isClosed(stop) {
+		return memoryMessage{}, false
+	}
+
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	return msg, true
+}
+
+// wake wakes up the waiting subscribers to check if they are stopped
+func (q *memoryQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cond.Broadcast()
+}
+
+func (q *memoryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+type memoryAcknowledger struct {
+	mu      sync.Mutex
+	queue   *memoryQueue
+	msg     memoryMessage
+	credits chan struct{}
+	settled bool
+}
+
+func (a *memoryAcknowledger) Ack() error {
+	return a.settle(func() {})
+}
+
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	return a.settle(func() {
+		if requeue {
+			a.msg.redelivered = true
+			a.queue.push(a.msg, true)
+		}
+	})
+}
+
+func (a *memoryAcknowledger) settle(fn func()) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.settled {
+		return errors.New("delivery is already acknowledged")
+	}
+	a.settled = true
+	fn()
+
+	if a.credits != nil {
+		<-a.credits
+	}
+	return nil
+}
+
+func matchRouting(kind, pattern, routingKey string) bool {
+	switch kind {
+	case ExchangeTypeFanout:
+		return true
+	case ExchangeTypeTopic:
+		return matchTopic(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+	}
+	return pattern == routingKey
+}
+
+// matchTopic matches routing key words against binding pattern, `*` matches
+// exactly one word and `#` matches zero or more words.
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
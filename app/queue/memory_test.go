@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMemoryBroker(t *testing.T, queue, pattern string) Broker {
+	t.Helper()
+
+	broker := NewMemoryBroker()
+	if err := broker.DeclareExchange(ExchangeSpec{Name: "test", Kind: ExchangeTypeTopic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.DeclareQueue(QueueSpec{Name: queue}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.BindQueue(queue, "test", pattern); err != nil {
+		t.Fatal(err)
+	}
+	return broker
+}
+
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+
+	select {
+	case delivery, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries are closed")
+		}
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("no delivery in time")
+	}
+	return Delivery{}
+}
+
+func TestMemoryBrokerRoutesByTopic(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "order.*")
+	defer broker.Close()
+
+	var confirmations []Confirmation
+	confirm := func(confirmation Confirmation) {
+		confirmations = append(confirmations, confirmation)
+	}
+	if err := broker.Publish("test", &Message{ID: "1", RoutingKey: "order.created"}, confirm); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("test", &Message{ID: "2", RoutingKey: "user.created"}, confirm); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(confirmations) != 2 || confirmations[0].Unroutable || !confirmations[1].Unroutable {
+		t.Fatalf("unexpected confirmations %+v", confirmations)
+	}
+
+	deliveries, err := broker.Subscribe("orders", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := receive(t, deliveries)
+	if delivery.ID != "1" {
+		t.Fatalf("expected message 1, got %s", delivery.ID)
+	}
+	if err := delivery.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Ack(); err == nil {
+		t.Fatal("expected error acking twice")
+	}
+}
+
+func TestMemoryBrokerRedeliversNackedMessage(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+
+	broker.Publish("test", &Message{ID: "1", RoutingKey: "order"}, nil)
+	broker.Publish("test", &Message{ID: "2", RoutingKey: "order"}, nil)
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	first := receive(t, deliveries)
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	redelivered := receive(t, deliveries)
+	if redelivered.ID != "1" || !redelivered.Redelivered {
+		t.Fatalf("expected redelivered message 1, got %s (redelivered %v)", redelivered.ID, redelivered.Redelivered)
+	}
+	redelivered.Nack(false)
+
+	next := receive(t, deliveries)
+	if next.ID != "2" || next.Redelivered {
+		t.Fatalf("expected message 2, got %s", next.ID)
+	}
+}
+
+func TestMemoryBrokerUnsubscribeKeepsMessage(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	broker.Publish("test", &Message{ID: "1", RoutingKey: "order"}, nil)
+
+	// The subscription holds message 1 until it's read, nobody reads it
+	time.Sleep(10 * time.Millisecond)
+	if err := broker.(Unsubscriber).Unsubscribe(deliveries); err != nil {
+		t.Fatal(err)
+	}
+	for range deliveries {
+		t.Fatal("unexpected delivery after unsubscribe")
+	}
+
+	deliveries, _ = broker.Subscribe("orders", 1)
+	if delivery := receive(t, deliveries); delivery.ID != "1" {
+		t.Fatalf("expected message 1, got %s", delivery.ID)
+	}
+}
+
+func TestMemoryBrokerUnsubscribeIdleQueue(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+
+	// The subscription waits for a message of the empty queue
+	deliveries, _ := broker.Subscribe("orders", 1)
+	time.Sleep(10 * time.Millisecond)
+	if err := broker.(Unsubscriber).Unsubscribe(deliveries); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Fatal("unexpected delivery after unsubscribe")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliveries aren't closed after unsubscribe")
+	}
+
+	broker.Publish("test", &Message{ID: "1", RoutingKey: "order"}, nil)
+	deliveries, _ = broker.Subscribe("orders", 1)
+	if delivery := receive(t, deliveries); delivery.ID != "1" {
+		t.Fatalf("expected message 1, got %s", delivery.ID)
+	}
+}
+
+func TestMemoryBrokerPrefetch(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+
+	for _, id := range []string{"1", "2", "3"} {
+		broker.Publish("test", &Message{ID: id, RoutingKey: "order"}, nil)
+	}
+
+	deliveries, _ := broker.Subscribe("orders", 2)
+	first := receive(t, deliveries)
+	receive(t, deliveries)
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("prefetch exceeded by message %s", delivery.ID)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	first.Ack()
+	if delivery := receive(t, deliveries); delivery.ID != "3" {
+		t.Fatalf("expected message 3, got %s", delivery.ID)
+	}
+}
@@ -0,0 +1,210 @@
+package queue
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/quangdangfit/gosdk/utils/logger"
+	"github.com/streadway/amqp"
+
+	"message-queue/app/models"
+	"message-queue/config"
+)
+
+const (
+	HeaderDeadLetterExchange = "x-dead-letter-exchange"
+	HeaderDeath              = "x-death"
+	DeathReasonRejected      = "rejected"
+	ParkingQueueSuffix       = ".parking"
+)
+
+// DeadLetterer is implemented by drivers which dead letter rejected
+// deliveries by themselves, the consumer publishes rejected deliveries to the
+// dead letter exchange for the others.
+type DeadLetterer interface {
+	DeadLetters() bool
+}
+
+// Parking consumes deliveries dead lettered to the parking queue
+type Parking interface {
+	Consume() <-chan *ParkedDelivery
+	// Stop stops forwarding parked deliveries and closes the consume channel
+	Stop()
+	// Requeue publishes parked message back to the exchange it was rejected
+	// from with its original routing key
+	Requeue(message *models.ParkedMessage) error
+}
+
+// ParkedDelivery must be acked after the message is stored
+type ParkedDelivery struct {
+	Message  *models.ParkedMessage
+	Delivery Delivery
+}
+
+func (d *ParkedDelivery) Ack() error {
+	return d.Delivery.Ack()
+}
+
+func (d *ParkedDelivery) Nack(requeue bool) error {
+	return d.Delivery.Nack(requeue)
+}
+
+type parking struct {
+	broker   Broker
+	queue    string
+	exchange string
+	msgChan  chan *ParkedDelivery
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewParking(broker Broker) Parking {
+	return &parking{
+		broker:   broker,
+		queue:    parkingQueue(),
+		exchange: config.Config.AMQP.ExchangeName,
+		msgChan:  make(chan *ParkedDelivery),
+		done:     make(chan struct{}),
+	}
+}
+
+// parkingQueue returns name of the parking queue, it defaults to the
+// consumer queue name with ".parking" suffix
+func parkingQueue() string {
+	if config.Config.AMQP.ParkingQueue != "" {
+		return config.Config.AMQP.ParkingQueue
+	}
+	return config.Config.AMQP.QueueName + ParkingQueueSuffix
+}
+
+func (p *parking) Consume() <-chan *ParkedDelivery {
+	if config.Config.AMQP.DeadLetterExchange == "" {
+		close(p.msgChan)
+		return p.msgChan
+	}
+
+	deliveries, err := p.broker.Subscribe(p.queue, DefaultPrefetch)
+	if err != nil {
+		logger.Error("Failed to subscribe parking queue: ", err)
+		close(p.msgChan)
+		return p.msgChan
+	}
+
+	logger.Info("Starting consume parking queue: ", p.queue)
+	go func() {
+		defer close(p.msgChan)
+		for {
+			select {
+			case msg, ok := <-deliveries:
+				if !ok {
+					return
+				}
+				select {
+				case p.msgChan <- &ParkedDelivery{Message: p.parse(msg), Delivery: msg}:
+				case <-p.done:
+					msg.Nack(true)
+					return
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p.msgChan
+}
+
+func (p *parking) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+func (p *parking) parse(msg Delivery) *models.ParkedMessage {
+	message := models.ParkedMessage{
+		Exchange:      p.exchange,
+		RoutingKey:    msg.RoutingKey,
+		BrokerHeaders: msg.Headers,
+	}
+	if err := json.Unmarshal(msg.Body, &message.Payload); err != nil {
+		message.Body = string(msg.Body)
+	}
+
+	data, _ := json.Marshal(msg.Headers)
+	json.Unmarshal(data, &message.Headers)
+
+	if death, ok := lastDeath(msg.Headers); ok {
+		message.Queue, _ = death["queue"].(string)
+		message.Reason, _ = death["reason"].(string)
+		if exchange, _ := death["exchange"].(string); exchange != "" {
+			message.Exchange = exchange
+		}
+		if keys, ok := death["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+			message.RoutingKey, _ = keys[0].(string)
+		}
+	}
+	return &message
+}
+
+func (p *parking) Requeue(message *models.ParkedMessage) error {
+	body := []byte(message.Body)
+	if message.Payload != nil {
+		body, _ = json.Marshal(message.Payload)
+	}
+
+	exchange := message.Exchange
+	if exchange == "" {
+		exchange = p.exchange
+	}
+
+	return p.broker.Publish(exchange, &Message{
+		Key:        messageKey(message.OriginModel, message.OriginCode),
+		RoutingKey: message.RoutingKey,
+		Headers: map[string]interface{}{
+			"origin_code":  message.OriginCode,
+			"origin_model": message.OriginModel,
+			"api_key":      message.APIKey,
+		},
+		ContentType: "application/json",
+		Body:        body,
+	}, nil)
+}
+
+// lastDeath returns the latest x-death entry, the broker prepends entries
+// so the first one is the latest.
+func lastDeath(headers map[string]interface{}) (map[string]interface{}, bool) {
+	deaths, ok := headers[HeaderDeath].([]interface{})
+	if !ok || len(deaths) == 0 {
+		return nil, false
+	}
+
+	switch death := deaths[0].(type) {
+	case amqp.Table:
+		return death, true
+	case map[string]interface{}:
+		return death, true
+	}
+	return nil, false
+}
+
+// deadLetterHeaders returns headers of delivery with a new x-death entry as
+// the broker adds when a delivery is rejected
+func deadLetterHeaders(delivery Delivery, queue, exchange string) map[string]interface{} {
+	headers := make(map[string]interface{}, len(delivery.Headers)+1)
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+
+	death := map[string]interface{}{
+		"queue":        queue,
+		"reason":       DeathReasonRejected,
+		"exchange":     exchange,
+		"routing-keys": []interface{}{delivery.RoutingKey},
+		"count":        1,
+		"time":         time.Now(),
+	}
+	deaths, _ := headers[HeaderDeath].([]interface{})
+	headers[HeaderDeath] = append([]interface{}{death}, deaths...)
+	return headers
+}
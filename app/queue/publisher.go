@@ -4,108 +4,96 @@ import (
 	"encoding/json"
 
 	"github.com/quangdangfit/gosdk/utils/logger"
-	"github.com/streadway/amqp"
 
 	"message-queue/app/models"
+	"message-queue/app/repositories"
 	"message-queue/config"
 	"message-queue/pkg/utils"
 )
 
 type Publisher interface {
-	Publish(message *models.OutMessage, reliable bool) error
+	// Publish sends stored message to the exchange, status of the message is
+	// updated when the broker confirms it.
+	Publish(message *models.OutMessage) error
 }
 
 type publisher struct {
-	messageQueue
+	broker   Broker
+	repo     repositories.OutRepository
+	exchange string
 }
 
-func NewPublisher() Publisher {
-	pub := publisher{}
-	pub.config = &AMQPConfig{
-		AMQPUrl:      config.Config.AMQP.URL,
-		ExchangeName: config.Config.AMQP.ExchangeName,
-		ExchangeType: config.Config.AMQP.ExchangeType,
-		QueueName:    config.Config.AMQP.QueueName,
-	}
-	_, err := pub.newConnection()
-	if err != nil {
-		logger.Error("Publisher create new connection failed!")
-	}
-
-	err = pub.declareExchange()
-	if err != nil {
-		logger.Error("Publisher declare exchange failed!")
+func NewPublisher(broker Broker, repo repositories.OutRepository) Publisher {
+	pub := publisher{
+		broker:   broker,
+		repo:     repo,
+		exchange: config.Config.AMQP.ExchangeName,
 	}
 
 	return &pub
 }
 
-func (pub *publisher) Publish(message *models.OutMessage, reliable bool) (
-	err error) {
-
-	// New channel and close after publish
-	pub.ensureConnection()
-	channel, _ := pub.connection.Channel()
-	defer channel.Close()
-
-	// Reliable publisher confirms require confirm.select support from the connection.
-	var confirms chan amqp.Confirmation
-	if reliable {
-		if err := channel.Confirm(false); err != nil {
-			logger.Errorf("Channel could not be put into confirm mode: %s", err)
-			return err
-		}
-		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
-	}
-
+func (pub *publisher) Publish(message *models.OutMessage) (err error) {
 	payload, _ := json.Marshal(message.Payload)
-	headers := amqp.Table{
-		"origin_code":  message.OriginCode,
-		"origin_model": message.OriginModel,
-		"api_key":      message.APIKey,
-	}
-	if err = channel.Publish(
-		pub.config.ExchangeName, // publish to an exchange
-		message.RoutingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			Headers:         headers,
-			ContentType:     "application/json",
-			ContentEncoding: "",
-			Body:            payload,
-			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			Priority:        0,              // 0-9
-			// a bunch of application/implementation-specific fields
+	msg := Message{
+		ID:         message.ID,
+		Key:        messageKey(message.OriginModel, message.OriginCode),
+		RoutingKey: message.RoutingKey,
+		Headers: map[string]interface{}{
+			"origin_code":  message.OriginCode,
+			"origin_model": message.OriginModel,
+			"api_key":      message.APIKey,
 		},
-	); err != nil {
+		ContentType: "application/json",
+		Body:        payload,
+	}
+
+	err = pub.broker.Publish(pub.exchange, &msg, pub.confirm)
+	if err != nil {
+		logger.Error("Failed to publish message ", err)
 		message.Status = models.OutMessageStatusFailed
 		message.Logs = append(message.Logs, utils.ParseLogs(err))
-		logger.Error("Failed to publish message ", err)
+		pub.updateStatus(message.ID, message.Status, utils.ParseLogs(err))
 		return err
 	}
 
-	if confirms != nil {
-		defer pub.confirmOne(message, confirms)
-	}
-
 	return nil
 }
 
-func (pub *publisher) confirmOne(message *models.OutMessage, confirms <-chan amqp.Confirmation) bool {
-
-	confirmed := <-confirms
-	if confirmed.Ack {
-		logger.Info("Confirmed delivery with delivery tag: ",
-			confirmed.DeliveryTag)
+// confirm updates status of message confirmed by the broker
+func (pub *publisher) confirm(confirmation Confirmation) {
+	switch {
+	case confirmation.Err != nil:
+		logger.Errorf("Failed to confirm message %s, %s", confirmation.MessageID, confirmation.Err)
+		pub.updateStatus(confirmation.MessageID, models.OutMessageStatusFailed,
+			utils.ParseLogs(confirmation.Err))
+	case confirmation.Unroutable:
+		logger.Errorf("Message %s is unroutable, %s", confirmation.MessageID, confirmation.Reason)
+		pub.updateStatus(confirmation.MessageID, models.OutMessageStatusUnroutable,
+			utils.ParseLogs(confirmation.Reason))
+	case confirmation.Ack:
+		pub.updateStatus(confirmation.MessageID, models.OutMessageStatusSent)
+	default:
+		logger.Errorf("Message %s is not confirmed by broker", confirmation.MessageID)
+		pub.updateStatus(confirmation.MessageID, models.OutMessageStatusSentWait)
+	}
+}
 
-		message.Status = models.OutMessageStatusSent
-		return true
+func (pub *publisher) updateStatus(id, status string, logs ...interface{}) {
+	if id == "" {
+		return
 	}
 
-	logger.Info("Failed delivery of delivery tag: ",
-		confirmed.DeliveryTag)
+	err := pub.repo.UpdateStatus(id, status, logs...)
+	if err != nil {
+		logger.Errorf("Failed to update status of out message %s, %s", id, err)
+	}
+}
 
-	message.Status = models.OutMessageStatusSentWait
-	return false
+// messageKey returns ordering key of messages belong to the same entity
+func messageKey(originModel, originCode string) string {
+	if originModel == "" && originCode == "" {
+		return ""
+	}
+	return originModel + ":" + originCode
 }
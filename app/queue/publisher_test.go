@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/quangdangfit/gosdk/utils/paging"
+
+	"message-queue/app/models"
+	"message-queue/app/schema"
+	"message-queue/pkg/utils"
+)
+
+type fakeOutStatus struct {
+	status string
+	logs   []interface{}
+}
+
+// fakeOutRepo records status updates of out messages
+type fakeOutRepo struct {
+	mu       sync.Mutex
+	statuses map[string]fakeOutStatus
+}
+
+func (r *fakeOutRepo) Retrieve(id string) (*models.OutMessage, error) {
+	return nil, nil
+}
+
+func (r *fakeOutRepo) Get(query *schema.OutMsgQueryParam) (*models.OutMessage, error) {
+	return nil, nil
+}
+
+func (r *fakeOutRepo) List(query *schema.OutMsgQueryParam) (*[]models.OutMessage, *paging.Paging, error) {
+	return &[]models.OutMessage{}, &paging.Paging{}, nil
+}
+
+func (r *fakeOutRepo) Create(message *models.OutMessage) error {
+	return nil
+}
+
+func (r *fakeOutRepo) Update(id string, body *schema.OutMsgUpdateParam) (*models.OutMessage, error) {
+	return nil, nil
+}
+
+func (r *fakeOutRepo) UpdateStatus(id string, status string, logs ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.statuses[id] = fakeOutStatus{status: status, logs: logs}
+	return nil
+}
+
+func TestPublisherMarksUnroutableMessage(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "order.*")
+	defer broker.Close()
+
+	repo := &fakeOutRepo{statuses: make(map[string]fakeOutStatus)}
+	pub := &publisher{broker: broker, repo: repo, exchange: "test"}
+
+	routed := models.OutMessage{ID: "1", RoutingKey: "order.created"}
+	if err := pub.Publish(&routed); err != nil {
+		t.Fatal(err)
+	}
+	unroutable := models.OutMessage{ID: "2", RoutingKey: "user.created"}
+	if err := pub.Publish(&unroutable); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := repo.statuses["1"]; got.status != models.OutMessageStatusSent {
+		t.Errorf("expected routed message %s, got %s", models.OutMessageStatusSent, got.status)
+	}
+	got := repo.statuses["2"]
+	if got.status != models.OutMessageStatusUnroutable {
+		t.Fatalf("expected unroutable message %s, got %s", models.OutMessageStatusUnroutable, got.status)
+	}
+	if len(got.logs) != 1 {
+		t.Fatalf("expected reply text in logs, got %v", got.logs)
+	}
+	if logs, ok := got.logs[0].(*utils.Logs); !ok || logs.Error != ReplyNoRoute {
+		t.Fatalf("expected reply text %s in logs, got %v", ReplyNoRoute, got.logs)
+	}
+}
@@ -0,0 +1,549 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/quangdangfit/gosdk/utils/logger"
+)
+
+const (
+	DefaultRedisPrefix        = "gomq:"
+	DefaultRedisClaimMinIdle  = 60 * time.Second
+	DefaultRedisClaimInterval = 30 * time.Second
+	DefaultRedisReadBlock     = 2 * time.Second
+	RedisClaimCount           = 100
+)
+
+// redisBroker maps exchanges to Redis streams and queues to consumer groups.
+// Routing key is stored as an entry field and matched against queue bindings
+// by the consumer, unmatched entries are acknowledged without delivery.
+type redisBroker struct {
+	config *RedisConfig
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewRedisBroker(config *RedisConfig) Broker {
+	if config.Prefix == "" {
+		config.Prefix = DefaultRedisPrefix
+	}
+	if config.ClaimMinIdle <= 0 {
+		config.ClaimMinIdle = DefaultRedisClaimMinIdle
+	}
+	if config.ClaimInterval <= 0 {
+		config.ClaimInterval = DefaultRedisClaimInterval
+	}
+	if config.ReadBlock <= 0 {
+		config.ReadBlock = DefaultRedisReadBlock
+	}
+	if config.Consumer == "" {
+		hostname, _ := os.Hostname()
+		config.Consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := redisBroker{
+		config: config,
+		client: redis.NewClient(&redis.Options{
+			Addr:     config.Addr,
+			Password: config.Password,
+			DB:       config.DB,
+		}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if err := b.client.Ping(ctx).Err(); err != nil {
+		logger.Error("Failed to connect to Redis: ", err)
+	}
+	return &b
+}
+
+func (b *redisBroker) streamKey(exchange string) string {
+	return b.config.Prefix + exchange
+}
+
+func (b *redisBroker) exchangesKey() string {
+	return b.config.Prefix + "exchanges"
+}
+
+func (b *redisBroker) bindingsKey(queue string) string {
+	return b.config.Prefix + "bindings:" + queue
+}
+
+// routesKey is the set of queue bindings of the exchange as "queue pattern"
+// members, it is used to detect unroutable messages on publishing
+func (b *redisBroker) routesKey(exchange string) string {
+	return b.config.Prefix + "routes:" + exchange
+}
+
+func (b *redisBroker) DeclareExchange(spec ExchangeSpec) error {
+	err := b.client.HSet(b.ctx, b.exchangesKey(), spec.Name, spec.Kind).Err()
+	if err != nil {
+		logger.Error("Failed to declare exchange: ", err)
+		return err
+	}
+
+	logger.Info("Declared exchange: ", spec.Name)
+	return nil
+}
+
+// DeclareQueue is a no-op, the consumer group of a queue is created when the
+// queue is bound to an exchange.
+func (b *redisBroker) DeclareQueue(spec QueueSpec) error {
+	logger.Info("Declared queue: ", spec.Name)
+	return nil
+}
+
+func (b *redisBroker) BindQueue(queue, exchange, routingKey string) error {
+	err := b.createGroup(exchange, queue)
+	if err != nil {
+		logger.Error("Failed to bind queue: ", err)
+		return err
+	}
+
+	err = b.client.SAdd(b.ctx, b.bindingsKey(queue), exchange+" "+routingKey).Err()
+	if err != nil {
+		logger.Error("Failed to bind queue: ", err)
+		return err
+	}
+
+	err = b.client.SAdd(b.ctx, b.routesKey(exchange), queue+" "+routingKey).Err()
+	if err != nil {
+		logger.Error("Failed to bind queue: ", err)
+		return err
+	}
+	return nil
+}
+
+// UnbindQueue removes the binding, the consumer group is kept because other
+// bindings of the queue may use the same stream.
+func (b *redisBroker) UnbindQueue(queue, exchange, routingKey string) error {
+	err := b.client.SRem(b.ctx, b.bindingsKey(queue), exchange+" "+routingKey).Err()
+	if err != nil {
+		logger.Error("Failed to unbind queue: ", err)
+		return err
+	}
+
+	err = b.client.SRem(b.ctx, b.routesKey(exchange), queue+" "+routingKey).Err()
+	if err != nil {
+		logger.Error("Failed to unbind queue: ", err)
+		return err
+	}
+	return nil
+}
+
+func (b *redisBroker) Bindings(exchange string) ([]Binding, error) {
+	members, err := b.client.SMembers(b.ctx, b.routesKey(exchange)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var bindings []Binding
+	for _, member := range members {
+		parts := strings.SplitN(member, " ", 2)
+		if len(parts) == 2 {
+			bindings = append(bindings, Binding{Queue: parts[0], RoutingKey: parts[1]})
+		}
+	}
+	return bindings, nil
+}
+
+// routable reports any queue is bound to exchange for the routing key
+func (b *redisBroker) routable(exchange, routingKey string) (bool, error) {
+	kind, err := b.client.HGet(b.ctx, b.exchangesKey(), exchange).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	members, err := b.client.SMembers(b.ctx, b.routesKey(exchange)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	for _, member := range members {
+		parts := strings.SplitN(member, " ", 2)
+		if len(parts) == 2 && matchRouting(kind, parts[1], routingKey) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *redisBroker) createGroup(exchange, queue string) error {
+	err := b.client.XGroupCreateMkStream(b.ctx, b.streamKey(exchange), queue, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (b *redisBroker) Publish(exchange string, msg *Message, confirm ConfirmFunc) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	routable, err := b.routable(exchange, msg.RoutingKey)
+	if err != nil {
+		return err
+	}
+	if !routable {
+		confirm.unroutable(msg)
+		return nil
+	}
+
+	err = b.client.XAdd(b.ctx, &redis.XAddArgs{
+		Stream:       b.streamKey(exchange),
+		MaxLenApprox: b.config.MaxLen,
+		Values: map[string]interface{}{
+			"routing_key":  msg.RoutingKey,
+			"headers":      string(headers),
+			"content_type": msg.ContentType,
+			"body":         string(msg.Body),
+		},
+	}).Err()
+	if err != nil {
+		return err
+	}
+
+	confirm.ack(msg)
+	return nil
+}
+
+func (b *redisBroker) Subscribe(queue string, prefetch int) (<-chan Delivery, error) {
+	if prefetch <= 0 {
+		prefetch = DefaultPrefetch
+	}
+
+	sub := redisSubscription{
+		broker:     b,
+		queue:      queue,
+		credits:    make(chan struct{}, prefetch),
+		inflight:   make(map[string]bool),
+		deliveries: make(chan Delivery),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sub.read()
+	}()
+	go func() {
+		defer wg.Done()
+		sub.claim()
+	}()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		wg.Wait()
+		close(sub.deliveries)
+	}()
+
+	return sub.deliveries, nil
+}
+
+func (b *redisBroker) Health() Health {
+	if b.ctx.Err() != nil {
+		return Health{State: BrokerClosed, Since: time.Now()}
+	}
+	if err := b.client.Ping(b.ctx).Err(); err != nil {
+		return Health{State: BrokerReconnecting, Since: time.Now(), Error: err.Error()}
+	}
+	return Health{State: BrokerConnected, Since: time.Now()}
+}
+
+func (b *redisBroker) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return b.client.Close()
+}
+
+type redisSubscription struct {
+	broker *redisBroker
+	queue  string
+
+	mu       sync.Mutex
+	credits  chan struct{}
+	inflight map[string]bool // entry IDs being processed by this consumer
+
+	deliveries chan Delivery
+}
+
+// bindings returns routing patterns of the queue grouped by exchange stream
+func (s *redisSubscription) bindings() (map[string][]string, map[string]string, error) {
+	b := s.broker
+	members, err := b.client.SMembers(b.ctx, b.bindingsKey(s.queue)).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	kinds, err := b.client.HGetAll(b.ctx, b.exchangesKey()).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bindings := make(map[string][]string)
+	streamKinds := make(map[string]string)
+	for _, member := range members {
+		parts := strings.SplitN(member, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		stream := b.streamKey(parts[0])
+		bindings[stream] = append(bindings[stream], parts[1])
+		streamKinds[stream] = kinds[parts[0]]
+	}
+	return bindings, streamKinds, nil
+}
+
+func (s *redisSubscription) acquire(n int) int {
+	select {
+	case s.credits <- struct{}{}:
+	case <-s.broker.ctx.Done():
+		return 0
+	}
+
+	acquired := 1
+	for acquired < n {
+		select {
+		case s.credits <- struct{}{}:
+			acquired++
+		default:
+			return acquired
+		}
+	}
+	return acquired
+}
+
+func (s *redisSubscription) release(n int) {
+	for i := 0; i < n; i++ {
+		<-s.credits
+	}
+}
+
+func (s *redisSubscription) read() {
+	b := s.broker
+	for b.ctx.Err() == nil {
+		bindings, kinds, err := s.bindings()
+		if err != nil || len(bindings) == 0 {
+			if err != nil {
+				logger.Error("Failed to get queue bindings: ", err)
+			}
+			s.sleep(b.config.ReadBlock)
+			continue
+		}
+
+		count := s.acquire(cap(s.credits))
+		if count == 0 {
+			return
+		}
+
+		var streams []string
+		for stream := range bindings {
+			streams = append(streams, stream)
+		}
+		for range bindings {
+			streams = append(streams, ">")
+		}
+
+		res, err := b.client.XReadGroup(b.ctx, &redis.XReadGroupArgs{
+			Group:    s.queue,
+			Consumer: b.config.Consumer,
+			Streams:  streams,
+			Count:    int64(count),
+			Block:    b.config.ReadBlock,
+		}).Result()
+		if err != nil {
+			s.release(count)
+			if err != redis.Nil && b.ctx.Err() == nil {
+				logger.Error("Failed to read streams: ", err)
+				if strings.HasPrefix(err.Error(), "NOGROUP") {
+					s.createGroups(bindings)
+				}
+				s.sleep(b.config.ReadBlock)
+			}
+			continue
+		}
+
+		for _, stream := range res {
+			for _, entry := range stream.Messages {
+				delivery := s.parse(entry)
+				if !s.matches(kinds[stream.Stream], bindings[stream.Stream], delivery.RoutingKey) {
+					b.client.XAck(b.ctx, stream.Stream, s.queue, entry.ID)
+					continue
+				}
+
+				count--
+				s.deliver(stream.Stream, entry.ID, delivery)
+			}
+		}
+		s.release(count)
+	}
+}
+
+// claim takes over entries pending longer than ClaimMinIdle, they belong to
+// deliveries which were nacked for requeue or to consumers which are gone.
+func (s *redisSubscription) claim() {
+	b := s.broker
+	ticker := time.NewTicker(b.config.ClaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bindings, kinds, err := s.bindings()
+		if err != nil {
+			logger.Error("Failed to get queue bindings: ", err)
+			continue
+		}
+
+		for stream, patterns := range bindings {
+			pending, err := b.client.XPendingExt(b.ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  s.queue,
+				Start:  "-",
+				End:    "+",
+				Count:  RedisClaimCount,
+			}).Result()
+			if err != nil {
+				continue
+			}
+
+			var ids []string
+			s.mu.Lock()
+			for _, entry := range pending {
+				if entry.Idle >= b.config.ClaimMinIdle && !s.inflight[entry.ID] {
+					ids = append(ids, entry.ID)
+				}
+			}
+			s.mu.Unlock()
+			if len(ids) == 0 {
+				continue
+			}
+
+			entries, err := b.client.XClaim(b.ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    s.queue,
+				Consumer: b.config.Consumer,
+				MinIdle:  b.config.ClaimMinIdle,
+				Messages: ids,
+			}).Result()
+			if err != nil {
+				logger.Error("Failed to claim pending entries: ", err)
+				continue
+			}
+
+			for _, entry := range entries {
+				delivery := s.parse(entry)
+				if !s.matches(kinds[stream], patterns, delivery.RoutingKey) {
+					b.client.XAck(b.ctx, stream, s.queue, entry.ID)
+					continue
+				}
+				if s.acquire(1) == 0 {
+					return
+				}
+
+				delivery.Redelivered = true
+				s.deliver(stream, entry.ID, delivery)
+			}
+		}
+	}
+}
+
+func (s *redisSubscription) createGroups(bindings map[string][]string) {
+	for stream := range bindings {
+		exchange := strings.TrimPrefix(stream, s.broker.config.Prefix)
+		if err := s.broker.createGroup(exchange, s.queue); err != nil {
+			logger.Error("Failed to create consumer group: ", err)
+		}
+	}
+}
+
+func (s *redisSubscription) deliver(stream, id string, delivery Delivery) {
+	s.mu.Lock()
+	s.inflight[id] = true
+	s.mu.Unlock()
+
+	delivery.Acknowledger = &redisAcknowledger{
+		subscription: s,
+		stream:       stream,
+		id:           id,
+	}
+	select {
+	case s.deliveries <- delivery:
+	case <-s.broker.ctx.Done():
+	}
+}
+
+func (s *redisSubscription) settle(id string) {
+	s.mu.Lock()
+	delete(s.inflight, id)
+	s.mu.Unlock()
+	s.release(1)
+}
+
+func (s *redisSubscription) matches(kind string, patterns []string, routingKey string) bool {
+	for _, pattern := range patterns {
+		if matchRouting(kind, pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *redisSubscription) parse(entry redis.XMessage) Delivery {
+	delivery := Delivery{}
+	delivery.RoutingKey, _ = entry.Values["routing_key"].(string)
+	delivery.ContentType, _ = entry.Values["content_type"].(string)
+	body, _ := entry.Values["body"].(string)
+	delivery.Body = []byte(body)
+	headers, _ := entry.Values["headers"].(string)
+	json.Unmarshal([]byte(headers), &delivery.Headers)
+	return delivery
+}
+
+func (s *redisSubscription) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-s.broker.ctx.Done():
+	}
+}
+
+type redisAcknowledger struct {
+	subscription *redisSubscription
+	stream       string
+	id           string
+}
+
+func (a *redisAcknowledger) Ack() error {
+	defer a.subscription.settle(a.id)
+
+	b := a.subscription.broker
+	return b.client.XAck(b.ctx, a.stream, a.subscription.queue, a.id).Err()
+}
+
+// Nack with requeue leaves the entry pending, it is claimed again after
+// ClaimMinIdle. Otherwise the entry is acknowledged and dropped.
+func (a *redisAcknowledger) Nack(requeue bool) error {
+	defer a.subscription.settle(a.id)
+	if requeue {
+		return nil
+	}
+
+	b := a.subscription.broker
+	return b.client.XAck(b.ctx, a.stream, a.subscription.queue, a.id).Err()
+}
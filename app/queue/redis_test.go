@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedisBroker(t *testing.T, queue, pattern string) (Broker, *miniredis.Miniredis) {
+	t.Helper()
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	broker := NewRedisBroker(&RedisConfig{
+		Addr:          server.Addr(),
+		Consumer:      "test",
+		ClaimMinIdle:  50 * time.Millisecond,
+		ClaimInterval: 20 * time.Millisecond,
+		ReadBlock:     50 * time.Millisecond,
+	})
+	if err := broker.DeclareExchange(ExchangeSpec{Name: "test", Kind: ExchangeTypeTopic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.DeclareQueue(QueueSpec{Name: queue}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.BindQueue(queue, "test", pattern); err != nil {
+		t.Fatal(err)
+	}
+	return broker, server
+}
+
+func TestRedisBrokerPublishConsume(t *testing.T) {
+	broker, server := newTestRedisBroker(t, "orders", "order.*")
+	defer broker.Close()
+
+	var confirmations []Confirmation
+	confirm := func(confirmation Confirmation) {
+		confirmations = append(confirmations, confirmation)
+	}
+	msg := Message{
+		RoutingKey:  "order.created",
+		Headers:     map[string]interface{}{"origin_code": "1"},
+		ContentType: "application/json",
+		Body:        []byte(`{"id": "1"}`),
+	}
+	if err := broker.Publish("test", &msg, confirm); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("test", &Message{RoutingKey: "user.created"}, confirm); err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmations) != 2 || confirmations[0].Unroutable || !confirmations[1].Unroutable {
+		t.Fatalf("unexpected confirmations %+v", confirmations)
+	}
+
+	deliveries, err := broker.Subscribe("orders", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := receive(t, deliveries)
+	if delivery.RoutingKey != msg.RoutingKey || string(delivery.Body) != string(msg.Body) ||
+		delivery.ContentType != msg.ContentType || delivery.Headers["origin_code"] != "1" {
+		t.Fatalf("unexpected delivery %+v", delivery.Message)
+	}
+	if err := delivery.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	pending, err := client.XPending(context.Background(), DefaultRedisPrefix+"test", "orders").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("expected no pending entries after ack, got %d", pending.Count)
+	}
+}
+
+func TestRedisBrokerSkipsUnboundRoutingKeys(t *testing.T) {
+	broker, _ := newTestRedisBroker(t, "orders", "order.created")
+	defer broker.Close()
+
+	// Both queues read the same stream, orders only gets its routing keys
+	broker.BindQueue("users", "test", "user.*")
+	broker.Publish("test", &Message{RoutingKey: "user.created", Body: []byte("user")}, nil)
+	broker.Publish("test", &Message{RoutingKey: "order.created", Body: []byte("order")}, nil)
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	delivery := receive(t, deliveries)
+	if string(delivery.Body) != "order" {
+		t.Fatalf("expected order, got %s", delivery.Body)
+	}
+	delivery.Ack()
+}
+
+func TestRedisBrokerReclaimsNackedMessage(t *testing.T) {
+	broker, _ := newTestRedisBroker(t, "orders", "#")
+	defer broker.Close()
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	broker.Publish("test", &Message{RoutingKey: "order", Body: []byte("1")}, nil)
+
+	first := receive(t, deliveries)
+	if first.Redelivered {
+		t.Fatal("first delivery is marked redelivered")
+	}
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	redelivered := receive(t, deliveries)
+	if string(redelivered.Body) != "1" || !redelivered.Redelivered {
+		t.Fatalf("expected redelivered message 1, got %s (redelivered %v)", redelivered.Body, redelivered.Redelivered)
+	}
+	if err := redelivered.Nack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery %s after reject", delivery.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRedisBrokerReclaimsFromGoneConsumer(t *testing.T) {
+	broker, server := newTestRedisBroker(t, "orders", "#")
+	defer broker.Close()
+
+	deliveries, _ := broker.Subscribe("orders", 1)
+	broker.Publish("test", &Message{RoutingKey: "order", Body: []byte("1")}, nil)
+	receive(t, deliveries)
+
+	// Another replica takes over the entry the first one never settled
+	other := NewRedisBroker(&RedisConfig{
+		Addr:          server.Addr(),
+		Consumer:      "other",
+		ClaimMinIdle:  50 * time.Millisecond,
+		ClaimInterval: 20 * time.Millisecond,
+		ReadBlock:     50 * time.Millisecond,
+	})
+	defer other.Close()
+
+	otherDeliveries, _ := other.Subscribe("orders", 1)
+	delivery := receive(t, otherDeliveries)
+	if string(delivery.Body) != "1" || !delivery.Redelivered {
+		t.Fatalf("expected redelivered message 1, got %s", delivery.Body)
+	}
+	if err := delivery.Ack(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"message-queue/config"
+)
+
+const (
+	RetryModeCron   = "cron"
+	RetryModeBroker = "broker"
+
+	HeaderRetryAttempts      = "x-retry-attempts"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderInMessageID        = "x-in-message-id"
+	HeaderMessageTTL         = "x-message-ttl"
+	HeaderDeadLetterKey      = "x-dead-letter-routing-key"
+
+	RetryConfirmTimeout = 5 * time.Second
+)
+
+var (
+	ErrRetryNotConfirmed = errors.New("retry message is not confirmed by broker")
+)
+
+// RetryDelays returns delays of retry queues from config
+func RetryDelays() []time.Duration {
+	var delays []time.Duration
+	for _, delay := range config.Config.Retry.Delays {
+		delays = append(delays, time.Duration(delay)*time.Second)
+	}
+	return delays
+}
+
+// RetryDelay returns the shortest delay of retry config which isn't shorter
+// than delay, or the longest one. Delay queues are declared only for the
+// delays of config, it returns delay when there is none.
+func RetryDelay(delay time.Duration) time.Duration {
+	delays := RetryDelays()
+	if len(delays) == 0 {
+		return delay
+	}
+
+	var longest, tier time.Duration
+	for _, d := range delays {
+		if d > longest {
+			longest = d
+		}
+		if d >= delay && (tier == 0 || d < tier) {
+			tier = d
+		}
+	}
+	if tier == 0 {
+		return longest
+	}
+	return tier
+}
+
+// retryQueueSpec returns the delay queue of queue, messages expire after
+// delay and are dead lettered back to queue through the default exchange.
+func retryQueueSpec(queue string, delay time.Duration) QueueSpec {
+	return QueueSpec{
+		Name:    fmt.Sprintf("%s.retry.%ds", queue, int64(delay/time.Second)),
+		Durable: true,
+		Args: map[string]interface{}{
+			HeaderMessageTTL:         delay.Milliseconds(),
+			HeaderDeadLetterExchange: "",
+			HeaderDeadLetterKey:      queue,
+		},
+	}
+}
+
+// retrier republishes failed deliveries to delay queues of retry config,
+// delays between them are snapped to the next one by RetryDelay.
+type retrier struct {
+	broker Broker
+}
+
+// declare declares delay queues of a dedicated consumer queue, the ones of
+// the shared queue are in topology
+func (r *retrier) declare(queue string) error {
+	for _, delay := range RetryDelays() {
+		if err := r.broker.DeclareQueue(retryQueueSpec(queue, delay)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry delays delivery in the delay queue of its consumer queue
+func (r *retrier) retry(delivery *InDelivery, delay time.Duration) error {
+	spec := retryQueueSpec(delivery.queue, RetryDelay(delay))
+
+	msg := delivery.Delivery.Message
+	msg.Headers = make(map[string]interface{}, len(delivery.Delivery.Headers)+3)
+	for key, value := range delivery.Delivery.Headers {
+		msg.Headers[key] = value
+	}
+	msg.Headers[HeaderRetryAttempts] = int64(delivery.Message.Attempts)
+	msg.Headers[HeaderOriginalRoutingKey] = delivery.Message.RoutingKey.Name
+	msg.Headers[HeaderInMessageID] = delivery.Message.ID
+	msg.ID = delivery.Message.ID
+	msg.RoutingKey = spec.Name
+
+	confirmed := make(chan Confirmation, 1)
+	err := r.broker.Publish("", &msg, func(confirmation Confirmation) {
+		confirmed <- confirmation
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case confirmation := <-confirmed:
+		if confirmation.Err != nil {
+			return confirmation.Err
+		}
+		if !confirmation.Ack || confirmation.Unroutable {
+			return ErrRetryNotConfirmed
+		}
+		return nil
+	case <-time.After(RetryConfirmTimeout):
+		return ErrRetryNotConfirmed
+	}
+}
+
+// headerUint converts numeric header to uint, AMQP decodes integers to
+// sized types and json decoded headers are float64
+func headerUint(value interface{}) uint {
+	switch v := value.(type) {
+	case int:
+		return uint(v)
+	case int32:
+		return uint(v)
+	case int64:
+		return uint(v)
+	case float64:
+		return uint(v)
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"message-queue/app/models"
+	"message-queue/config"
+)
+
+func TestRetryDelay(t *testing.T) {
+	config.Config.Retry.Delays = []uint{60, 10, 600}
+	defer func() { config.Config.Retry.Delays = nil }()
+
+	tests := []struct {
+		delay    time.Duration
+		expected time.Duration
+	}{
+		{delay: time.Second, expected: 10 * time.Second},
+		{delay: 10 * time.Second, expected: 10 * time.Second},
+		{delay: 11 * time.Second, expected: 60 * time.Second},
+		{delay: 90 * time.Second, expected: 600 * time.Second},
+		{delay: time.Hour, expected: 600 * time.Second}, // the longest delay
+	}
+	for _, test := range tests {
+		if got := RetryDelay(test.delay); got != test.expected {
+			t.Errorf("delay %s: expected %s, got %s", test.delay, test.expected, got)
+		}
+	}
+
+	config.Config.Retry.Delays = nil
+	if got := RetryDelay(time.Minute); got != time.Minute {
+		t.Errorf("expected delay without config, got %s", got)
+	}
+}
+
+func TestRetrierRepublishesToDelayQueue(t *testing.T) {
+	config.Config.Retry.Delays = []uint{10, 60}
+	defer func() { config.Config.Retry.Delays = nil }()
+
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+	retrier := &retrier{broker: broker}
+	if err := retrier.declare("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]interface{}{"origin_code": "1"}
+	delivery := &InDelivery{
+		Message: &models.InMessage{
+			ID:         "1",
+			RoutingKey: models.RoutingKey{Name: "order.created"},
+			Attempts:   2,
+		},
+		Delivery: Delivery{Message: Message{RoutingKey: "order.created", Headers: headers, Body: []byte(`{}`)}},
+		queue:    "orders",
+	}
+	if err := retrier.retry(delivery, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 {
+		t.Fatalf("headers of the delivery are changed: %v", headers)
+	}
+
+	// 30s is delayed in the 60s queue
+	deliveries, err := broker.Subscribe("orders.retry.60s", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried := receive(t, deliveries)
+	if retried.ID != "1" || retried.RoutingKey != "orders.retry.60s" {
+		t.Fatalf("expected message 1 to orders.retry.60s, got %s to %s", retried.ID, retried.RoutingKey)
+	}
+	expected := map[string]interface{}{
+		"origin_code":            "1",
+		HeaderRetryAttempts:      int64(2),
+		HeaderOriginalRoutingKey: "order.created",
+		HeaderInMessageID:        "1",
+	}
+	for key, value := range expected {
+		if retried.Headers[key] != value {
+			t.Errorf("header %s: expected %v, got %v", key, value, retried.Headers[key])
+		}
+	}
+}
+
+func TestRetrierDoesntDeclareDelayQueues(t *testing.T) {
+	config.Config.Retry.Delays = []uint{10}
+	defer func() { config.Config.Retry.Delays = nil }()
+
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+	retrier := &retrier{broker: broker}
+
+	// Delay queues of config aren't declared by topology in this test
+	delivery := &InDelivery{
+		Message:  &models.InMessage{ID: "1", RoutingKey: models.RoutingKey{Name: "order.created"}},
+		Delivery: Delivery{Message: Message{RoutingKey: "order.created"}},
+		queue:    "orders",
+	}
+	if err := retrier.retry(delivery, 10*time.Second); err != ErrRetryNotConfirmed {
+		t.Fatalf("expected %s, got %v", ErrRetryNotConfirmed, err)
+	}
+	if _, err := broker.Subscribe("orders.retry.10s", 1); err != ErrQueueNotFound {
+		t.Fatalf("expected undeclared delay queue, got %v", err)
+	}
+}
+
+func TestConsumerParsesRetriedDelivery(t *testing.T) {
+	c := &consumer{}
+	message, err := c.parseMessageFromDelivery(Delivery{Message: Message{
+		RoutingKey: "orders.retry.10s",
+		Headers: map[string]interface{}{
+			"origin_model":           "order",
+			"origin_code":            "1",
+			HeaderRetryAttempts:      int32(2), // amqp decodes integers to sized types
+			HeaderOriginalRoutingKey: "order.created",
+			HeaderInMessageID:        "2",
+		},
+		Body: []byte(`{"id": "1"}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.RoutingKey.Name != "order.created" {
+		t.Errorf("expected original routing key order.created, got %s", message.RoutingKey.Name)
+	}
+	if message.ID != "2" || message.Attempts != 2 {
+		t.Errorf("expected message 2 of 2 attempts, got %s of %d attempts", message.ID, message.Attempts)
+	}
+	if message.OriginModel != "order" || message.OriginCode != "1" {
+		t.Errorf("expected origin order 1, got %s %s", message.OriginModel, message.OriginCode)
+	}
+}
+
+func TestConsumerDeclaresDelayQueuesOfDedicatedQueue(t *testing.T) {
+	config.Config.AMQP.ExchangeName = "test"
+	config.Config.AMQP.QueueName = "orders"
+	config.Config.Retry.Delays = []uint{10, 60}
+	defer func() { config.Config.Retry.Delays = nil }()
+
+	broker := newTestMemoryBroker(t, "orders", "#")
+	defer broker.Close()
+	c := NewConsumer(broker).(*consumer)
+	defer c.Stop()
+	c.retrier = &retrier{broker: broker}
+
+	routingKey := models.RoutingKey{Name: "order.created", QueueMode: models.RoutingQueueModeKey}
+	if err := c.Bind(&routingKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, queue := range []string{"orders.key.order.created.retry.10s", "orders.key.order.created.retry.60s"} {
+		if _, err := broker.Subscribe(queue, 1); err != nil {
+			t.Errorf("delay queue %s: %s", queue, err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/quangdangfit/gosdk/utils/logger"
+
+	"message-queue/config"
+)
+
+const (
+	TopologyCreate   = "create"
+	TopologyExists   = "exists"
+	TopologyMismatch = "mismatch"
+	TopologyUnknown  = "unknown"
+)
+
+// Topology is the set of exchanges, queues and bindings declared at boot
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+
+	implied map[string]string // queue -> argument added by config, not by topology
+}
+
+// Inspector is implemented by drivers which can check declared topology
+// without changing it
+type Inspector interface {
+	ExchangeExists(name string) (bool, error)
+	QueueExists(name string) (bool, error)
+}
+
+// Matcher is implemented by drivers which can check existing exchanges and
+// queues are declared with the same options and arguments, reason tells the
+// difference. Declaring a mismatched entity fails and so does Apply.
+type Matcher interface {
+	ExchangeMatches(spec ExchangeSpec) (bool, string, error)
+	QueueMatches(spec QueueSpec) (bool, string, error)
+}
+
+// TopologyChange is an entry of the topology dry run
+type TopologyChange struct {
+	Action string
+	Kind   string
+	Name   string
+	Detail string
+}
+
+func (c TopologyChange) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%-8s %-8s %s", c.Action, c.Kind, c.Name)
+	}
+	return fmt.Sprintf("%-8s %-8s %s (%s)", c.Action, c.Kind, c.Name, c.Detail)
+}
+
+// NewTopology reads topology from config, the exchange and queue of AMQP
+// config are declared as durable when they are not listed.
+func NewTopology() *Topology {
+	var topology Topology
+	for _, exchange := range config.Config.Topology.Exchanges {
+		topology.Exchanges = append(topology.Exchanges, ExchangeSpec{
+			Name:       exchange.Name,
+			Kind:       exchange.Kind,
+			Durable:    exchange.Durable,
+			AutoDelete: exchange.AutoDelete,
+			Args:       exchange.Args,
+		})
+	}
+	for _, queue := range config.Config.Topology.Queues {
+		topology.Queues = append(topology.Queues, QueueSpec{
+			Name:       queue.Name,
+			Durable:    queue.Durable,
+			AutoDelete: queue.AutoDelete,
+			Args:       queue.Args,
+		})
+	}
+	for _, binding := range config.Config.Topology.Bindings {
+		topology.Bindings = append(topology.Bindings, BindingSpec{
+			Queue:      binding.Queue,
+			Exchange:   binding.Exchange,
+			RoutingKey: binding.RoutingKey,
+		})
+	}
+
+	if !topology.hasExchange(config.Config.AMQP.ExchangeName) {
+		topology.Exchanges = append(topology.Exchanges, ExchangeSpec{
+			Name:    config.Config.AMQP.ExchangeName,
+			Kind:    config.Config.AMQP.ExchangeType,
+			Durable: true,
+		})
+	}
+	if !topology.hasQueue(config.Config.AMQP.QueueName) {
+		topology.Queues = append(topology.Queues, QueueSpec{
+			Name:    config.Config.AMQP.QueueName,
+			Durable: true,
+		})
+	}
+	topology.addDeadLetter()
+	topology.addRetry()
+
+	return &topology
+}
+
+// addRetry declares delay queues of retry config
+func (t *Topology) addRetry() {
+	if config.Config.Retry.Mode != RetryModeBroker {
+		return
+	}
+
+	for _, delay := range RetryDelays() {
+		spec := retryQueueSpec(config.Config.AMQP.QueueName, delay)
+		if !t.hasQueue(spec.Name) {
+			t.Queues = append(t.Queues, spec)
+		}
+	}
+}
+
+// addDeadLetter declares the dead letter exchange and the parking queue, and
+// dead letters rejected deliveries of the consumer queue to them
+func (t *Topology) addDeadLetter() {
+	dlx := config.Config.AMQP.DeadLetterExchange
+	if dlx == "" {
+		return
+	}
+
+	if !t.hasExchange(dlx) {
+		t.Exchanges = append(t.Exchanges, ExchangeSpec{
+			Name:    dlx,
+			Kind:    ExchangeTypeFanout,
+			Durable: true,
+		})
+	}
+	if !t.hasQueue(parkingQueue()) {
+		t.Queues = append(t.Queues, QueueSpec{
+			Name:    parkingQueue(),
+			Durable: true,
+		})
+	}
+	t.Bindings = append(t.Bindings, BindingSpec{
+		Queue:      parkingQueue(),
+		Exchange:   dlx,
+		RoutingKey: "#",
+	})
+
+	for i, queue := range t.Queues {
+		if queue.Name != config.Config.AMQP.QueueName {
+			continue
+		}
+		if queue.Args == nil {
+			t.Queues[i].Args = make(map[string]interface{})
+		}
+		if _, ok := queue.Args[HeaderDeadLetterExchange]; !ok {
+			t.Queues[i].Args[HeaderDeadLetterExchange] = dlx
+			t.implied = map[string]string{queue.Name: HeaderDeadLetterExchange}
+		}
+	}
+}
+
+func (t *Topology) hasExchange(name string) bool {
+	for _, exchange := range t.Exchanges {
+		if exchange.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Topology) hasQueue(name string) bool {
+	for _, queue := range t.Queues {
+		if queue.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply declares the topology on broker, declarations are idempotent so it
+// is safe to apply on every boot.
+func (t *Topology) Apply(broker Broker) error {
+	for _, exchange := range t.Exchanges {
+		if err := broker.DeclareExchange(exchange); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", exchange.Name, err)
+		}
+	}
+	for _, queue := range t.Queues {
+		queue, err := t.applicable(broker, queue)
+		if err != nil {
+			return err
+		}
+		if err := broker.DeclareQueue(queue); err != nil {
+			return fmt.Errorf("declare queue %s: %w", queue.Name, err)
+		}
+	}
+	for _, binding := range t.Bindings {
+		if err := broker.BindQueue(binding.Queue, binding.Exchange, binding.RoutingKey); err != nil {
+			return fmt.Errorf("bind queue %s to %s: %w", binding.Queue, binding.Exchange, err)
+		}
+	}
+
+	logger.Infof("Applied topology: %d exchanges, %d queues, %d bindings",
+		len(t.Exchanges), len(t.Queues), len(t.Bindings))
+	return nil
+}
+
+// ReapplyOnReconnect declares the topology again and syncs bindings by sync
+// when broker reconnects, topology and bindings may be lost when the broker
+// restarts. Subscriptions are resumed after it, drivers which don't reconnect
+// by themselves are skipped.
+func (t *Topology) ReapplyOnReconnect(broker Broker, sync func() error) {
+	reconnector, ok := broker.(Reconnector)
+	if !ok {
+		return
+	}
+	reconnector.OnReconnect(func() {
+		if err := t.Apply(broker); err != nil {
+			logger.Error("Failed to apply topology after reconnect: ", err)
+			return
+		}
+		if err := sync(); err != nil {
+			logger.Error("Failed to sync bindings after reconnect: ", err)
+		}
+	})
+}
+
+// applicable drops the argument added by config from queue when the queue
+// exists without it, arguments of existing queues can't change so declaring
+// would fail. The argument has to be set by a broker policy instead.
+func (t *Topology) applicable(broker Broker, queue QueueSpec) (QueueSpec, error) {
+	arg, ok := t.implied[queue.Name]
+	inspector, isInspector := broker.(Inspector)
+	matcher, isMatcher := broker.(Matcher)
+	if !ok || !isInspector || !isMatcher {
+		return queue, nil
+	}
+
+	exists, err := inspector.QueueExists(queue.Name)
+	if err != nil || !exists {
+		return queue, err
+	}
+	matched, _, err := matcher.QueueMatches(queue)
+	if err != nil || matched {
+		return queue, err
+	}
+
+	args := make(map[string]interface{}, len(queue.Args))
+	for key, value := range queue.Args {
+		if key != arg {
+			args[key] = value
+		}
+	}
+	queue.Args = args
+	logger.Warnf("Queue %s exists without %s, it's declared without the argument, set it by policy", queue.Name, arg)
+	return queue, nil
+}
+
+// Diff compares the topology with what exists on broker without changing it.
+// Existing exchanges and queues are compared by options and arguments when
+// the driver is a Matcher, bindings are compared when it's a BindingLister.
+func (t *Topology) Diff(broker Broker) ([]TopologyChange, error) {
+	inspector, _ := broker.(Inspector)
+	matcher, _ := broker.(Matcher)
+
+	var changes []TopologyChange
+	for _, exchange := range t.Exchanges {
+		change := TopologyChange{
+			Kind:   "exchange",
+			Name:   exchange.Name,
+			Detail: fmt.Sprintf("kind=%s durable=%t args=%v", exchange.Kind, exchange.Durable, exchange.Args),
+		}
+		action, err := t.inspect(inspector, exchange.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		if action == TopologyExists && matcher != nil {
+			matched, reason, err := matcher.ExchangeMatches(exchange)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				action, change.Detail = TopologyMismatch, reason
+			}
+		}
+		change.Action = action
+		changes = append(changes, change)
+	}
+	for _, queue := range t.Queues {
+		change := TopologyChange{
+			Kind:   "queue",
+			Name:   queue.Name,
+			Detail: fmt.Sprintf("durable=%t args=%v", queue.Durable, queue.Args),
+		}
+		action, err := t.inspect(inspector, queue.Name, false)
+		if err != nil {
+			return nil, err
+		}
+		if action == TopologyExists && matcher != nil {
+			// Apply declares it as applicable, a dropped argument is logged
+			queue, err := t.applicable(broker, queue)
+			if err != nil {
+				return nil, err
+			}
+			matched, reason, err := matcher.QueueMatches(queue)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				action, change.Detail = TopologyMismatch, reason
+			}
+		}
+		change.Action = action
+		changes = append(changes, change)
+	}
+
+	existing, err := t.bindings(broker)
+	if err != nil {
+		return nil, err
+	}
+	for _, binding := range t.Bindings {
+		action := TopologyUnknown
+		if existing != nil {
+			action = TopologyCreate
+			if existing[binding] {
+				action = TopologyExists
+			}
+		}
+		changes = append(changes, TopologyChange{
+			Action: action,
+			Kind:   "binding",
+			Name:   binding.Exchange + " -> " + binding.Queue,
+			Detail: "routing_key=" + binding.RoutingKey,
+		})
+	}
+	return changes, nil
+}
+
+// bindings returns existing bindings of topology exchanges, it's nil when
+// the driver can't list them
+func (t *Topology) bindings(broker Broker) (map[BindingSpec]bool, error) {
+	lister, ok := broker.(BindingLister)
+	if !ok {
+		return nil, nil
+	}
+
+	existing := make(map[BindingSpec]bool)
+	listed := make(map[string]bool)
+	for _, binding := range t.Bindings {
+		if listed[binding.Exchange] {
+			continue
+		}
+		listed[binding.Exchange] = true
+
+		bindings, err := lister.Bindings(binding.Exchange)
+		if err == ErrManagementNotConfigured {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bindings {
+			existing[BindingSpec{Queue: b.Queue, Exchange: binding.Exchange, RoutingKey: b.RoutingKey}] = true
+		}
+	}
+	return existing, nil
+}
+
+func (t *Topology) inspect(inspector Inspector, name string, exchange bool) (string, error) {
+	if inspector == nil {
+		return TopologyUnknown, nil
+	}
+
+	var exists bool
+	var err error
+	if exchange {
+		exists, err = inspector.ExchangeExists(name)
+	} else {
+		exists, err = inspector.QueueExists(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return TopologyExists, nil
+	}
+	return TopologyCreate, nil
+}
@@ -0,0 +1,138 @@
+package queue
+
+import "testing"
+
+// mismatchBroker reports queues don't match while they have args
+type mismatchBroker struct {
+	Broker
+}
+
+func (b mismatchBroker) ExchangeMatches(spec ExchangeSpec) (bool, string, error) {
+	return true, "", nil
+}
+
+func (b mismatchBroker) QueueMatches(spec QueueSpec) (bool, string, error) {
+	if len(spec.Args) > 0 {
+		return false, "inequivalent arg", nil
+	}
+	return true, "", nil
+}
+
+func (b mismatchBroker) ExchangeExists(name string) (bool, error) {
+	return b.Broker.(Inspector).ExchangeExists(name)
+}
+
+func (b mismatchBroker) QueueExists(name string) (bool, error) {
+	return b.Broker.(Inspector).QueueExists(name)
+}
+
+func (b mismatchBroker) Bindings(exchange string) ([]Binding, error) {
+	return b.Broker.(BindingLister).Bindings(exchange)
+}
+
+func TestTopologyDiff(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "order.*")
+	defer broker.Close()
+
+	topology := Topology{
+		Exchanges: []ExchangeSpec{{Name: "test", Kind: ExchangeTypeTopic}},
+		Queues: []QueueSpec{
+			{Name: "orders", Args: map[string]interface{}{"x-queue-type": "quorum"}},
+			{Name: "users"},
+		},
+		Bindings: []BindingSpec{
+			{Queue: "orders", Exchange: "test", RoutingKey: "order.*"},
+			{Queue: "users", Exchange: "test", RoutingKey: "user.*"},
+		},
+	}
+	changes, err := topology.Diff(mismatchBroker{broker})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{TopologyExists, TopologyMismatch, TopologyCreate, TopologyExists, TopologyCreate}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	for i, change := range changes {
+		if change.Action != expected[i] {
+			t.Fatalf("expected %s, got %s", expected[i], change)
+		}
+	}
+	if changes[1].Detail != "inequivalent arg" {
+		t.Fatalf("expected mismatch reason, got %s", changes[1].Detail)
+	}
+}
+
+func TestTopologyDropsImpliedArgOfExistingQueue(t *testing.T) {
+	broker := newTestMemoryBroker(t, "orders", "order.*")
+	defer broker.Close()
+
+	topology := Topology{
+		Queues: []QueueSpec{
+			{Name: "orders", Args: map[string]interface{}{HeaderDeadLetterExchange: "dlx"}},
+			{Name: "users", Args: map[string]interface{}{HeaderDeadLetterExchange: "dlx"}},
+		},
+		implied: map[string]string{"orders": HeaderDeadLetterExchange, "users": HeaderDeadLetterExchange},
+	}
+
+	// orders exists without the argument, users is new
+	for i, hasArg := range []bool{false, true} {
+		queue, err := topology.applicable(mismatchBroker{broker}, topology.Queues[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := queue.Args[HeaderDeadLetterExchange]; ok != hasArg {
+			t.Fatalf("queue %s has argument %v, expected %v", queue.Name, ok, hasArg)
+		}
+	}
+}
+
+// reconnectingBroker runs reconnect handlers when reconnect is called
+type reconnectingBroker struct {
+	Broker
+	handlers []func()
+}
+
+func (b *reconnectingBroker) OnReconnect(handler func()) {
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *reconnectingBroker) reconnect() {
+	for _, handler := range b.handlers {
+		handler()
+	}
+}
+
+func TestTopologyReapplyOnReconnect(t *testing.T) {
+	broker := &reconnectingBroker{Broker: NewMemoryBroker()}
+	defer broker.Close()
+
+	topology := Topology{
+		Exchanges: []ExchangeSpec{{Name: "test", Kind: ExchangeTypeTopic}},
+		Queues:    []QueueSpec{{Name: "orders"}},
+		Bindings:  []BindingSpec{{Queue: "orders", Exchange: "test", RoutingKey: "order.*"}},
+	}
+	var syncs int
+	topology.ReapplyOnReconnect(broker, func() error {
+		// Bindings of routing keys are synced after the topology is declared
+		if exists, _ := broker.Broker.(Inspector).QueueExists("orders"); !exists {
+			t.Error("bindings are synced before topology is applied")
+		}
+		syncs++
+		return nil
+	})
+	if syncs != 0 {
+		t.Fatalf("expected no sync before reconnect, got %d", syncs)
+	}
+
+	// The restarted broker lost its topology
+	broker.reconnect()
+	if syncs != 1 {
+		t.Fatalf("expected 1 sync after reconnect, got %d", syncs)
+	}
+	bindings, _ := broker.Broker.(BindingLister).Bindings("test")
+	if len(bindings) != 1 || bindings[0] != (Binding{Queue: "orders", RoutingKey: "order.*"}) {
+		t.Fatalf("expected topology binding after reconnect, got %+v", bindings)
+	}
+}
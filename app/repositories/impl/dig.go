@@ -6,6 +6,7 @@ func Inject(container *dig.Container) error {
 	_ = container.Provide(NewInRepository)
 	_ = container.Provide(NewOutRepository)
 	_ = container.Provide(NewRoutingRepository)
+	_ = container.Provide(NewParkedRepository)
 
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/quangdangfit/gosdk/utils/paging"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"message-queue/app/dbs"
@@ -20,6 +21,11 @@ type inRepo struct {
 }
 
 func NewInRepository(db dbs.IDatabase) repositories.InRepository {
+	db.EnsureIndex(models.CollectionInMessage, mgo.Index{
+		Name:       "status_next_attempt_at",
+		Key:        []string{"status", "next_attempt_at"},
+		Background: true,
+	})
 	return &inRepo{db: db}
 }
 
@@ -76,6 +82,24 @@ func (i *inRepo) List(query *schema.InMsgQueryParam) (*[]models.InMessage, *pagi
 	return &message, pageInfo, nil
 }
 
+func (i *inRepo) ListDue(status string, before time.Time, limit int) (*[]models.InMessage, error) {
+	query := bson.M{
+		"status": status,
+		"$or": []bson.M{
+			{"next_attempt_at": bson.M{"$lte": before}},
+			{"next_attempt_at": bson.M{"$exists": false}},
+		},
+	}
+
+	var messages []models.InMessage
+	_, err := i.db.FindManyPaging(models.CollectionInMessage, query, "next_attempt_at", 1, limit, &messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messages, nil
+}
+
 func (i *inRepo) Create(message *models.InMessage) error {
 	message.CreatedTime = time.Now()
 	message.UpdatedTime = time.Now()
@@ -88,6 +112,7 @@ func (i *inRepo) Create(message *models.InMessage) error {
 		return err
 	}
 	json.Unmarshal(data, &value)
+	setAttemptTimes(value, message)
 
 	err = i.db.InsertOne(models.CollectionInMessage, value)
 	if err != nil {
@@ -106,8 +131,12 @@ func (i *inRepo) Update(message *models.InMessage) error {
 		return err
 	}
 	json.Unmarshal(data, &payload)
+	setAttemptTimes(payload, message)
 
 	change := bson.M{"$set": payload}
+	if message.NextAttemptAt == nil {
+		change["$unset"] = bson.M{"next_attempt_at": ""}
+	}
 	err = i.db.UpdateOne(models.CollectionInMessage, selector, change)
 	if err != nil {
 		return err
@@ -123,3 +152,28 @@ func (i *inRepo) Upsert(message *models.InMessage) error {
 	}
 	return i.Create(message)
 }
+
+// setAttemptTimes stores attempt times as dates instead of json strings, so
+// due messages can be queried by time
+func setAttemptTimes(value map[string]interface{}, message *models.InMessage) {
+	if deliveries, ok := value["deliveries"].([]interface{}); ok {
+		for index, state := range message.Deliveries {
+			delivery, ok := deliveries[index].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if state.LastAttemptAt != nil {
+				delivery["last_attempt_at"] = *state.LastAttemptAt
+			}
+			if state.NextAttemptAt != nil {
+				delivery["next_attempt_at"] = *state.NextAttemptAt
+			}
+		}
+	}
+	if message.LastAttemptAt != nil {
+		value["last_attempt_at"] = *message.LastAttemptAt
+	}
+	if message.NextAttemptAt != nil {
+		value["next_attempt_at"] = *message.NextAttemptAt
+	}
+}
@@ -0,0 +1,66 @@
+package impl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/quangdangfit/gosdk/utils/paging"
+	"gopkg.in/mgo.v2/bson"
+
+	"message-queue/app/dbs"
+	"message-queue/app/models"
+)
+
+// fakeDatabase records the paging query, other methods aren't used
+type fakeDatabase struct {
+	dbs.IDatabase
+
+	collection string
+	query      map[string]interface{}
+	sort       string
+	page       int
+	limit      int
+}
+
+func (db *fakeDatabase) FindManyPaging(collectionName string, query map[string]interface{}, sort string,
+	page int, limit int, result interface{}) (*paging.Paging, error) {
+
+	db.collection, db.query, db.sort, db.page, db.limit = collectionName, query, sort, page, limit
+	return &paging.Paging{}, nil
+}
+
+func TestInRepoListDueQuery(t *testing.T) {
+	db := &fakeDatabase{}
+	repo := &inRepo{db: db}
+	before := time.Now()
+
+	if _, err := repo.ListDue(models.InMessageStatusWaitRetry, before, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.collection != models.CollectionInMessage || db.page != 1 || db.limit != 100 {
+		t.Fatalf("expected first 100 of %s, got page %d of %d in %s", models.CollectionInMessage,
+			db.page, db.limit, db.collection)
+	}
+	// Most overdue messages first
+	if db.sort != "next_attempt_at" {
+		t.Fatalf("expected sort by next_attempt_at, got %q", db.sort)
+	}
+	if db.query["status"] != models.InMessageStatusWaitRetry {
+		t.Fatalf("expected wait_retry messages, got %v", db.query["status"])
+	}
+
+	// Messages stored before next attempts were scheduled are due too
+	or, ok := db.query["$or"].([]bson.M)
+	if !ok || len(or) != 2 {
+		t.Fatalf("expected due or unscheduled messages, got %v", db.query)
+	}
+	due, _ := or[0]["next_attempt_at"].(bson.M)
+	if at, ok := due["$lte"].(time.Time); !ok || !at.Equal(before) {
+		t.Fatalf("expected messages due before %s, got %v", before, or[0])
+	}
+	unscheduled, _ := or[1]["next_attempt_at"].(bson.M)
+	if exists, ok := unscheduled["$exists"].(bool); !ok || exists {
+		t.Fatalf("expected messages without next attempt, got %v", or[1])
+	}
+}
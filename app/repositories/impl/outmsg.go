@@ -125,3 +125,20 @@ func (o *outRepo) Update(id string, body *schema.OutMsgUpdateParam) (*models.Out
 	}
 	return &update, nil
 }
+
+// UpdateStatus sets status of message and appends logs, it doesn't read the
+// message so it's safe to call concurrently from publish confirmations.
+func (o *outRepo) UpdateStatus(id string, status string, logs ...interface{}) error {
+	change := bson.M{
+		"$set": bson.M{
+			"status":       status,
+			"updated_time": time.Now(),
+		},
+	}
+	if len(logs) > 0 {
+		change["$push"] = bson.M{"logs": bson.M{"$each": logs}}
+	}
+
+	selector := bson.M{"id": id}
+	return o.db.UpdateOne(models.CollectionOutMessage, selector, change)
+}
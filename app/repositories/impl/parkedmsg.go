@@ -0,0 +1,86 @@
+package impl
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quangdangfit/gosdk/utils/paging"
+	"gopkg.in/mgo.v2/bson"
+
+	"message-queue/app/dbs"
+	"message-queue/app/models"
+	"message-queue/app/repositories"
+	"message-queue/app/schema"
+	"message-queue/config"
+)
+
+type parkedRepo struct {
+	db dbs.IDatabase
+}
+
+func NewParkedRepository(db dbs.IDatabase) repositories.ParkedRepository {
+	return &parkedRepo{db: db}
+}
+
+func (p *parkedRepo) Retrieve(id string) (*models.ParkedMessage, error) {
+	message := models.ParkedMessage{}
+	query := bson.M{"id": id}
+	err := p.db.FindOne(models.CollectionParkedMessage, query, "-_id", &message)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func (p *parkedRepo) List(query *schema.ParkedMsgQueryParam) (*[]models.ParkedMessage, *paging.Paging, error) {
+	if query.Page <= 0 {
+		query.Page = 1
+	}
+	if query.Limit <= 0 {
+		query.Limit = config.Config.PageLimit
+	}
+
+	var messages []models.ParkedMessage
+	var mapQuery map[string]interface{}
+	data, err := json.Marshal(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	json.Unmarshal(data, &mapQuery)
+
+	pageInfo, err := p.db.FindManyPaging(models.CollectionParkedMessage, mapQuery, "-_id", query.Page, query.Limit, &messages)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &messages, pageInfo, nil
+}
+
+func (p *parkedRepo) Create(message *models.ParkedMessage) error {
+	message.ID = uuid.New().String()
+	message.CreatedTime = time.Now()
+
+	err := p.db.InsertOne(models.CollectionParkedMessage, message)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *parkedRepo) Delete(id string) error {
+	selector := bson.M{"id": id}
+	return p.db.DeleteOne(models.CollectionParkedMessage, selector)
+}
+
+func (p *parkedRepo) DeleteMany(query *schema.ParkedMsgQueryParam) error {
+	var mapQuery map[string]interface{}
+	data, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	json.Unmarshal(data, &mapQuery)
+
+	return p.db.DeleteMany(models.CollectionParkedMessage, mapQuery)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"reflect"
 
+	"github.com/google/uuid"
 	"github.com/jinzhu/copier"
 	"github.com/quangdangfit/gosdk/utils/paging"
 	"gopkg.in/mgo.v2/bson"
@@ -79,6 +80,7 @@ func (r *routing) Create(body *schema.RoutingCreateParam) (*models.RoutingKey, e
 	copier.Copy(&routing, &body)
 	routing.BeforeCreate()
 	routing.Active = true
+	setSubscriptionIDs(routing.Subscriptions, nil)
 
 	var value map[string]interface{}
 	data, err := json.Marshal(routing)
@@ -102,29 +104,97 @@ func (r *routing) Update(id string, body *schema.RoutingUpdateParam) (*models.Ro
 		return nil, errors.New("not found routing key")
 	}
 
-	var update models.RoutingKey
-	copier.Copy(&update, &routing)
-	data, err := json.Marshal(body)
+	update, err := mergeUpdate(routing, body)
 	if err != nil {
 		return nil, err
 	}
-	json.Unmarshal(data, &update)
-
-	if reflect.DeepEqual(*routing, update) {
+	if reflect.DeepEqual(*routing, *update) {
 		return routing, nil
 	}
 
 	var value map[string]interface{}
-	data, err = json.Marshal(update)
+	data, err := json.Marshal(update)
 	if err != nil {
 		return nil, err
 	}
 	json.Unmarshal(data, &value)
+	if len(update.SigningSecrets) > 0 {
+		// keep times of secrets as dates instead of json strings
+		value["signing_secrets"] = update.SigningSecrets
+	}
 
 	selector := bson.M{"id": routing.ID}
 	err = r.db.UpdateOne(models.CollectionRoutingKey, selector, value)
 	if err != nil {
 		return nil, err
 	}
+	return update, nil
+}
+
+// mergeUpdate returns routing key with fields of body which are set. Body
+// subscriptions replace the current ones, an empty list removes them.
+func mergeUpdate(routing *models.RoutingKey, body *schema.RoutingUpdateParam) (*models.RoutingKey, error) {
+	// copier shares pointers of nested settings, body is merged into a deep
+	// copy so the change is detected
+	var update models.RoutingKey
+	data, err := json.Marshal(routing)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(data, &update)
+
+	// Subscriptions would be merged into the current ones at the same index
+	if body.Subscriptions != nil {
+		update.Subscriptions = nil
+	}
+
+	data, err = json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(data, &update)
+	setSubscriptionIDs(update.Subscriptions, routing.Subscriptions)
+	update.KeepSecrets(routing)
 	return &update, nil
 }
+
+func (r *routing) UpdateSecrets(id string, secrets []models.SigningSecret) error {
+	selector := bson.M{"id": id}
+	change := bson.M{"$set": bson.M{"signing_secrets": secrets}}
+	return r.db.UpdateOne(models.CollectionRoutingKey, selector, change)
+}
+
+// setSubscriptionIDs sets id of subscriptions without one, delivery states
+// of in messages refer to subscriptions by id. They keep the id of the
+// current subscription with the same name, or else the same API url, new
+// subscriptions get a new one.
+func setSubscriptionIDs(subscriptions []models.Subscription, current []models.Subscription) {
+	used := make(map[string]bool, len(subscriptions))
+	for _, subscription := range subscriptions {
+		used[subscription.ID] = true
+	}
+
+	match := func(subscription *models.Subscription, same func(current *models.Subscription) bool) {
+		for i := range current {
+			if subscription.ID == "" && !used[current[i].ID] && same(&current[i]) {
+				subscription.ID = current[i].ID
+				used[subscription.ID] = true
+			}
+		}
+	}
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		match(subscription, func(current *models.Subscription) bool {
+			return current.Name != "" && current.Name == subscription.Name
+		})
+	}
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		match(subscription, func(current *models.Subscription) bool {
+			return current.APIUrl != "" && current.APIUrl == subscription.APIUrl
+		})
+		if subscription.ID == "" {
+			subscription.ID = uuid.New().String()
+		}
+	}
+}
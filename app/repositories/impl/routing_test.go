@@ -0,0 +1,139 @@
+package impl
+
+import (
+	"encoding/json"
+	"testing"
+
+	"message-queue/app/models"
+	"message-queue/app/schema"
+)
+
+func newTestRoutingKey() *models.RoutingKey {
+	return &models.RoutingKey{
+		Name: "order.created",
+		Subscriptions: []models.Subscription{
+			{ID: "billing-id", Name: "billing", APIUrl: "http://billing/events", Filter: "payload.paid"},
+			{ID: "search-id", Name: "search", APIUrl: "http://search/index"},
+		},
+	}
+}
+
+// newTestUpdate decodes update body like the handler binds it
+func newTestUpdate(t *testing.T, body string) *schema.RoutingUpdateParam {
+	t.Helper()
+
+	var update schema.RoutingUpdateParam
+	if err := json.Unmarshal([]byte(body), &update); err != nil {
+		t.Fatal(err)
+	}
+	return &update
+}
+
+func TestMergeUpdateKeepsSubscriptionIDs(t *testing.T) {
+	routing := newTestRoutingKey()
+	body := newTestUpdate(t, `{"subscriptions": [
+		{"name": "search", "api_url": "http://search/v2/index"},
+		{"name": "audit", "api_url": "http://audit/events"},
+		{"name": "billing v2", "api_url": "http://billing/events"}
+	]}`)
+
+	update, err := mergeUpdate(routing, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions := update.Subscriptions
+	if len(subscriptions) != 3 {
+		t.Fatalf("expected 3 subscriptions, got %+v", subscriptions)
+	}
+	if subscriptions[0].ID != "search-id" || subscriptions[0].APIUrl != "http://search/v2/index" {
+		t.Fatalf("expected search matched by name, got %+v", subscriptions[0])
+	}
+	if subscriptions[1].ID == "" || subscriptions[1].ID == "billing-id" || subscriptions[1].ID == "search-id" {
+		t.Fatalf("expected new id of audit, got %s", subscriptions[1].ID)
+	}
+	// Fields which are not sent are not merged from the subscription at the same index
+	if subscriptions[2].ID != "billing-id" || subscriptions[2].Filter != "" {
+		t.Fatalf("expected billing matched by api url without filter, got %+v", subscriptions[2])
+	}
+}
+
+func TestMergeUpdateSubscriptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{name: "not set", body: `{"api_method": "POST"}`, expected: 2},
+		{name: "null", body: `{"subscriptions": null}`, expected: 2},
+		{name: "cleared", body: `{"subscriptions": []}`, expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			update, err := mergeUpdate(newTestRoutingKey(), newTestUpdate(t, test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(update.Subscriptions) != test.expected {
+				t.Fatalf("expected %d subscriptions, got %+v", test.expected, update.Subscriptions)
+			}
+		})
+	}
+}
+
+func TestMergeUpdateFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "not set", body: `{"api_method": "POST"}`, expected: "payload.paid"},
+		{name: "changed", body: `{"filter": "payload.country == 'VN'"}`, expected: "payload.country == 'VN'"},
+		{name: "cleared", body: `{"filter": ""}`, expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			routing := newTestRoutingKey()
+			routing.Filter = "payload.paid"
+
+			update, err := mergeUpdate(routing, newTestUpdate(t, test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if update.Filter != test.expected {
+				t.Fatalf("expected filter %q, got %q", test.expected, update.Filter)
+			}
+		})
+	}
+}
+
+func TestMergeUpdatePayloadSchema(t *testing.T) {
+	const (
+		current = `{"type": "object"}`
+		changed = `{"type": "object", "required": ["id"]}`
+	)
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "not set", body: `{"api_method": "POST"}`, expected: current},
+		{name: "changed", body: `{"payload_schema": "{\"type\": \"object\", \"required\": [\"id\"]}"}`, expected: changed},
+		{name: "cleared", body: `{"payload_schema": ""}`, expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			routing := newTestRoutingKey()
+			routing.PayloadSchema = current
+
+			update, err := mergeUpdate(routing, newTestUpdate(t, test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if update.PayloadSchema != test.expected {
+				t.Fatalf("expected payload schema %q, got %q", test.expected, update.PayloadSchema)
+			}
+		})
+	}
+}
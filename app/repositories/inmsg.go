@@ -1,6 +1,8 @@
 package repositories
 
 import (
+	"time"
+
 	"github.com/quangdangfit/gosdk/utils/paging"
 
 	"message-queue/app/models"
@@ -11,6 +13,9 @@ type InRepository interface {
 	Retrieve(id string) (*models.InMessage, error)
 	Get(query *schema.InMsgQueryParam) (*models.InMessage, error)
 	List(query *schema.InMsgQueryParam) (*[]models.InMessage, *paging.Paging, error)
+	// ListDue returns messages of status which are due before time, ordered
+	// by next attempt time
+	ListDue(status string, before time.Time, limit int) (*[]models.InMessage, error)
 	Create(message *models.InMessage) error
 	Update(message *models.InMessage) error
 	Upsert(message *models.InMessage) error
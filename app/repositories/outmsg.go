@@ -13,4 +13,5 @@ type OutRepository interface {
 	List(query *schema.OutMsgQueryParam) (*[]models.OutMessage, *paging.Paging, error)
 	Create(message *models.OutMessage) error
 	Update(id string, body *schema.OutMsgUpdateParam) (*models.OutMessage, error)
+	UpdateStatus(id string, status string, logs ...interface{}) error
 }
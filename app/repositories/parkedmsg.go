@@ -0,0 +1,16 @@
+package repositories
+
+import (
+	"github.com/quangdangfit/gosdk/utils/paging"
+
+	"message-queue/app/models"
+	"message-queue/app/schema"
+)
+
+type ParkedRepository interface {
+	Retrieve(id string) (*models.ParkedMessage, error)
+	List(query *schema.ParkedMsgQueryParam) (*[]models.ParkedMessage, *paging.Paging, error)
+	Create(message *models.ParkedMessage) error
+	Delete(id string) error
+	DeleteMany(query *schema.ParkedMsgQueryParam) error
+}
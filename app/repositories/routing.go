@@ -13,4 +13,5 @@ type RoutingRepository interface {
 	List(query *schema.RoutingQueryParam) (*[]models.RoutingKey, *paging.Paging, error)
 	Create(body *schema.RoutingCreateParam) (*models.RoutingKey, error)
 	Update(id string, body *schema.RoutingUpdateParam) (*models.RoutingKey, error)
+	UpdateSecrets(id string, secrets []models.SigningSecret) error
 }
@@ -12,6 +12,8 @@ func RegisterAPI(e *gin.Engine, container *dig.Container) error {
 		outMsg *api.OutMsg,
 		inMsg *api.InMsg,
 		routing *api.Routing,
+		parkedMsg *api.ParkedMsg,
+		breaker *api.Breaker,
 	) error {
 		apiRoute := e.Group("/api/v1")
 
@@ -22,12 +24,25 @@ func RegisterAPI(e *gin.Engine, container *dig.Container) error {
 
 		// In Messages
 		apiRoute.GET("/in_messages", inMsg.List)
+		apiRoute.GET("/in_messages/:id/preview", inMsg.Preview)
 
 		// Routing Keys
 		apiRoute.GET("/routing_keys", routing.List)
 		apiRoute.POST("/routing_keys", routing.Create)
 		apiRoute.GET("/routing_keys/:id", routing.Retrieve)
 		apiRoute.PUT("/routing_keys/:id", routing.Update)
+		apiRoute.POST("/routing_keys/:id/rotate_secret", routing.RotateSecret)
+		apiRoute.POST("/filters/test", routing.TestFilter)
+
+		// Parked Messages
+		apiRoute.GET("/parked_messages", parkedMsg.List)
+		apiRoute.DELETE("/parked_messages", parkedMsg.Purge)
+		apiRoute.GET("/parked_messages/:id", parkedMsg.Retrieve)
+		apiRoute.POST("/parked_messages/:id/requeue", parkedMsg.Requeue)
+
+		// Circuit Breakers
+		apiRoute.GET("/breakers", breaker.List)
+		apiRoute.POST("/breakers/:host/reset", breaker.Reset)
 
 		return nil
 	})
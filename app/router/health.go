@@ -0,0 +1,23 @@
+package router
+
+import (
+	"expvar"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/dig"
+
+	"message-queue/app/api"
+)
+
+func RegisterHealth(e *gin.Engine, container *dig.Container) error {
+	err := container.Invoke(func(
+		health *api.Health,
+	) error {
+		e.GET("/health", health.Check)
+		e.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+		return nil
+	})
+
+	return err
+}
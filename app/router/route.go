@@ -8,7 +8,12 @@ import (
 
 func Initialize(container *dig.Container) *gin.Engine {
 	app := gin.New()
-	err := RegisterAPI(app, container)
+	err := RegisterHealth(app, container)
+	if err != nil {
+		logger.Error("Failed to register Health API: ", err)
+	}
+
+	err = RegisterAPI(app, container)
 	if err != nil {
 		logger.Error("Failed to register API: ", err)
 	}
@@ -0,0 +1,10 @@
+package schema
+
+import "time"
+
+type Health struct {
+	Status   string    `json:"status"`
+	Since    time.Time `json:"since,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	InFlight int64     `json:"in_flight"`
+}
@@ -10,3 +10,13 @@ type InMsgQueryParam struct {
 	Page         int    `json:"-" form:"page,omitempty"`
 	Limit        int    `json:"-" form:"limit,omitempty"`
 }
+
+// RequestPreview is the API request of an in message to target, which is
+// not sent. Auth headers and signature are not included.
+type RequestPreview struct {
+	Target  string            `json:"target,omitempty"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
@@ -0,0 +1,11 @@
+package schema
+
+type ParkedMsgQueryParam struct {
+	RoutingKey  string `json:"routing_key,omitempty" form:"routing_key,omitempty"`
+	Queue       string `json:"queue,omitempty" form:"queue,omitempty"`
+	Reason      string `json:"reason,omitempty" form:"reason,omitempty"`
+	OriginCode  string `json:"origin_code,omitempty" form:"origin_code,omitempty"`
+	OriginModel string `json:"origin_model,omitempty" form:"origin_model,omitempty"`
+	Page        int    `json:"-" form:"page,omitempty"`
+	Limit       int    `json:"-" form:"limit,omitempty"`
+}
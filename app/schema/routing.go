@@ -1,5 +1,21 @@
 package schema
 
+type RotateSecretParam struct {
+	// Overlap is seconds current secrets keep signing, default is a day
+	Overlap uint `json:"overlap,omitempty"`
+}
+
+type FilterTestParam struct {
+	Filter     string                 `json:"filter,omitempty" validate:"required"`
+	RoutingKey string                 `json:"routing_key,omitempty"`
+	Payload    interface{}            `json:"payload,omitempty" validate:"required"`
+	Headers    map[string]interface{} `json:"headers,omitempty"`
+}
+
+type FilterTestResult struct {
+	Matched bool `json:"matched"`
+}
+
 type RoutingQueryParam struct {
 	Group string `json:"group,omitempty" form:"group,omitempty"`
 	Name  string `json:"name,omitempty" form:"name,omitempty"`
@@ -12,8 +28,28 @@ type RoutingCreateParam struct {
 	Name      string `json:"name,omitempty" validate:"required"`
 	Group     string `json:"group,omitempty" validate:"required"`
 	Value     uint   `json:"value,omitempty" validate:"required,gt=0"`
-	APIMethod string `json:"api_method,omitempty" validate:"required,oneof=GET POST PUT DELETE PATCH"`
-	APIUrl    string `json:"api_url,omitempty" validate:"required,url"`
+	APIMethod string `json:"api_method,omitempty" validate:"required_without=Subscriptions,omitempty,oneof=GET POST PUT DELETE PATCH"`
+	APIUrl    string `json:"api_url,omitempty" validate:"required_without=Subscriptions,omitempty,url"`
+	Filter    string `json:"filter,omitempty"`
+
+	// PayloadSchema is a JSON Schema document as text
+	PayloadSchema string `json:"payload_schema,omitempty"`
+
+	RetryDelays []uint       `json:"retry_delays,omitempty" validate:"omitempty,dive,gt=0"`
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty"`
+
+	QueueMode string `json:"queue_mode,omitempty" validate:"omitempty,oneof=shared key group"`
+	Prefetch  uint   `json:"prefetch,omitempty"`
+	Workers   uint   `json:"workers,omitempty"`
+
+	RateLimit   float64 `json:"rate_limit,omitempty" validate:"omitempty,gt=0"`
+	RateBurst   uint    `json:"rate_burst,omitempty"`
+	MaxInFlight uint    `json:"max_in_flight,omitempty"`
+
+	HTTP      *HTTPConfig `json:"http,omitempty"`
+	Transform *Transform  `json:"transform,omitempty"`
+
+	Subscriptions []Subscription `json:"subscriptions,omitempty" validate:"omitempty,dive"`
 }
 
 type RoutingUpdateParam struct {
@@ -22,4 +58,88 @@ type RoutingUpdateParam struct {
 	Value     uint   `json:"value,omitempty" validate:"gt=0"`
 	APIMethod string `json:"api_method,omitempty" validate:"omitempty,oneof=GET POST PUT DELETE PATCH"`
 	APIUrl    string `json:"api_url,omitempty" validate:"omitempty,url"`
+	Active    *bool  `json:"active,omitempty"`
+
+	// Filter is kept when it's not set, an empty one removes it
+	Filter *string `json:"filter,omitempty"`
+
+	// PayloadSchema is a JSON Schema document as text, it's kept when it's
+	// not set and an empty one removes it
+	PayloadSchema *string `json:"payload_schema,omitempty"`
+
+	RetryDelays []uint       `json:"retry_delays,omitempty" validate:"omitempty,dive,gt=0"`
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty"`
+
+	QueueMode string `json:"queue_mode,omitempty" validate:"omitempty,oneof=shared key group"`
+	Prefetch  uint   `json:"prefetch,omitempty"`
+	Workers   uint   `json:"workers,omitempty"`
+
+	RateLimit   float64 `json:"rate_limit,omitempty" validate:"omitempty,gt=0"`
+	RateBurst   uint    `json:"rate_burst,omitempty"`
+	MaxInFlight uint    `json:"max_in_flight,omitempty"`
+
+	HTTP      *HTTPConfig `json:"http,omitempty"`
+	Transform *Transform  `json:"transform,omitempty"`
+
+	// Subscriptions replace the current ones, an empty list removes them.
+	// Subscriptions without id keep the one of the current subscription with
+	// the same name, or api url.
+	Subscriptions []Subscription `json:"subscriptions,omitempty" validate:"omitempty,dive"`
+}
+
+type RetryPolicy struct {
+	MaxAttempts        uint   `json:"max_attempts,omitempty"`
+	Backoff            string `json:"backoff,omitempty" validate:"omitempty,oneof=fixed exponential exponential_jitter"`
+	Delay              uint   `json:"delay,omitempty"`
+	MaxDelay           uint   `json:"max_delay,omitempty" validate:"omitempty,gtefield=Delay"`
+	RetryableStatuses  []int  `json:"retryable_statuses,omitempty" validate:"omitempty,dive,min=100,max=599"`
+	RetryNetworkErrors *bool  `json:"retry_network_errors,omitempty"`
+}
+
+type Subscription struct {
+	ID          string       `json:"id,omitempty"`
+	Name        string       `json:"name,omitempty" validate:"required"`
+	APIMethod   string       `json:"api_method,omitempty" validate:"required,oneof=GET POST PUT DELETE PATCH"`
+	APIUrl      string       `json:"api_url,omitempty" validate:"required,url"`
+	Status      string       `json:"status,omitempty" validate:"omitempty,oneof=active inactive"`
+	Filter      string       `json:"filter,omitempty"`
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty"`
+	HTTP        *HTTPConfig  `json:"http,omitempty"`
+	Transform   *Transform   `json:"transform,omitempty"`
+}
+
+type Transform struct {
+	Body    string            `json:"body,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type HTTPConfig struct {
+	Timeout uint              `json:"timeout,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Auth    *HTTPAuth         `json:"auth,omitempty"`
+	TLS     *HTTPTLS          `json:"tls,omitempty"`
+	Proxy   string            `json:"proxy,omitempty" validate:"omitempty,url"`
+}
+
+type HTTPAuth struct {
+	Type         string   `json:"type,omitempty" validate:"required,oneof=none bearer basic api_key oauth2"`
+	Token        string   `json:"token,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	Password     string   `json:"password,omitempty"`
+	Header       string   `json:"header,omitempty"`
+	APIKey       string   `json:"api_key,omitempty"`
+	TokenURL     string   `json:"token_url,omitempty" validate:"omitempty,url"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+type HTTPTLS struct {
+	CA                 string `json:"ca,omitempty"`
+	Cert               string `json:"cert,omitempty" validate:"required_with=Key"`
+	Key                string `json:"key,omitempty" validate:"required_with=Cert"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
 }
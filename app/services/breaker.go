@@ -0,0 +1,10 @@
+package services
+
+import (
+	"message-queue/app/breaker"
+)
+
+type BreakerService interface {
+	List() []breaker.State
+	Reset(host string) error
+}
@@ -0,0 +1,9 @@
+package services
+
+import (
+	"message-queue/app/schema"
+)
+
+type HealthService interface {
+	Check() *schema.Health
+}
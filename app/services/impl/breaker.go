@@ -0,0 +1,27 @@
+package impl
+
+import (
+	"errors"
+
+	"message-queue/app/breaker"
+	"message-queue/app/services"
+)
+
+type breakerService struct {
+	breakers *breaker.Breakers
+}
+
+func NewBreakerService(breakers *breaker.Breakers) services.BreakerService {
+	return &breakerService{breakers: breakers}
+}
+
+func (b *breakerService) List() []breaker.State {
+	return b.breakers.States()
+}
+
+func (b *breakerService) Reset(host string) error {
+	if !b.breakers.Reset(host) {
+		return errors.New("not found circuit breaker of host " + host)
+	}
+	return nil
+}
@@ -6,6 +6,9 @@ func Inject(container *dig.Container) error {
 	_ = container.Provide(NewInService)
 	_ = container.Provide(NewOutService)
 	_ = container.Provide(NewRoutingService)
+	_ = container.Provide(NewParkedService)
+	_ = container.Provide(NewHealthService)
+	_ = container.Provide(NewBreakerService)
 
 	return nil
 }
@@ -0,0 +1,318 @@
+package impl
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quangdangfit/gosdk/utils/paging"
+
+	"message-queue/app/models"
+	"message-queue/app/queue"
+	"message-queue/app/schema"
+)
+
+var errNotFound = errors.New("not found")
+
+// fakeInRepo keeps in messages in memory by id
+type fakeInRepo struct {
+	mu       sync.Mutex
+	messages map[string]models.InMessage
+	storeErr error
+}
+
+func newFakeInRepo() *fakeInRepo {
+	return &fakeInRepo{messages: make(map[string]models.InMessage)}
+}
+
+func (r *fakeInRepo) all() []models.InMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []models.InMessage
+	for _, message := range r.messages {
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func (r *fakeInRepo) setStoreErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.storeErr = err
+}
+
+func (r *fakeInRepo) Retrieve(id string) (*models.InMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	message, ok := r.messages[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return &message, nil
+}
+
+func (r *fakeInRepo) Get(query *schema.InMsgQueryParam) (*models.InMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, message := range r.messages {
+		if (query.RoutingKey == "" || message.RoutingKey.Name == query.RoutingKey) &&
+			(query.OriginCode == "" || message.OriginCode == query.OriginCode) &&
+			(query.OriginModel == "" || message.OriginModel == query.OriginModel) {
+			return &message, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *fakeInRepo) List(query *schema.InMsgQueryParam) (*[]models.InMessage, *paging.Paging, error) {
+	var messages []models.InMessage
+	for _, message := range r.all() {
+		if query.Status == "" || message.Status == query.Status {
+			messages = append(messages, message)
+		}
+	}
+	return &messages, &paging.Paging{}, nil
+}
+
+// ListDue sorts due messages by next attempt, messages without it first as
+// mongo sorts missing fields
+func (r *fakeInRepo) ListDue(status string, before time.Time, limit int) (*[]models.InMessage, error) {
+	var messages []models.InMessage
+	for _, message := range r.all() {
+		if message.Status == status && (message.NextAttemptAt == nil || !message.NextAttemptAt.After(before)) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[j].NextAttemptAt == nil {
+			return false
+		}
+		return messages[i].NextAttemptAt == nil || messages[i].NextAttemptAt.Before(*messages[j].NextAttemptAt)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return &messages, nil
+}
+
+func (r *fakeInRepo) Create(message *models.InMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.storeErr != nil {
+		return r.storeErr
+	}
+	message.ID = uuid.New().String()
+	r.messages[message.ID] = *message
+	return nil
+}
+
+func (r *fakeInRepo) Update(message *models.InMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.storeErr != nil {
+		return r.storeErr
+	}
+	r.messages[message.ID] = *message
+	return nil
+}
+
+func (r *fakeInRepo) Upsert(message *models.InMessage) error {
+	if _, err := r.Retrieve(message.ID); err == nil {
+		return r.Update(message)
+	}
+	return r.Create(message)
+}
+
+// fakeRoutingRepo finds active routing keys by name or by group and value
+type fakeRoutingRepo struct {
+	mu   sync.Mutex
+	keys []models.RoutingKey
+	get  func(query *schema.RoutingQueryParam) // called on every Get
+}
+
+func newFakeRoutingRepo(keys ...models.RoutingKey) *fakeRoutingRepo {
+	return &fakeRoutingRepo{keys: keys}
+}
+
+func (r *fakeRoutingRepo) Retrieve(id string) (*models.RoutingKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range r.keys {
+		if key.ID == id {
+			return &key, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *fakeRoutingRepo) Get(query *schema.RoutingQueryParam) (*models.RoutingKey, error) {
+	if r.get != nil {
+		r.get(query)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range r.keys {
+		if key.Active && (query.Name == "" || key.Name == query.Name) &&
+			(query.Group == "" || key.Group == query.Group) &&
+			(query.Value == 0 || key.Value == query.Value) {
+			return &key, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *fakeRoutingRepo) List(query *schema.RoutingQueryParam) (*[]models.RoutingKey, *paging.Paging, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := append([]models.RoutingKey(nil), r.keys...)
+	return &keys, &paging.Paging{TotalPage: 1}, nil
+}
+
+func (r *fakeRoutingRepo) Create(body *schema.RoutingCreateParam) (*models.RoutingKey, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeRoutingRepo) Update(id string, body *schema.RoutingUpdateParam) (*models.RoutingKey, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeRoutingRepo) UpdateSecrets(id string, secrets []models.SigningSecret) error {
+	return errors.New("not implemented")
+}
+
+// fakeOutRepo records status updates of out messages
+type fakeOutRepo struct {
+	mu       sync.Mutex
+	statuses map[string]string
+}
+
+func newFakeOutRepo() *fakeOutRepo {
+	return &fakeOutRepo{statuses: make(map[string]string)}
+}
+
+func (r *fakeOutRepo) Retrieve(id string) (*models.OutMessage, error) {
+	return nil, errNotFound
+}
+
+func (r *fakeOutRepo) Get(query *schema.OutMsgQueryParam) (*models.OutMessage, error) {
+	return nil, errNotFound
+}
+
+func (r *fakeOutRepo) List(query *schema.OutMsgQueryParam) (*[]models.OutMessage, *paging.Paging, error) {
+	return &[]models.OutMessage{}, &paging.Paging{}, nil
+}
+
+func (r *fakeOutRepo) Create(message *models.OutMessage) error {
+	message.ID = uuid.New().String()
+	return nil
+}
+
+func (r *fakeOutRepo) Update(id string, body *schema.OutMsgUpdateParam) (*models.OutMessage, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeOutRepo) UpdateStatus(id string, status string, logs ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[id] = status
+	return nil
+}
+
+func (r *fakeOutRepo) status(id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.statuses[id]
+}
+
+// fakeConsumer feeds deliveries of a single queue to the service, delays of
+// retried deliveries are sent to delays when retries is set
+type fakeConsumer struct {
+	queue      queue.ConsumerQueue
+	queues     chan queue.ConsumerQueue
+	deliveries chan *queue.InDelivery
+	retries    bool
+	delays     chan time.Duration
+}
+
+func newFakeConsumer(workers int) *fakeConsumer {
+	c := fakeConsumer{
+		queue:      queue.ConsumerQueue{Name: "test", Prefetch: workers, Workers: workers},
+		queues:     make(chan queue.ConsumerQueue, 1),
+		deliveries: make(chan *queue.InDelivery),
+		delays:     make(chan time.Duration, 10),
+	}
+	c.queues <- c.queue
+	close(c.queues)
+	return &c
+}
+
+func (c *fakeConsumer) Queues() <-chan queue.ConsumerQueue { return c.queues }
+
+func (c *fakeConsumer) Queue(routingKey *models.RoutingKey) queue.ConsumerQueue { return c.queue }
+
+func (c *fakeConsumer) Consume(queue queue.ConsumerQueue) <-chan *queue.InDelivery {
+	return c.deliveries
+}
+
+// Stop closes deliveries, it must be called after the last delivery is sent
+func (c *fakeConsumer) Stop() { close(c.deliveries) }
+
+func (c *fakeConsumer) Bind(routingKey *models.RoutingKey) error { return nil }
+
+func (c *fakeConsumer) Unbind(routingKey *models.RoutingKey) error { return nil }
+
+func (c *fakeConsumer) Prune(routingKeys []models.RoutingKey) error { return nil }
+
+func (c *fakeConsumer) Retries() bool { return c.retries }
+
+func (c *fakeConsumer) Retry(delivery *queue.InDelivery, delay time.Duration) error {
+	if !c.retries {
+		return errors.New("retry by broker is not enabled")
+	}
+	c.delays <- delay
+	return nil
+}
+
+const (
+	settledAck     = "ack"
+	settledRequeue = "requeue"
+	settledReject  = "reject"
+)
+
+// fakeAcknowledger reports how its delivery is settled
+type fakeAcknowledger struct {
+	settled chan string
+}
+
+func newFakeDelivery(message models.InMessage) (*queue.InDelivery, <-chan string) {
+	acknowledger := fakeAcknowledger{settled: make(chan string, 1)}
+	return &queue.InDelivery{
+		Message:  &message,
+		Delivery: queue.Delivery{Acknowledger: &acknowledger},
+	}, acknowledger.settled
+}
+
+func (a *fakeAcknowledger) Ack() error {
+	a.settled <- settledAck
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(requeue bool) error {
+	if requeue {
+		a.settled <- settledRequeue
+	} else {
+		a.settled <- settledReject
+	}
+	return nil
+}
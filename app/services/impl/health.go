@@ -0,0 +1,33 @@
+package impl
+
+import (
+	"message-queue/app/queue"
+	"message-queue/app/schema"
+	"message-queue/app/services"
+)
+
+type healthService struct {
+	broker    queue.Broker
+	inService services.InService
+}
+
+func NewHealthService(broker queue.Broker, inService services.InService) services.HealthService {
+	return &healthService{
+		broker:    broker,
+		inService: inService,
+	}
+}
+
+func (h *healthService) Check() *schema.Health {
+	health := queue.Health{State: queue.BrokerUnknown}
+	if checker, ok := h.broker.(queue.HealthChecker); ok {
+		health = checker.Health()
+	}
+
+	return &schema.Health{
+		Status:   health.State,
+		Since:    health.Since,
+		Error:    health.Error,
+		InFlight: h.inService.InFlight(),
+	}
+}
@@ -1,62 +1,208 @@
 package impl
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quangdangfit/gosdk/utils/logger"
 	"github.com/quangdangfit/gosdk/utils/paging"
 	"github.com/spf13/viper"
 
+	"message-queue/app/breaker"
+	"message-queue/app/httpclient"
+	"message-queue/app/limiter"
 	"message-queue/app/models"
 	"message-queue/app/queue"
 	"message-queue/app/repositories"
 	"message-queue/app/schema"
 	"message-queue/app/services"
+	"message-queue/config"
+	"message-queue/pkg/filter"
+	"message-queue/pkg/jsonschema"
+	"message-queue/pkg/signature"
 	"message-queue/pkg/utils"
 )
 
 const (
-	RequestTimeout         = 60
-	DefaultMaxRetryTimes   = 3
-	DefaultConsumerThreads = 10
-	RetryInMessageLimit    = 100
+	DefaultMaxRetryTimes = 3
+	RetryInMessageLimit  = 100
+	DefaultRetryDelay    = 30 * time.Second
+	RetryJitterSteps     = 4
+	MaxBackoffDoublings  = 32
+	RetryDueTolerance    = time.Second
+	StoreRetryMinDelay   = 100 * time.Millisecond
+	StoreRetryMaxDelay   = 10 * time.Second
 )
 
 type inService struct {
+	inFlight int64 // first field to keep 64-bit alignment for atomic
+
 	msgRepo     repositories.InRepository
 	routingRepo repositories.RoutingRepository
 
-	consumer        queue.Consumer
-	consumerThreads int
+	consumer      queue.Consumer
+	ctx           context.Context // of API calls, canceled by Abort
+	abort         context.CancelFunc
+	breakers      *breaker.Breakers
+	limiters      *limiter.Limiters
+	clients       *httpclient.Clients
+	next          uint32
+	storeFailures uint32 // consecutive failures, requeue is delayed by them
 }
 
 func NewInService(inRepo repositories.InRepository, routingRepo repositories.RoutingRepository,
-	consumer queue.Consumer) services.InService {
+	consumer queue.Consumer, breakers *breaker.Breakers, limiters *limiter.Limiters,
+	clients *httpclient.Clients) services.InService {
+
+	rand.Seed(time.Now().UnixNano())
 
+	ctx, abort := context.WithCancel(context.Background())
 	r := inService{
-		msgRepo:         inRepo,
-		routingRepo:     routingRepo,
-		consumer:        consumer,
-		consumerThreads: DefaultConsumerThreads,
+		msgRepo:     inRepo,
+		routingRepo: routingRepo,
+		consumer:    consumer,
+		ctx:         ctx,
+		abort:       abort,
+		breakers:    breakers,
+		limiters:    limiters,
+		clients:     clients,
 	}
 	return &r
 }
 
+// Consume runs a pool of workers for the shared queue and for each dedicated
+// queue, until the consumer is stopped and all deliveries are handled.
 func (i *inService) Consume() {
-	msgChan := i.consumer.Consume()
-	logger.Infof("Run %d threads to consume messages", i.consumerThreads)
-	for index := 0; index <= i.consumerThreads; index++ {
-		for msg := range msgChan {
-			i.handle(msg, msg.RoutingKey.Name)
-			i.msgRepo.Create(msg)
+	var wg sync.WaitGroup
+	for consumerQueue := range i.consumer.Queues() {
+		wg.Add(1)
+		go func(consumerQueue queue.ConsumerQueue) {
+			defer wg.Done()
+			i.consumeQueue(consumerQueue)
+		}(consumerQueue)
+	}
+	wg.Wait()
+}
+
+// consumeQueue handles deliveries of queue by its workers. Messages of the
+// same origin always go to the same worker, so they are handled in order.
+func (i *inService) consumeQueue(consumerQueue queue.ConsumerQueue) {
+	msgChan := i.consumer.Consume(consumerQueue)
+	logger.Infof("Run %d threads to consume queue %s", consumerQueue.Workers, consumerQueue.Name)
+
+	var wg sync.WaitGroup
+	workers := make([]chan *queue.InDelivery, consumerQueue.Workers)
+	for index := range workers {
+		workers[index] = make(chan *queue.InDelivery)
+
+		wg.Add(1)
+		go func(deliveries <-chan *queue.InDelivery) {
+			defer wg.Done()
+			for delivery := range deliveries {
+				i.process(delivery)
+			}
+		}(workers[index])
+	}
+
+	for delivery := range msgChan {
+		atomic.AddInt64(&i.inFlight, 1)
+		workers[i.worker(delivery.Message, len(workers))] <- delivery
+	}
+
+	for _, worker := range workers {
+		close(worker)
+	}
+	wg.Wait()
+}
+
+func (i *inService) InFlight() int64 {
+	return atomic.LoadInt64(&i.inFlight)
+}
+
+// Abort cancels API calls in flight and the ones after, their deliveries
+// are requeued
+func (i *inService) Abort() {
+	i.abort()
+}
+
+// worker returns index of the worker handling message, messages without
+// origin are spread over workers
+func (i *inService) worker(message *models.InMessage, workers int) int {
+	if message.OriginModel == "" && message.OriginCode == "" {
+		return int(atomic.AddUint32(&i.next, 1) % uint32(workers))
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(message.OriginModel + ":" + message.OriginCode))
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// process acks delivery after the message is stored, it is requeued after a
+// delay when storing fails. Messages which failed for good or panic the
+// handler are rejected, so they are parked when dead lettering is enabled.
+func (i *inService) process(delivery *queue.InDelivery) {
+	defer atomic.AddInt64(&i.inFlight, -1)
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Failed to handle in message %s, panic: %v", delivery.Message.RoutingKey.Name, r)
+			delivery.Nack(false)
+		}
+	}()
+
+	msg := delivery.Message
+	i.loadDeliveries(msg)
+	handleErr := i.handle(msg, msg.RoutingKey.Name)
+	i.scheduleRetry(msg, handleErr)
+	err := i.storeMessage(msg)
+	if err != nil {
+		logger.Errorf("Failed to store in message %s, %s, %s, error: %s",
+			msg.RoutingKey.Name, msg.OriginModel, msg.OriginCode, err)
+		time.Sleep(i.getStoreRetryDelay())
+		delivery.Nack(true)
+		return
+	}
+	atomic.StoreUint32(&i.storeFailures, 0)
+
+	// Rate limited messages are delayed until the limit allows them, other
+	// skipped messages, e.g. aborted calls, are left wait_retry for the retry
+	// cronjob
+	if msg.Status == models.InMessageStatusWaitRetry && i.consumer.Retries() {
+		if errors.Is(handleErr, limiter.ErrLimited) {
+			i.delay(delivery, getLimitedDelay(msg))
+		} else if !isSkipped(handleErr) {
+			i.retry(delivery)
 		}
 	}
+	if msg.Status == models.InMessageStatusFailed || msg.Status == models.InMessageStatusInvalid {
+		delivery.Nack(false)
+		return
+	}
+	delivery.Ack()
+}
+
+// loadDeliveries restores subscription states of a redelivered message, the
+// broker republishes the original body so succeeded subscriptions would be
+// called again otherwise
+func (i *inService) loadDeliveries(message *models.InMessage) {
+	if message.ID == "" {
+		return
+	}
+
+	stored, err := i.msgRepo.Retrieve(message.ID)
+	if err != nil || stored == nil {
+		return
+	}
+	message.Deliveries = stored.Deliveries
 }
 
 func (i *inService) List(ctx context.Context, query *schema.InMsgQueryParam) (*[]models.InMessage, *paging.Paging, error) {
@@ -68,30 +214,81 @@ func (i *inService) List(ctx context.Context, query *schema.InMsgQueryParam) (*[
 	return rs, pageInfo, nil
 }
 
-func (i *inService) CronRetry() error {
-	query := schema.InMsgQueryParam{
-		Status: models.InMessageStatusWaitRetry,
-		Page:   1,
-		Limit:  RetryInMessageLimit,
+func (i *inService) Preview(ctx context.Context, id string) ([]schema.RequestPreview, error) {
+	message, err := i.msgRepo.Retrieve(id)
+	if err != nil {
+		logger.Errorf("Cannot get in message %s, error: %s", id, err)
+		return nil, err
 	}
 
-	messages, _, _ := i.msgRepo.List(&query)
+	query := schema.RoutingQueryParam{
+		Name: message.RoutingKey.Name,
+	}
+	routingKey, err := i.routingRepo.Get(&query)
+	if err != nil {
+		logger.Errorf("Cannot find routing key %s, error: %s", message.RoutingKey.Name, err)
+		return nil, err
+	}
+	message.RoutingKey = *routingKey
+
+	targets := []models.Subscription{routingKey.Target()}
+	if len(routingKey.Subscriptions) > 0 {
+		targets = targets[:0]
+		for _, subscription := range routingKey.Subscriptions {
+			if subscription.Active() {
+				targets = append(targets, subscription)
+			}
+		}
+	}
+
+	previews := make([]schema.RequestPreview, 0, len(targets))
+	for _, target := range targets {
+		target := target
+		req, body, err := i.clients.NewRequest(target.APIMethod, target.APIUrl, i.getTransform(message, &target), message)
+		if err != nil {
+			return nil, err
+		}
+		err = i.clients.SetHeaders(req, i.getHTTPConfig(message, &target), message)
+		if err != nil {
+			return nil, err
+		}
+
+		headers := make(map[string]string, len(req.Header))
+		for key, values := range req.Header {
+			headers[key] = strings.Join(values, ", ")
+		}
+		previews = append(previews, schema.RequestPreview{
+			Target:  target.Name,
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: headers,
+			Body:    string(body),
+		})
+	}
+	return previews, nil
+}
+
+// CronRetry retries wait_retry messages which are due, most overdue first,
+// and schedules the next attempt of messages failing again
+func (i *inService) CronRetry() error {
+	messages, _ := i.msgRepo.ListDue(models.InMessageStatusWaitRetry, time.Now(), RetryInMessageLimit)
 	if messages == nil {
-		logger.Info("[Retry Message] Not found any wait_retry message!")
+		logger.Info("[Retry Message] Not found any due wait_retry message!")
 		return nil
 	}
 
-	logger.Infof("[Retry Message] Found %d wait_retry messages!", len(*messages))
+	logger.Infof("[Retry Message] Found %d due wait_retry messages!", len(*messages))
 	for _, msg := range *messages {
 		err := i.handle(&msg, msg.RoutingKey.Name)
-		if err == nil {
-			continue
+		// Attempts of fan-out messages are counted by subscriptions
+		if err != nil && !isSkipped(err) && len(msg.Deliveries) == 0 {
+			msg.Attempts += 1
+			if msg.Attempts >= i.getMaxRetryTimes(msg.RoutingKey.RetryPolicy) {
+				msg.Status = models.InMessageStatusFailed
+			}
 		}
+		i.scheduleRetry(&msg, err)
 
-		msg.Attempts += 1
-		if msg.Attempts >= i.getMaxRetryTimes() {
-			msg.Status = models.InMessageStatusFailed
-		}
 		err = i.msgRepo.Update(&msg)
 		if err != nil {
 			logger.Errorf("Sent, failed to update status: %s, %s, %s, error: %s",
@@ -124,21 +321,26 @@ func (i *inService) CronRetryPrevious() error {
 		prevMsg, err := i.msgRepo.Get(&query)
 		if (prevMsg == nil && msg.RoutingKey.Value != 1) ||
 			(prevMsg != nil && prevMsg.Status != models.InMessageStatusSuccess &&
-				prevMsg.Status != models.InMessageStatusCanceled) {
+				prevMsg.Status != models.InMessageStatusCanceled &&
+				prevMsg.Status != models.InMessageStatusFiltered) {
 
 			logger.Infof("[Retry Prev Message] Ignore message %s!", msg.ID)
 			continue
 		}
 
 		err = i.handle(&msg, msg.RoutingKey.Name)
-		if err == nil {
+		if err == nil || isSkipped(err) {
 			continue
 		}
 
-		msg.Attempts += 1
-		if msg.Attempts >= i.getMaxRetryTimes() {
-			msg.Status = models.InMessageStatusFailed
+		if len(msg.Deliveries) == 0 {
+			msg.Attempts += 1
+			if msg.Attempts >= i.getMaxRetryTimes(msg.RoutingKey.RetryPolicy) {
+				msg.Status = models.InMessageStatusFailed
+			}
 		}
+		i.scheduleRetry(&msg, err)
+
 		err = i.msgRepo.Update(&msg)
 		if err != nil {
 			logger.Errorf("Sent, failed to update status: %s, %s, %s, "+
@@ -163,68 +365,520 @@ func (i *inService) handle(message *models.InMessage, routingKey string) error {
 	}
 	message.RoutingKey = *inRoutingKey
 
+	err = jsonschema.ValidatePayload(message.RoutingKey.PayloadSchema, message.Payload)
+	if err != nil {
+		message.Status = models.InMessageStatusInvalid
+		message.Logs = append(message.Logs, utils.ParseLogs(err))
+		logger.Errorf("Payload of routing key %s is invalid, error: %s", routingKey, err)
+		return err
+	}
+
+	matched, err := i.matches(message, message.RoutingKey.Filter)
+	if err != nil {
+		message.Status = models.InMessageStatusInvalid
+		message.Logs = append(message.Logs, utils.ParseLogs(err))
+		logger.Errorf("Failed to filter message of routing key %s, error: %s", routingKey, err)
+		return err
+	}
+	if !matched {
+		message.Status = models.InMessageStatusFiltered
+		return nil
+	}
+
+	// Even ordered brokers only keep the publishing order, the previous step
+	// must be done before the message is delivered
 	prevMsg, _ := i.getPrevMessage(message)
 	if (prevMsg == nil && message.RoutingKey.Value != 1) ||
-		(prevMsg != nil && prevMsg.Status != models.InMessageStatusSuccess && prevMsg.Status != models.InMessageStatusCanceled) {
+		(prevMsg != nil && prevMsg.Status != models.InMessageStatusSuccess &&
+			prevMsg.Status != models.InMessageStatusCanceled && prevMsg.Status != models.InMessageStatusFiltered) {
 		message.Status = models.InMessageStatusWaitPrevMsg
 		logger.Warn("Set message to WAIT_PREV_MESSAGE")
 		return nil
 	}
 
-	res, err := i.callAPI(message)
+	if len(message.RoutingKey.Subscriptions) > 0 {
+		return i.fanOut(message)
+	}
+
+	target := message.RoutingKey.Target()
+	status, log, err := i.deliver(message, &target)
+	message.Status = status
+	message.Logs = append(message.Logs, log)
+	return err
+}
+
+// fanOut delivers message to subscriptions of routing key which are due and
+// not done yet, so failing subscriptions don't cause redelivery to others.
+// It returns the first error of subscriptions.
+func (i *inService) fanOut(message *models.InMessage) error {
+	states := make(map[string]models.SubscriptionDelivery, len(message.Deliveries))
+	for _, state := range message.Deliveries {
+		states[state.SubscriptionID] = state
+	}
+
+	var deliveries []models.SubscriptionDelivery
+	var firstErr error
+	for _, subscription := range message.RoutingKey.Subscriptions {
+		subscription := subscription
+		if !subscription.Active() {
+			continue
+		}
+		if subscription.RetryPolicy == nil {
+			subscription.RetryPolicy = message.RoutingKey.RetryPolicy
+		}
+
+		state, ok := states[subscription.ID]
+		if !ok {
+			state = models.SubscriptionDelivery{SubscriptionID: subscription.ID}
+		}
+		if !i.isDue(&state) {
+			deliveries = append(deliveries, state)
+			continue
+		}
+
+		matched, err := i.matches(message, subscription.Filter)
+		if err != nil || !matched {
+			state.Status = models.InMessageStatusFiltered
+			state.NextAttemptAt = nil
+			if err != nil {
+				state.Status = models.InMessageStatusFailed
+				state.Logs = append(state.Logs, utils.ParseLogs(err))
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			deliveries = append(deliveries, state)
+			continue
+		}
+
+		status, log, err := i.deliver(message, &subscription)
+		state.Status = status
+		state.Logs = append(state.Logs, log)
+		state.NextAttemptAt = nil
+		if !isSkipped(err) {
+			state.LastAttemptAt = message.LastAttemptAt
+		}
+		if err != nil && !isSkipped(err) && status == models.InMessageStatusWaitRetry {
+			state.Attempts += 1
+			if state.Attempts >= i.getMaxRetryTimes(subscription.RetryPolicy) {
+				state.Status = models.InMessageStatusFailed
+			}
+		}
+		var limited *limiter.LimitedError
+		if errors.As(err, &limited) {
+			nextAttemptAt := time.Now().Add(limited.RetryAfter)
+			state.NextAttemptAt = &nextAttemptAt
+		} else if state.Status == models.InMessageStatusWaitRetry {
+			nextAttemptAt := time.Now().Add(i.getRetryDelay(&message.RoutingKey, subscription.RetryPolicy, state.Attempts))
+			state.NextAttemptAt = &nextAttemptAt
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		deliveries = append(deliveries, state)
+	}
+
+	message.Deliveries = deliveries
+	message.Status = getFanOutStatus(deliveries)
+	return firstErr
+}
+
+// getFanOutStatus returns wait_retry while any subscription is, then failed
+// when any subscription failed, then filtered when every subscription
+// filtered the message out
+func getFanOutStatus(deliveries []models.SubscriptionDelivery) string {
+	var filtered int
+	status := models.InMessageStatusSuccess
+	for _, state := range deliveries {
+		switch state.Status {
+		case models.InMessageStatusWaitRetry:
+			return models.InMessageStatusWaitRetry
+		case models.InMessageStatusFailed:
+			status = models.InMessageStatusFailed
+		case models.InMessageStatusFiltered:
+			filtered++
+		}
+	}
+
+	if filtered > 0 && filtered == len(deliveries) {
+		return models.InMessageStatusFiltered
+	}
+	return status
+}
+
+// matches reports message matches filter expression of routing key or
+// subscription
+func (i *inService) matches(message *models.InMessage, expression string) (bool, error) {
+	if expression == "" {
+		return true, nil
+	}
+
+	document, err := filter.Document(message.RoutingKey.Name, message.Payload, message.Headers)
 	if err != nil {
-		message.Status = models.InMessageStatusWaitRetry
-		message.Logs = append(message.Logs, utils.ParseLogs(err))
-		return err
+		return false, err
+	}
+	return filter.Match(expression, document)
+}
+
+// isDue reports subscription of delivery state should be called now
+func (i *inService) isDue(state *models.SubscriptionDelivery) bool {
+	if state.Status == models.InMessageStatusSuccess || state.Status == models.InMessageStatusFailed ||
+		state.Status == models.InMessageStatusFiltered {
+		return false
+	}
+	return state.NextAttemptAt == nil || !time.Now().Add(RetryDueTolerance).Before(*state.NextAttemptAt)
+}
+
+// deliver calls API of target after rate limit of routing key, it returns
+// status of the call by retry policy of target and its log
+func (i *inService) deliver(message *models.InMessage, target *models.Subscription) (string, interface{}, error) {
+	key := message.RoutingKey.Name
+	if target.ID != "" {
+		key += "/" + target.ID
+	}
+	release, err := i.limiters.Acquire(key, message.RoutingKey.RateLimit, int(message.RoutingKey.RateBurst),
+		int(message.RoutingKey.MaxInFlight), httpclient.Timeout(i.getHTTPConfig(message, target)))
+	if err != nil {
+		return models.InMessageStatusWaitRetry, utils.ParseLogs(err), err
 	}
+	defer release()
+
+	res, err := i.callAPI(message, target)
+	if isSkipped(err) {
+		return models.InMessageStatusWaitRetry, utils.ParseLogs(err), err
+	}
+	if err != nil {
+		return i.getFailedStatus(target.RetryPolicy, 0), utils.ParseLogs(err), err
+	}
+	// The body is drained so the connection is reused
+	defer res.Body.Close()
+	defer io.Copy(ioutil.Discard, res.Body)
 
 	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusUnauthorized {
-		message.Status = models.InMessageStatusWaitRetry
 		err = errors.New(fmt.Sprintf("failed to call API %s", res.Status))
-		message.Logs = append(message.Logs, utils.ParseLogs(res))
-		return err
+		return i.getFailedStatus(target.RetryPolicy, res.StatusCode), utils.ParseLogs(res), err
 	}
 
 	if res.StatusCode != http.StatusOK {
-		message.Status = models.InMessageStatusWaitRetry
 		err = errors.New("failed to call API")
-		message.Logs = append(message.Logs, utils.ParseLogs(res))
-		return err
+		return i.getFailedStatus(target.RetryPolicy, res.StatusCode), utils.ParseLogs(res), err
+	}
+
+	return models.InMessageStatusSuccess, utils.ParseLogs(res), nil
+}
+
+// retry republishes the failed delivery to the delay queue of its next
+// attempt, the message is failed when all attempts are used, and it stays
+// wait_retry for the retry cronjob when it can't be republished.
+func (i *inService) retry(delivery *queue.InDelivery) {
+	msg := delivery.Message
+	delay, ok := i.getNextRetryDelay(msg)
+	if !ok {
+		msg.Status = models.InMessageStatusFailed
+		msg.NextAttemptAt = nil
+	} else {
+		msg.Attempts += 1
+		delay = queue.RetryDelay(delay)
+		err := i.consumer.Retry(delivery, delay)
+		if err != nil {
+			logger.Errorf("Failed to retry in message %s, error: %s", msg.ID, err)
+			return
+		}
+		msg.Status = models.InMessageStatusRetrying
+		nextAttemptAt := time.Now().Add(delay)
+		msg.NextAttemptAt = &nextAttemptAt
+	}
+
+	err := i.msgRepo.Update(msg)
+	if err != nil {
+		logger.Errorf("Retried, failed to update status: %s, %s, %s, error: %s",
+			msg.RoutingKey.Name, msg.OriginModel, msg.OriginCode, err)
 	}
+}
 
-	message.Status = models.InMessageStatusSuccess
-	message.Logs = append(message.Logs, utils.ParseLogs(res))
+// delay republishes the rate limited delivery to the delay queue of delay,
+// it doesn't use a retry attempt
+func (i *inService) delay(delivery *queue.InDelivery, delay time.Duration) {
+	msg := delivery.Message
+	delay = queue.RetryDelay(delay)
+	err := i.consumer.Retry(delivery, delay)
+	if err != nil {
+		logger.Errorf("Failed to delay in message %s, error: %s", msg.ID, err)
+		return
+	}
+	msg.Status = models.InMessageStatusRetrying
+	nextAttemptAt := time.Now().Add(delay)
+	msg.NextAttemptAt = &nextAttemptAt
 
-	return nil
+	err = i.msgRepo.Update(msg)
+	if err != nil {
+		logger.Errorf("Delayed, failed to update status: %s, %s, %s, error: %s",
+			msg.RoutingKey.Name, msg.OriginModel, msg.OriginCode, err)
+	}
+}
+
+// getLimitedDelay returns delay of rate limited message until it's due
+func getLimitedDelay(message *models.InMessage) time.Duration {
+	delay := time.Second
+	if message.NextAttemptAt != nil {
+		if until := time.Until(*message.NextAttemptAt); until > delay {
+			delay = until
+		}
+	}
+	return delay
+}
+
+// getStoreRetryDelay doubles the delay by consecutive store failures, so
+// deliveries aren't redelivered in a hot loop while the database is down
+func (i *inService) getStoreRetryDelay() time.Duration {
+	failures := atomic.AddUint32(&i.storeFailures, 1)
+	delay := StoreRetryMinDelay
+	for n := uint32(1); n < failures && delay < StoreRetryMaxDelay; n++ {
+		delay *= 2
+	}
+	if delay > StoreRetryMaxDelay {
+		delay = StoreRetryMaxDelay
+	}
+	return delay
+}
+
+// isSkipped reports API is not called because its circuit breaker is open,
+// its rate limit is exceeded or the call is aborted, skipped calls don't use
+// retry attempts
+func isSkipped(err error) bool {
+	return errors.Is(err, breaker.ErrOpen) || errors.Is(err, limiter.ErrLimited) ||
+		errors.Is(err, context.Canceled)
+}
+
+// scheduleRetry sets when the retry cronjob picks wait_retry message again by
+// delay of its next attempt, or when the rate limit of the failed call by err
+// allows it. It's cleared for other statuses.
+func (i *inService) scheduleRetry(message *models.InMessage, err error) {
+	if message.Status != models.InMessageStatusWaitRetry {
+		message.NextAttemptAt = nil
+		return
+	}
+
+	// Fan-out messages are due when their first subscription is
+	if len(message.Deliveries) > 0 {
+		message.NextAttemptAt = nil
+		for _, state := range message.Deliveries {
+			if state.NextAttemptAt != nil && (message.NextAttemptAt == nil || state.NextAttemptAt.Before(*message.NextAttemptAt)) {
+				message.NextAttemptAt = state.NextAttemptAt
+			}
+		}
+		return
+	}
+
+	var limited *limiter.LimitedError
+	if errors.As(err, &limited) {
+		nextAttemptAt := time.Now().Add(limited.RetryAfter)
+		message.NextAttemptAt = &nextAttemptAt
+		return
+	}
+	// Aborted calls didn't use an attempt, they are due right away
+	if errors.Is(err, context.Canceled) {
+		nextAttemptAt := time.Now()
+		message.NextAttemptAt = &nextAttemptAt
+		return
+	}
+
+	nextAttemptAt := time.Now()
+	if message.LastAttemptAt != nil {
+		nextAttemptAt = *message.LastAttemptAt
+	}
+	nextAttemptAt = nextAttemptAt.Add(i.getRetryDelay(&message.RoutingKey, message.RoutingKey.RetryPolicy, message.Attempts+1))
+	message.NextAttemptAt = &nextAttemptAt
+}
+
+// getNextRetryDelay returns delay before the message is retried by broker,
+// false when attempts are used up. Attempts of fan-out messages are counted
+// by subscriptions, the delay is of the subscription which is due first.
+func (i *inService) getNextRetryDelay(message *models.InMessage) (time.Duration, bool) {
+	routingKey := &message.RoutingKey
+	if len(message.Deliveries) == 0 {
+		if message.Attempts >= i.getMaxRetryTimes(routingKey.RetryPolicy) {
+			return 0, false
+		}
+		return i.getRetryDelay(routingKey, routingKey.RetryPolicy, message.Attempts+1), true
+	}
+
+	var next *models.SubscriptionDelivery
+	for index, state := range message.Deliveries {
+		if state.NextAttemptAt != nil && (next == nil || state.NextAttemptAt.Before(*next.NextAttemptAt)) {
+			next = &message.Deliveries[index]
+		}
+	}
+	if next == nil {
+		return 0, false
+	}
+	for _, subscription := range routingKey.Subscriptions {
+		if subscription.ID == next.SubscriptionID {
+			return i.getRetryDelay(routingKey, subscription.RetryPolicy, next.Attempts), true
+		}
+	}
+	return i.getRetryDelay(routingKey, nil, next.Attempts), true
+}
+
+// getFailedStatus returns wait_retry when the failed call is retryable by
+// retry policy, status code 0 is a network error
+func (i *inService) getFailedStatus(policy *models.RetryPolicy, statusCode int) string {
+	if policy == nil {
+		return models.InMessageStatusWaitRetry
+	}
+
+	if statusCode == 0 {
+		if policy.RetryNetworkErrors != nil && !*policy.RetryNetworkErrors {
+			return models.InMessageStatusFailed
+		}
+		return models.InMessageStatusWaitRetry
+	}
+
+	if len(policy.RetryableStatuses) == 0 {
+		return models.InMessageStatusWaitRetry
+	}
+	for _, retryable := range policy.RetryableStatuses {
+		if retryable == statusCode {
+			return models.InMessageStatusWaitRetry
+		}
+	}
+	return models.InMessageStatusFailed
+}
+
+// getRetryDelay returns delay before attempt, retry policy of subscription
+// is used first, then retry delays of routing key, then its retry policy,
+// then retry config. The last delay is reused when there are more attempts
+// than delays.
+func (i *inService) getRetryDelay(routingKey *models.RoutingKey, policy *models.RetryPolicy, attempt uint) time.Duration {
+	if attempt == 0 {
+		attempt = 1
+	}
+
+	if policy != nil && policy != routingKey.RetryPolicy && policy.Delay > 0 {
+		return i.getBackoffDelay(policy, attempt)
+	}
+	if count := uint(len(routingKey.RetryDelays)); count > 0 {
+		if attempt > count {
+			attempt = count
+		}
+		return time.Duration(routingKey.RetryDelays[attempt-1]) * time.Second
+	}
+
+	if policy := routingKey.RetryPolicy; policy != nil && policy.Delay > 0 {
+		return i.getBackoffDelay(policy, attempt)
+	}
+
+	delays := queue.RetryDelays()
+	if len(delays) == 0 {
+		return DefaultRetryDelay
+	}
+	if attempt > uint(len(delays)) {
+		attempt = uint(len(delays))
+	}
+	return delays[attempt-1]
+}
+
+// getBackoffDelay doubles delay of policy on each attempt for exponential
+// backoff, jitter picks one of RetryJitterSteps between half and full delay.
+// Broker retry mode delays it in the delay queue of the next retry delay.
+func (i *inService) getBackoffDelay(policy *models.RetryPolicy, attempt uint) time.Duration {
+	delay := time.Duration(policy.Delay) * time.Second
+	maxDelay := time.Duration(policy.MaxDelay) * time.Second
+
+	if policy.Backoff == models.RetryBackoffExponential || policy.Backoff == models.RetryBackoffExponentialJitter {
+		for n := uint(1); n < attempt && n < MaxBackoffDoublings; n++ {
+			delay *= 2
+			if maxDelay > 0 && delay >= maxDelay {
+				break
+			}
+		}
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if policy.Backoff == models.RetryBackoffExponentialJitter {
+		step := time.Duration(rand.Intn(RetryJitterSteps + 1))
+		delay = delay/2 + delay/2*step/RetryJitterSteps
+		delay = delay.Round(time.Second)
+		if delay < time.Second {
+			delay = time.Second
+		}
+	}
+	return delay
 }
 
 func (i *inService) storeMessage(message *models.InMessage) (err error) {
 	return i.msgRepo.Upsert(message)
 }
 
-func (i *inService) callAPI(message *models.InMessage) (*http.Response, error) {
+func (i *inService) callAPI(message *models.InMessage, target *models.Subscription) (*http.Response, error) {
 	routingKey := message.RoutingKey
 
-	bytesPayload, _ := json.Marshal(message.Payload)
-	req, _ := http.NewRequest(
-		routingKey.APIMethod, routingKey.APIUrl, bytes.NewBuffer(bytesPayload))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", "ahsfishdi"))
+	req, body, err := i.clients.NewRequest(target.APIMethod, target.APIUrl, i.getTransform(message, target), message)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(i.ctx)
 	req.Header.Set("x-api-key", message.APIKey)
+	if secrets := routingKey.ActiveSecrets(time.Now()); len(secrets) > 0 {
+		req.Header.Set(signature.Header, signature.Sign(body, time.Now(), secrets...))
+	}
 
-	client := http.Client{
-		Timeout: RequestTimeout * time.Second,
+	host := req.URL.Host
+	if err := i.breakers.Allow(host); err != nil {
+		logger.Warnf("Skip request to %s, %s", target.APIUrl, err)
+		return nil, err
 	}
-	res, err := client.Do(req)
 
+	attemptAt := time.Now()
+	message.LastAttemptAt = &attemptAt
+
+	res, err := i.clients.Do(req, i.getHTTPConfig(message, target), message)
+
+	if errors.Is(err, context.Canceled) {
+		i.breakers.Release(host)
+		logger.Warnf("Aborted request to %s", target.APIUrl)
+		return res, err
+	}
+	// The host isn't called, e.g. the OAuth2 token isn't fetched
+	if errors.Is(err, httpclient.ErrNotSent) {
+		i.breakers.Release(host)
+		logger.Errorf("Failed to prepare request to %s, %s", target.APIUrl, err)
+		return res, err
+	}
 	if err != nil {
-		logger.Errorf("Failed to send request to %s, %s", routingKey.APIUrl, err)
+		i.breakers.Failure(host)
+		logger.Errorf("Failed to send request to %s, %s", target.APIUrl, err)
 		return res, err
 	}
 
+	// Client errors mean the host is up, only server errors open the breaker
+	if res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests {
+		i.breakers.Failure(host)
+	} else {
+		i.breakers.Success(host)
+	}
 	return res, nil
 }
 
+// getHTTPConfig returns HTTP config of target, or of routing key
+func (i *inService) getHTTPConfig(message *models.InMessage, target *models.Subscription) *models.HTTPConfig {
+	if target.HTTP != nil {
+		return target.HTTP
+	}
+	return message.RoutingKey.HTTP
+}
+
+// getTransform returns transform of target, or of routing key
+func (i *inService) getTransform(message *models.InMessage, target *models.Subscription) *models.Transform {
+	if target.Transform != nil {
+		return target.Transform
+	}
+	return message.RoutingKey.Transform
+}
+
 func (i *inService) getPrevMessage(message *models.InMessage) (*models.InMessage, error) {
 	// Get previous routing
 	routingQuery := schema.RoutingQueryParam{
@@ -244,9 +898,17 @@ func (i *inService) getPrevMessage(message *models.InMessage) (*models.InMessage
 	return i.msgRepo.Get(&query)
 }
 
-func (i *inService) getMaxRetryTimes() uint {
-	retryTimes := viper.GetUint("ts_rabbit.max_retry_times")
+// getMaxRetryTimes returns max attempts of retry policy, or of retry config
+func (i *inService) getMaxRetryTimes(policy *models.RetryPolicy) uint {
+	if policy != nil && policy.MaxAttempts > 0 {
+		return policy.MaxAttempts
+	}
 
+	retryTimes := config.Config.Retry.MaxAttempts
+	if retryTimes <= 0 {
+		// Config key before retry.max_attempts
+		retryTimes = viper.GetUint("ts_rabbit.max_retry_times")
+	}
 	if retryTimes <= 0 {
 		retryTimes = DefaultMaxRetryTimes
 	}
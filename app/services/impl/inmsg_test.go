@@ -0,0 +1,846 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"message-queue/app/breaker"
+	"message-queue/app/httpclient"
+	"message-queue/app/limiter"
+	"message-queue/app/models"
+	"message-queue/app/queue"
+	"message-queue/app/schema"
+	"message-queue/config"
+)
+
+const (
+	testExchange = "test.exchange"
+	testQueue    = "test.queue"
+)
+
+func init() {
+	config.Config.AMQP.ExchangeName = testExchange
+	config.Config.AMQP.QueueName = testQueue
+	config.Config.AMQP.DeadLetterExchange = ""
+	config.Config.Retry.Mode = ""
+	config.Config.Limiter.Backend = limiter.BackendMemory
+}
+
+func newTestBroker(t *testing.T) queue.Broker {
+	t.Helper()
+
+	broker := queue.NewMemoryBroker()
+	if err := broker.DeclareExchange(queue.ExchangeSpec{Name: testExchange, Kind: queue.ExchangeTypeTopic}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.DeclareQueue(queue.QueueSpec{Name: testQueue}); err != nil {
+		t.Fatal(err)
+	}
+	return broker
+}
+
+func newTestInService(inRepo *fakeInRepo, routingRepo *fakeRoutingRepo, consumer queue.Consumer) *inService {
+	return NewInService(inRepo, routingRepo, consumer, breaker.NewBreakers(),
+		limiter.NewLimiters(), httpclient.NewClients()).(*inService)
+}
+
+// waitFor polls condition until it's true or fails the test after a second
+func waitFor(t *testing.T, message string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for ", message)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublishConsumeCallAPI(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		requests <- payload
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	routingKey := models.RoutingKey{
+		Name:      "order.created",
+		Group:     "order",
+		Value:     1,
+		APIMethod: http.MethodPost,
+		APIUrl:    server.URL,
+		Active:    true,
+	}
+	inRepo := newFakeInRepo()
+	consumer := queue.NewConsumer(broker)
+	if err := consumer.Bind(&routingKey); err != nil {
+		t.Fatal(err)
+	}
+	service := newTestInService(inRepo, newFakeRoutingRepo(routingKey), consumer)
+
+	consumed := make(chan struct{})
+	go func() {
+		service.Consume()
+		close(consumed)
+	}()
+
+	outRepo := newFakeOutRepo()
+	outMsg := models.OutMessage{
+		RoutingKey:  routingKey.Name,
+		Payload:     map[string]interface{}{"id": "1"},
+		OriginModel: "order",
+		OriginCode:  "1",
+	}
+	outRepo.Create(&outMsg)
+	if err := queue.NewPublisher(broker, outRepo).Publish(&outMsg); err != nil {
+		t.Fatal(err)
+	}
+	if status := outRepo.status(outMsg.ID); status != models.OutMessageStatusSent {
+		t.Fatalf("expected out message sent, got %s", status)
+	}
+
+	select {
+	case payload := <-requests:
+		if payload["id"] != "1" {
+			t.Fatalf("unexpected payload %v", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("API is not called")
+	}
+
+	waitFor(t, "stored in message", func() bool {
+		messages := inRepo.all()
+		return len(messages) == 1 && messages[0].Status == models.InMessageStatusSuccess
+	})
+	if service.InFlight() != 0 {
+		t.Fatalf("expected no in-flight deliveries, got %d", service.InFlight())
+	}
+
+	consumer.Stop()
+	select {
+	case <-consumed:
+	case <-time.After(time.Second):
+		t.Fatal("Consume doesn't return after consumer is stopped")
+	}
+}
+
+func TestHandleWaitsForPreviousStep(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	created := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL, Active: true}
+	paid := models.RoutingKey{Name: "order.paid", Group: "order", Value: 2, APIUrl: server.URL, Active: true}
+	inRepo := newFakeInRepo()
+	service := newTestInService(inRepo, newFakeRoutingRepo(created, paid), queue.NewConsumer(newTestBroker(t)))
+
+	// Publish order of a partition doesn't prove the previous step succeeded
+	origin := models.Headers{OriginModel: "order", OriginCode: "1"}
+	prev := models.InMessage{RoutingKey: created, Headers: origin, Status: models.InMessageStatusFailed}
+	inRepo.Create(&prev)
+
+	message := models.InMessage{Headers: origin}
+	if err := service.handle(&message, paid.Name); err != nil {
+		t.Fatal(err)
+	}
+	if message.Status != models.InMessageStatusWaitPrevMsg || calls != 0 {
+		t.Fatalf("expected message waiting for previous one, got %s with %d calls", message.Status, calls)
+	}
+
+	prev.Status = models.InMessageStatusSuccess
+	inRepo.Update(&prev)
+	if err := service.handle(&message, paid.Name); err != nil {
+		t.Fatal(err)
+	}
+	if message.Status != models.InMessageStatusSuccess || calls != 1 {
+		t.Fatalf("expected delivered message, got %s with %d calls", message.Status, calls)
+	}
+}
+
+func TestHandleFiltersMessage(t *testing.T) {
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+	}))
+	defer server.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, Active: true,
+		Filter: "payload.country == 'VN'",
+		Subscriptions: []models.Subscription{
+			{ID: "billing", APIUrl: server.URL + "/billing", Filter: "payload.total > `100`"},
+			{ID: "search", APIUrl: server.URL + "/search"},
+		}}
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+
+	tests := []struct {
+		name     string
+		payload  map[string]interface{}
+		status   string
+		billing  string
+		expected map[string]int
+	}{
+		{name: "routing key filter", payload: map[string]interface{}{"country": "US", "total": 200},
+			status: models.InMessageStatusFiltered, expected: map[string]int{}},
+		{name: "subscription filter", payload: map[string]interface{}{"country": "VN", "total": 50},
+			status: models.InMessageStatusSuccess, billing: models.InMessageStatusFiltered,
+			expected: map[string]int{"/search": 1}},
+		{name: "matched", payload: map[string]interface{}{"country": "VN", "total": 200},
+			status: models.InMessageStatusSuccess, billing: models.InMessageStatusSuccess,
+			expected: map[string]int{"/billing": 1, "/search": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for path := range calls {
+				delete(calls, path)
+			}
+
+			message := models.InMessage{Payload: test.payload}
+			if err := service.handle(&message, routingKey.Name); err != nil {
+				t.Fatal(err)
+			}
+			if message.Status != test.status {
+				t.Fatalf("expected %s, got %s", test.status, message.Status)
+			}
+			if test.billing != "" && message.Deliveries[0].Status != test.billing {
+				t.Fatalf("expected billing %s, got %s", test.billing, message.Deliveries[0].Status)
+			}
+			if len(calls) != len(test.expected) {
+				t.Fatalf("expected calls %v, got %v", test.expected, calls)
+			}
+			for path, n := range test.expected {
+				if calls[path] != n {
+					t.Fatalf("expected calls %v, got %v", test.expected, calls)
+				}
+			}
+		})
+	}
+}
+
+// settled waits how the delivery is settled
+func settled(t *testing.T, settled <-chan string) string {
+	t.Helper()
+
+	select {
+	case result := <-settled:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("delivery is not settled")
+	}
+	return ""
+}
+
+func TestProcessSettlesDeliveries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL, Active: true}
+	routingRepo := newFakeRoutingRepo(routingKey)
+	routingRepo.get = func(query *schema.RoutingQueryParam) {
+		if query.Name == "order.panic" {
+			panic("poison message")
+		}
+	}
+	service := newTestInService(newFakeInRepo(), routingRepo, newFakeConsumer(1))
+
+	tests := []struct {
+		name       string
+		routingKey string
+		expected   string
+	}{
+		{name: "delivered", routingKey: "order.created", expected: settledAck},
+		{name: "invalid routing key", routingKey: "order.unknown", expected: settledReject},
+		{name: "handler panics", routingKey: "order.panic", expected: settledReject},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := models.InMessage{RoutingKey: models.RoutingKey{Name: test.routingKey}}
+			delivery, result := newFakeDelivery(message)
+			atomic.AddInt64(&service.inFlight, 1)
+			service.process(delivery)
+
+			if got := settled(t, result); got != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+	if service.InFlight() != 0 {
+		t.Fatalf("expected no in-flight deliveries, got %d", service.InFlight())
+	}
+}
+
+func TestProcessDelaysRequeueWhenStoreFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL, Active: true}
+	inRepo := newFakeInRepo()
+	inRepo.setStoreErr(errors.New("database is down"))
+	service := newTestInService(inRepo, newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+
+	// Requeue waits longer on every consecutive failure
+	for _, minDelay := range []time.Duration{StoreRetryMinDelay, 2 * StoreRetryMinDelay} {
+		delivery, result := newFakeDelivery(models.InMessage{RoutingKey: routingKey})
+		start := time.Now()
+		service.process(delivery)
+		if got := settled(t, result); got != settledRequeue {
+			t.Fatalf("expected requeue, got %s", got)
+		}
+		if elapsed := time.Since(start); elapsed < minDelay {
+			t.Fatalf("requeued after %s, expected at least %s", elapsed, minDelay)
+		}
+	}
+
+	inRepo.setStoreErr(nil)
+	delivery, result := newFakeDelivery(models.InMessage{RoutingKey: routingKey})
+	service.process(delivery)
+	if got := settled(t, result); got != settledAck {
+		t.Fatalf("expected ack, got %s", got)
+	}
+	if delay := service.getStoreRetryDelay(); delay != StoreRetryMinDelay {
+		t.Fatalf("expected delay reset after stored message, got %s", delay)
+	}
+}
+
+func TestConsumeQueueHandlesOriginsConcurrentlyAndInOrder(t *testing.T) {
+	const (
+		workers  = 4
+		messages = 3 // of every origin
+	)
+
+	var mu sync.Mutex
+	calls := make(map[string][]string) // origin code -> ids in call order
+	arrived := make(chan struct{}, workers*messages)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		calls[payload["origin"]] = append(calls[payload["origin"]], payload["id"])
+		mu.Unlock()
+
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL, Active: true}
+	consumer := newFakeConsumer(workers)
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(routingKey), consumer)
+
+	consumed := make(chan struct{})
+	go func() {
+		service.Consume()
+		close(consumed)
+	}()
+
+	// Find origins handled by different workers, messages of an origin are
+	// always handled by the same one
+	var origins []string
+	used := make(map[int]bool)
+	for code := 0; len(origins) < workers; code++ {
+		origin := fmt.Sprint(code)
+		worker := service.worker(&models.InMessage{Headers: models.Headers{OriginModel: "order", OriginCode: origin}}, workers)
+		if !used[worker] {
+			used[worker] = true
+			origins = append(origins, origin)
+		}
+	}
+
+	var results []<-chan string
+	go func() {
+		for id := 0; id < messages; id++ {
+			for _, origin := range origins {
+				message := models.InMessage{
+					RoutingKey: models.RoutingKey{Name: routingKey.Name},
+					Payload:    map[string]string{"origin": origin, "id": fmt.Sprint(id)},
+					Headers:    models.Headers{OriginModel: "order", OriginCode: origin},
+				}
+				delivery, result := newFakeDelivery(message)
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+				consumer.deliveries <- delivery
+			}
+		}
+		consumer.Stop()
+	}()
+
+	// Every worker calls the API at the same time
+	for n := 0; n < workers; n++ {
+		select {
+		case <-arrived:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d workers call the API concurrently", n, workers)
+		}
+	}
+	close(release)
+
+	select {
+	case <-consumed:
+	case <-time.After(time.Second):
+		t.Fatal("Consume doesn't return after deliveries are closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, result := range results {
+		if got := settled(t, result); got != settledAck {
+			t.Fatalf("expected ack, got %s", got)
+		}
+	}
+	for _, origin := range origins {
+		if ids := strings.Join(calls[origin], ","); ids != "0,1,2" {
+			t.Fatalf("origin %s is called in order %s", origin, ids)
+		}
+	}
+}
+
+func TestProcessLeavesAbortedCallForRetry(t *testing.T) {
+	var calls int32
+	called := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// Disconnects are only noticed after the body is read
+		ioutil.ReadAll(r.Body)
+		close(called)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL, Active: true}
+	inRepo := newFakeInRepo()
+	service := newTestInService(inRepo, newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+
+	delivery, result := newFakeDelivery(models.InMessage{RoutingKey: routingKey})
+	go service.process(delivery)
+	<-called
+	service.Abort()
+
+	// The delivery isn't requeued, the stored message is retried once
+	if got := settled(t, result); got != settledAck {
+		t.Fatalf("expected ack, got %s", got)
+	}
+	select {
+	case got := <-result:
+		t.Fatalf("delivery is settled again: %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	messages := inRepo.all()
+	if len(messages) != 1 || messages[0].Status != models.InMessageStatusWaitRetry ||
+		messages[0].Attempts != 0 || messages[0].NextAttemptAt == nil || messages[0].NextAttemptAt.After(time.Now()) {
+		t.Fatalf("expected one stored wait_retry message due without attempts, got %+v", messages)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected 1 call, got %d", n)
+	}
+	for _, state := range service.breakers.States() {
+		if state.TotalFailures != 0 {
+			t.Fatalf("aborted call is counted as failure of %s", state.Host)
+		}
+	}
+}
+
+func TestCallAPIDoesntCountUnsentRequestAsFailure(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer tokenServer.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL,
+		Active: true, HTTP: &models.HTTPConfig{Auth: &models.HTTPAuth{Type: models.HTTPAuthOAuth2,
+			TokenURL: tokenServer.URL, ClientID: "client"}}}
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+	config.Config.Breaker.FailureThreshold = 1
+	defer func() { config.Config.Breaker.FailureThreshold = 0 }()
+	service.breakers = breaker.NewBreakers()
+
+	for n := 0; n < 2; n++ {
+		message := models.InMessage{RoutingKey: routingKey}
+		target := routingKey.Target()
+		_, err := service.callAPI(&message, &target)
+		if !errors.Is(err, httpclient.ErrNotSent) {
+			t.Fatalf("expected %s, got %v", httpclient.ErrNotSent, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("expected API isn't called, got %d calls", n)
+	}
+	for _, state := range service.breakers.States() {
+		if state.TotalFailures != 0 || state.State != breaker.StateClosed {
+			t.Fatalf("unsent request is counted as failure of %s: %+v", state.Host, state)
+		}
+	}
+}
+
+func TestGetMaxRetryTimes(t *testing.T) {
+	maxAttempts := config.Config.Retry.MaxAttempts
+	defer func() {
+		config.Config.Retry.MaxAttempts = maxAttempts
+		viper.Set("ts_rabbit.max_retry_times", nil)
+	}()
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(), newFakeConsumer(1))
+
+	tests := []struct {
+		name          string
+		policy        *models.RetryPolicy
+		maxAttempts   uint
+		maxRetryTimes interface{}
+		expected      uint
+	}{
+		{name: "retry policy", policy: &models.RetryPolicy{MaxAttempts: 5}, maxAttempts: 4, expected: 5},
+		{name: "retry config", maxAttempts: 4, maxRetryTimes: 2, expected: 4},
+		{name: "legacy config", maxRetryTimes: 2, expected: 2},
+		{name: "default", expected: DefaultMaxRetryTimes},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Retry.MaxAttempts = test.maxAttempts
+			viper.Set("ts_rabbit.max_retry_times", test.maxRetryTimes)
+
+			if got := service.getMaxRetryTimes(test.policy); got != test.expected {
+				t.Fatalf("expected %d, got %d", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFanOutFailsSubscriptionAtMaxAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	routingKey := models.RoutingKey{
+		Name:   "order.created",
+		Group:  "order",
+		Value:  1,
+		Active: true,
+		Subscriptions: []models.Subscription{
+			{ID: "billing", APIUrl: server.URL, RetryPolicy: &models.RetryPolicy{MaxAttempts: 2}},
+		},
+	}
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+
+	// Attempts are counted like the ones of messages without subscriptions
+	message := models.InMessage{RoutingKey: routingKey}
+	for attempt, expected := range []string{models.InMessageStatusWaitRetry, models.InMessageStatusFailed} {
+		service.fanOut(&message)
+		state := message.Deliveries[0]
+		if state.Status != expected || state.Attempts != uint(attempt+1) {
+			t.Fatalf("expected %s after attempt %d, got %s after %d", expected, attempt+1, state.Status, state.Attempts)
+		}
+		message.Deliveries[0].NextAttemptAt = nil
+	}
+}
+
+func TestProcessDelaysRateLimitedMessage(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+	}))
+	defer server.Close()
+
+	// One call every 10 seconds
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL,
+		Active: true, RateLimit: 0.1, RateBurst: 1}
+	inRepo := newFakeInRepo()
+	consumer := newFakeConsumer(1)
+	service := newTestInService(inRepo, newFakeRoutingRepo(routingKey), consumer)
+
+	// Distinct origins, messages don't wait for each other as previous steps
+	first, result := newFakeDelivery(models.InMessage{RoutingKey: routingKey,
+		Headers: models.Headers{OriginModel: "order", OriginCode: "1"}})
+	service.process(first)
+	if got := settled(t, result); got != settledAck {
+		t.Fatalf("expected ack, got %s", got)
+	}
+
+	// The worker isn't blocked until a token is available
+	second, result := newFakeDelivery(models.InMessage{RoutingKey: routingKey,
+		Headers: models.Headers{OriginModel: "order", OriginCode: "2"}})
+	start := time.Now()
+	service.process(second)
+	if got := settled(t, result); got != settledAck || time.Since(start) > time.Second {
+		t.Fatalf("expected ack without waiting, got %s after %s", got, time.Since(start))
+	}
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 call, got %d", len(calls))
+	}
+	msg := second.Message
+	if msg.Status != models.InMessageStatusWaitRetry || msg.Attempts != 0 || msg.NextAttemptAt == nil ||
+		time.Until(*msg.NextAttemptAt) > 10*time.Second {
+		t.Fatalf("expected wait_retry message due when a token is available, got %+v", msg)
+	}
+
+	// Brokers with delay queues redeliver it after the wait, in the delay
+	// queue of the next configured delay
+	consumer.retries = true
+	config.Config.Retry.Delays = []uint{5, 30, 60}
+	defer func() { config.Config.Retry.Delays = nil }()
+	third, result := newFakeDelivery(models.InMessage{RoutingKey: routingKey,
+		Headers: models.Headers{OriginModel: "order", OriginCode: "3"}})
+	service.process(third)
+	if got := settled(t, result); got != settledAck {
+		t.Fatalf("expected ack, got %s", got)
+	}
+	select {
+	case delay := <-consumer.delays:
+		if delay != 30*time.Second {
+			t.Fatalf("expected delay of 30s queue for the next token, got %s", delay)
+		}
+	default:
+		t.Fatal("rate limited delivery is not delayed")
+	}
+	if third.Message.Status != models.InMessageStatusRetrying || third.Message.Attempts != 0 {
+		t.Fatalf("expected retrying message without attempts, got %+v", third.Message)
+	}
+}
+
+func TestDeliverReusesConnection(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}` + strings.Repeat(" ", 64*1024)))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, APIUrl: server.URL, Active: true}
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+
+	for n := 0; n < 3; n++ {
+		message := models.InMessage{RoutingKey: routingKey}
+		target := routingKey.Target()
+		if status, _, err := service.deliver(&message, &target); status != models.InMessageStatusSuccess {
+			t.Fatalf("expected success, got %s, %v", status, err)
+		}
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("expected connection reused by calls, got %d connections", n)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	routingKey := models.RoutingKey{Name: "order.created", Group: "order", Value: 1, Active: true,
+		APIMethod: http.MethodPost, APIUrl: "http://api.test/orders",
+		Transform: &models.Transform{Body: `{"id": {{json .Payload.id}}}`},
+		HTTP: &models.HTTPConfig{Headers: map[string]string{"X-Origin": "{{.OriginModel}}"},
+			Auth: &models.HTTPAuth{Type: models.HTTPAuthBearer, Token: "token"}},
+		Subscriptions: []models.Subscription{
+			{ID: "billing", Name: "billing", APIMethod: http.MethodPut, APIUrl: "http://billing.test",
+				Transform: &models.Transform{Path: "/invoices/{{.Payload.id}}"}},
+			{ID: "search", Name: "search", APIMethod: http.MethodPost, APIUrl: "http://search.test"},
+			{ID: "audit", Name: "audit", APIUrl: "http://audit.test", Status: models.SubscriptionStatusInactive},
+		}}
+	inRepo := newFakeInRepo()
+	service := newTestInService(inRepo, newFakeRoutingRepo(routingKey), newFakeConsumer(1))
+
+	message := models.InMessage{RoutingKey: models.RoutingKey{Name: routingKey.Name},
+		Payload: map[string]interface{}{"id": "1"}, Headers: models.Headers{OriginModel: "order"}}
+	inRepo.Create(&message)
+
+	previews, err := service.Preview(context.Background(), message.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previews) != 2 {
+		t.Fatalf("expected previews of active subscriptions, got %+v", previews)
+	}
+
+	// Subscriptions without transform use the one of routing key
+	expected := []schema.RequestPreview{
+		{Target: "billing", Method: http.MethodPut, URL: "http://billing.test/invoices/1", Body: `{"id":"1"}`},
+		{Target: "search", Method: http.MethodPost, URL: "http://search.test", Body: `{"id": "1"}`},
+	}
+	for n, preview := range previews {
+		if preview.Target != expected[n].Target || preview.Method != expected[n].Method ||
+			preview.URL != expected[n].URL || preview.Body != expected[n].Body {
+			t.Fatalf("expected %+v, got %+v", expected[n], preview)
+		}
+		if preview.Headers["Content-Type"] != "application/json" || preview.Headers["X-Origin"] != "order" {
+			t.Fatalf("expected content type and rendered headers, got %v", preview.Headers)
+		}
+		if _, ok := preview.Headers["Authorization"]; ok {
+			t.Fatalf("auth header in preview %v", preview.Headers)
+		}
+	}
+
+	// Template errors of the current routing key are returned
+	routingKey.HTTP.Headers["X-Origin"] = "{{.OriginModel.Missing}}"
+	service.routingRepo = newFakeRoutingRepo(routingKey)
+	if _, err := service.Preview(context.Background(), message.ID); err == nil ||
+		!strings.Contains(err.Error(), "render header X-Origin") {
+		t.Fatalf("expected error of header template, got %v", err)
+	}
+
+	if _, err := service.Preview(context.Background(), "unknown"); err == nil {
+		t.Fatal("expected error of unknown message")
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	service := newTestInService(newFakeInRepo(), newFakeRoutingRepo(), newFakeConsumer(1))
+	routingKey := models.RoutingKey{Name: "order.created", RetryDelays: []uint{10, 60}}
+	lastAttemptAt := time.Now().Add(-time.Minute)
+	subscriptionDue := time.Now().Add(5 * time.Second)
+
+	tests := []struct {
+		name     string
+		message  models.InMessage
+		err      error
+		expected *time.Time
+	}{
+		{
+			name:    "not waiting",
+			message: models.InMessage{Status: models.InMessageStatusSuccess, NextAttemptAt: &lastAttemptAt},
+		},
+		{
+			name:     "retry delay of the next attempt",
+			message:  models.InMessage{Status: models.InMessageStatusWaitRetry, Attempts: 1, LastAttemptAt: &lastAttemptAt},
+			err:      errors.New("500 Internal Server Error"),
+			expected: timePtr(lastAttemptAt.Add(60 * time.Second)),
+		},
+		{
+			name:     "rate limited",
+			message:  models.InMessage{Status: models.InMessageStatusWaitRetry, Attempts: 1, LastAttemptAt: &lastAttemptAt},
+			err:      &limiter.LimitedError{RetryAfter: 3 * time.Second},
+			expected: timePtr(time.Now().Add(3 * time.Second)),
+		},
+		{
+			name:     "aborted",
+			message:  models.InMessage{Status: models.InMessageStatusWaitRetry, Attempts: 1, LastAttemptAt: &lastAttemptAt},
+			err:      context.Canceled,
+			expected: timePtr(time.Now()),
+		},
+		{
+			name: "first due subscription",
+			message: models.InMessage{Status: models.InMessageStatusWaitRetry, Deliveries: []models.SubscriptionDelivery{
+				{SubscriptionID: "billing", Status: models.InMessageStatusSuccess},
+				{SubscriptionID: "search", Status: models.InMessageStatusWaitRetry, NextAttemptAt: timePtr(subscriptionDue.Add(time.Minute))},
+				{SubscriptionID: "mail", Status: models.InMessageStatusWaitRetry, NextAttemptAt: &subscriptionDue},
+			}},
+			expected: &subscriptionDue,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := test.message
+			message.RoutingKey = routingKey
+			service.scheduleRetry(&message, test.err)
+
+			if test.expected == nil {
+				if message.NextAttemptAt != nil {
+					t.Fatalf("expected no next attempt, got %s", message.NextAttemptAt)
+				}
+				return
+			}
+			if message.NextAttemptAt == nil {
+				t.Fatalf("expected next attempt at %s, got none", test.expected)
+			}
+			if diff := message.NextAttemptAt.Sub(*test.expected); diff < -time.Second || diff > time.Second {
+				t.Fatalf("expected next attempt at %s, got %s", test.expected, message.NextAttemptAt)
+			}
+		})
+	}
+}
+
+func TestCronRetryRetriesDueMessagesInOrder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		calls = append(calls, payload.ID)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// Messages of the second step, their first steps are done
+	placed := models.RoutingKey{Name: "order.placed", Group: "order", Value: 1, Active: true}
+	routingKey := models.RoutingKey{Name: "order.shipped", Group: "order", Value: 2, APIUrl: server.URL, Active: true}
+	inRepo := newFakeInRepo()
+	service := newTestInService(inRepo, newFakeRoutingRepo(placed, routingKey), newFakeConsumer(1))
+
+	now := time.Now()
+	for _, message := range []struct {
+		id            string
+		nextAttemptAt time.Time
+	}{
+		{id: "later", nextAttemptAt: now.Add(-time.Minute)},
+		{id: "future", nextAttemptAt: now.Add(time.Hour)},
+		{id: "earliest", nextAttemptAt: now.Add(-time.Hour)},
+	} {
+		origin := models.Headers{OriginModel: "order", OriginCode: message.id}
+		inRepo.Create(&models.InMessage{RoutingKey: placed, Headers: origin, Status: models.InMessageStatusSuccess})
+
+		nextAttemptAt := message.nextAttemptAt
+		inRepo.Create(&models.InMessage{
+			RoutingKey:    routingKey,
+			Headers:       origin,
+			Payload:       map[string]interface{}{"id": message.id},
+			Status:        models.InMessageStatusWaitRetry,
+			NextAttemptAt: &nextAttemptAt,
+		})
+	}
+
+	if err := service.CronRetry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(calls, ",") != "earliest,later" {
+		t.Fatalf("expected calls of due messages earliest first, got %v", calls)
+	}
+	for _, message := range inRepo.all() {
+		if message.RoutingKey.Name != routingKey.Name {
+			continue
+		}
+		expected := models.InMessageStatusSuccess
+		if message.OriginCode == "future" {
+			expected = models.InMessageStatusWaitRetry
+		}
+		if message.Status != expected {
+			t.Errorf("message %s: expected %s, got %s", message.OriginCode, expected, message.Status)
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -11,6 +11,7 @@ import (
 	"message-queue/app/repositories"
 	"message-queue/app/schema"
 	"message-queue/app/services"
+	"message-queue/pkg/jsonschema"
 )
 
 const (
@@ -18,14 +19,17 @@ const (
 )
 
 type outService struct {
-	pub  queue.Publisher
-	repo repositories.OutRepository
+	pub         queue.Publisher
+	repo        repositories.OutRepository
+	routingRepo repositories.RoutingRepository
 }
 
-func NewOutService(pub queue.Publisher, repo repositories.OutRepository) services.OutService {
+func NewOutService(pub queue.Publisher, repo repositories.OutRepository,
+	routingRepo repositories.RoutingRepository) services.OutService {
 	return &outService{
-		pub:  pub,
-		repo: repo,
+		pub:         pub,
+		repo:        repo,
+		routingRepo: routingRepo,
 	}
 }
 
@@ -47,10 +51,14 @@ func (o *outService) Update(ctx context.Context, id string, body *schema.OutMsgU
 	return rs, nil
 }
 
+// Publish stores message before publishing, so that the broker confirmation
+// can update its status. Messages which don't match payload schema of their
+// routing key are rejected with a *jsonschema.ValidationError.
 func (o *outService) Publish(ctx context.Context, message *models.OutMessage) error {
-	err := o.pub.Publish(message, true)
+	err := o.validatePayload(message)
 	if err != nil {
-		logger.Errorf("Failed to publish msg %s, %s", message.ID, err)
+		logger.Errorf("Reject out msg of routing key %s, %s", message.RoutingKey, err)
+		return err
 	}
 
 	err = o.repo.Create(message)
@@ -58,6 +66,11 @@ func (o *outService) Publish(ctx context.Context, message *models.OutMessage) er
 		logger.Errorf("Failed to create out msg %s", message.ID)
 		return err
 	}
+
+	err = o.pub.Publish(message)
+	if err != nil {
+		logger.Errorf("Failed to publish msg %s, %s", message.ID, err)
+	}
 	return nil
 }
 
@@ -75,9 +88,22 @@ func (o *outService) CronResend() error {
 
 	logger.Infof("[Resend Message] Found %d wait messages!", len(*messages))
 	for _, msg := range *messages {
-		o.pub.Publish(&msg, true)
+		o.pub.Publish(&msg)
 	}
 	logger.Info("[Resend Message] Finish!")
 
 	return nil
 }
+
+// validatePayload validates payload by schema of routing key, messages of
+// unknown routing keys are published as they are
+func (o *outService) validatePayload(message *models.OutMessage) error {
+	query := schema.RoutingQueryParam{
+		Name: message.RoutingKey,
+	}
+	routingKey, err := o.routingRepo.Get(&query)
+	if err != nil || routingKey == nil {
+		return nil
+	}
+	return jsonschema.ValidatePayload(routingKey.PayloadSchema, message.Payload)
+}
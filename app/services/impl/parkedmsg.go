@@ -0,0 +1,94 @@
+package impl
+
+import (
+	"context"
+
+	"github.com/quangdangfit/gosdk/utils/logger"
+	"github.com/quangdangfit/gosdk/utils/paging"
+
+	"message-queue/app/models"
+	"message-queue/app/queue"
+	"message-queue/app/repositories"
+	"message-queue/app/schema"
+	"message-queue/app/services"
+)
+
+type parkedService struct {
+	parking queue.Parking
+	repo    repositories.ParkedRepository
+}
+
+func NewParkedService(parking queue.Parking, repo repositories.ParkedRepository) services.ParkedService {
+	return &parkedService{
+		parking: parking,
+		repo:    repo,
+	}
+}
+
+// Consume stores parked deliveries, they stay in the parking queue until
+// they are stored.
+func (p *parkedService) Consume() {
+	for delivery := range p.parking.Consume() {
+		err := p.repo.Create(delivery.Message)
+		if err != nil {
+			logger.Error("Failed to store parked message: ", err)
+			delivery.Nack(true)
+			continue
+		}
+
+		delivery.Ack()
+		logger.Infof("Parked message %s from queue %s, reason: %s",
+			delivery.Message.ID, delivery.Message.Queue, delivery.Message.Reason)
+	}
+}
+
+func (p *parkedService) Retrieve(ctx context.Context, id string) (*models.ParkedMessage, error) {
+	rs, err := p.repo.Retrieve(id)
+	if err != nil {
+		logger.Errorf("Cannot get parked message %s, error: %s", id, err)
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (p *parkedService) List(ctx context.Context, query *schema.ParkedMsgQueryParam) (*[]models.ParkedMessage, *paging.Paging, error) {
+	rs, pageInfo, err := p.repo.List(query)
+	if err != nil {
+		logger.Errorf("Cannot get list parked messages, error: %s", err)
+		return nil, nil, err
+	}
+
+	return rs, pageInfo, nil
+}
+
+// Requeue publishes parked message back and removes it from parking lot
+func (p *parkedService) Requeue(ctx context.Context, id string) error {
+	message, err := p.repo.Retrieve(id)
+	if err != nil {
+		logger.Errorf("Cannot get parked message %s, error: %s", id, err)
+		return err
+	}
+
+	err = p.parking.Requeue(message)
+	if err != nil {
+		logger.Errorf("Cannot requeue parked message %s, error: %s", id, err)
+		return err
+	}
+
+	err = p.repo.Delete(id)
+	if err != nil {
+		logger.Errorf("Cannot delete requeued parked message %s, error: %s", id, err)
+		return err
+	}
+	return nil
+}
+
+func (p *parkedService) Purge(ctx context.Context, query *schema.ParkedMsgQueryParam) error {
+	err := p.repo.DeleteMany(query)
+	if err != nil {
+		logger.Errorf("Cannot purge parked messages, error: %s", err)
+		return err
+	}
+	return nil
+}
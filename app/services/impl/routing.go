@@ -2,23 +2,39 @@ package impl
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/quangdangfit/gosdk/utils/logger"
 	"github.com/quangdangfit/gosdk/utils/paging"
 
+	"message-queue/app/httpclient"
 	"message-queue/app/models"
+	"message-queue/app/queue"
 	"message-queue/app/repositories"
 	"message-queue/app/schema"
 	"message-queue/app/services"
+	"message-queue/pkg/filter"
+	"message-queue/pkg/jsonschema"
+)
+
+const (
+	SyncBindingsPageLimit = 50
+	SigningSecretBytes    = 32
 )
 
 type routing struct {
-	repo repositories.RoutingRepository
+	consumer queue.Consumer
+	repo     repositories.RoutingRepository
 }
 
-func NewRoutingService(repo repositories.RoutingRepository) services.RoutingService {
+func NewRoutingService(consumer queue.Consumer, repo repositories.RoutingRepository) services.RoutingService {
 	return &routing{
-		repo: repo,
+		consumer: consumer,
+		repo:     repo,
 	}
 }
 
@@ -43,21 +59,232 @@ func (r *routing) List(ctx context.Context, query *schema.RoutingQueryParam) (*[
 }
 
 func (r *routing) Create(ctx context.Context, body *schema.RoutingCreateParam) (*models.RoutingKey, error) {
+	if err := validateFilters(body.Filter, body.Subscriptions); err != nil {
+		return nil, err
+	}
+	if err := validateTemplates(body.HTTP, body.Transform, body.Subscriptions); err != nil {
+		return nil, err
+	}
+	if err := jsonschema.Validate(body.PayloadSchema); err != nil {
+		return nil, err
+	}
+
 	rs, err := r.repo.Create(body)
 	if err != nil {
 		logger.Error("Cannot create routing key, error: ", err)
 		return nil, err
 	}
 
+	r.bind(rs)
 	return rs, nil
 }
 
 func (r *routing) Update(ctx context.Context, id string, body *schema.RoutingUpdateParam) (*models.RoutingKey, error) {
+	var expression string
+	if body.Filter != nil {
+		expression = *body.Filter
+	}
+	if err := validateFilters(expression, body.Subscriptions); err != nil {
+		return nil, err
+	}
+	if err := validateTemplates(body.HTTP, body.Transform, body.Subscriptions); err != nil {
+		return nil, err
+	}
+	if body.PayloadSchema != nil {
+		if err := jsonschema.Validate(*body.PayloadSchema); err != nil {
+			return nil, err
+		}
+	}
+
+	old, err := r.repo.Retrieve(id)
+	if err != nil {
+		logger.Errorf("Cannot get routing key %s, error: %s", id, err)
+		return nil, err
+	}
+
 	rs, err := r.repo.Update(id, body)
 	if err != nil {
 		logger.Error("Cannot update routing key, error: ", err)
 		return nil, err
 	}
 
+	if old.Active && (!rs.Active || old.Name != rs.Name ||
+		r.consumer.Queue(old).Name != r.consumer.Queue(rs).Name) {
+		r.unbind(old)
+	}
+	r.bind(rs)
 	return rs, nil
 }
+
+func (r *routing) RotateSecret(ctx context.Context, id string, overlap time.Duration) (*models.SigningSecret, error) {
+	routingKey, err := r.repo.Retrieve(id)
+	if err != nil {
+		logger.Errorf("Cannot get routing key %s, error: %s", id, err)
+		return nil, err
+	}
+
+	random := make([]byte, SigningSecretBytes)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(overlap)
+	secret := models.SigningSecret{
+		ID:        uuid.New().String(),
+		Secret:    models.SigningSecretPrefix + hex.EncodeToString(random),
+		CreatedAt: now,
+	}
+
+	secrets := []models.SigningSecret{secret}
+	for _, current := range routingKey.SigningSecrets {
+		if current.ExpiresAt != nil && !now.Before(*current.ExpiresAt) {
+			continue
+		}
+		if current.ExpiresAt == nil || current.ExpiresAt.After(expiresAt) {
+			current.ExpiresAt = &expiresAt
+		}
+		// Secrets rotated before ids were added
+		if current.ID == "" {
+			current.ID = uuid.New().String()
+		}
+		secrets = append(secrets, current)
+	}
+
+	err = r.repo.UpdateSecrets(id, secrets)
+	if err != nil {
+		logger.Errorf("Cannot rotate secret of routing key %s, error: %s", id, err)
+		return nil, err
+	}
+
+	logger.Infof("Rotated signing secret of routing key %s", routingKey.Name)
+	return &secret, nil
+}
+
+func (r *routing) SyncBindings(ctx context.Context) error {
+	query := schema.RoutingQueryParam{
+		Page:  1,
+		Limit: SyncBindingsPageLimit,
+	}
+
+	var active []models.RoutingKey
+	for {
+		rs, pageInfo, err := r.repo.List(&query)
+		if err != nil {
+			logger.Errorf("Cannot get list routing key, error: %s", err)
+			return err
+		}
+
+		for _, routingKey := range *rs {
+			routingKey := routingKey
+			if routingKey.Active {
+				r.bind(&routingKey)
+				active = append(active, routingKey)
+			} else {
+				r.unbind(&routingKey)
+			}
+		}
+
+		if pageInfo == nil || query.Page >= pageInfo.TotalPage {
+			break
+		}
+		query.Page++
+	}
+
+	// Keys which are deleted or renamed are not listed anymore, their
+	// bindings are only found on the broker
+	err := r.consumer.Prune(active)
+	if err == queue.ErrManagementNotConfigured {
+		logger.Warn("Cannot remove stale queue bindings, amqp management url is not set")
+	} else if err != nil {
+		logger.Error("Cannot remove stale queue bindings, error: ", err)
+	}
+
+	logger.Info("Synced queue bindings with routing keys")
+	return nil
+}
+
+// bind binds the queue of routing key to its messages if it is active, queue
+// bindings are resynced on startup so failures are only logged
+func (r *routing) bind(routingKey *models.RoutingKey) {
+	if !routingKey.Active || routingKey.Name == "" {
+		return
+	}
+
+	err := r.consumer.Bind(routingKey)
+	if err != nil {
+		logger.Errorf("Cannot bind routing key %s, error: %s", routingKey.Name, err)
+	}
+}
+
+func (r *routing) unbind(routingKey *models.RoutingKey) {
+	if routingKey.Name == "" {
+		return
+	}
+
+	err := r.consumer.Unbind(routingKey)
+	if err != nil {
+		logger.Errorf("Cannot unbind routing key %s, error: %s", routingKey.Name, err)
+	}
+}
+
+func (r *routing) TestFilter(ctx context.Context, body *schema.FilterTestParam) (*schema.FilterTestResult, error) {
+	document, err := filter.Document(body.RoutingKey, body.Payload, body.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := filter.Match(body.Filter, document)
+	if err != nil {
+		return nil, err
+	}
+	return &schema.FilterTestResult{Matched: matched}, nil
+}
+
+// validateFilters returns an error when filter of routing key or of any
+// subscription is not a valid expression
+func validateFilters(expression string, subscriptions []schema.Subscription) error {
+	if err := filter.Validate(expression); err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if err := filter.Validate(subscription.Filter); err != nil {
+			return errors.Wrapf(err, "subscription %s", subscription.Name)
+		}
+	}
+	return nil
+}
+
+// validateTemplates returns an error when a header or transform template of
+// routing key or of any subscription can't be parsed
+func validateTemplates(config *schema.HTTPConfig, transform *schema.Transform, subscriptions []schema.Subscription) error {
+	var templates []string
+	add := func(config *schema.HTTPConfig, transform *schema.Transform) {
+		if config != nil {
+			for _, value := range config.Headers {
+				templates = append(templates, value)
+			}
+		}
+		if transform != nil {
+			templates = append(templates, transform.Body, transform.Path)
+			for _, value := range transform.Query {
+				templates = append(templates, value)
+			}
+			for _, value := range transform.Headers {
+				templates = append(templates, value)
+			}
+		}
+	}
+
+	add(config, transform)
+	for _, subscription := range subscriptions {
+		add(subscription.HTTP, subscription.Transform)
+	}
+
+	for _, value := range templates {
+		if err := httpclient.ValidateTemplate(value); err != nil {
+			return errors.Wrap(err, "template is invalid")
+		}
+	}
+	return nil
+}
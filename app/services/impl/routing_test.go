@@ -0,0 +1,77 @@
+package impl
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"message-queue/app/schema"
+)
+
+func TestRoutingTestFilter(t *testing.T) {
+	service := &routing{}
+	payload := map[string]interface{}{"country": "VN", "total": 120}
+	headers := map[string]interface{}{"origin_model": "order"}
+
+	tests := []struct {
+		name     string
+		filter   string
+		expected bool
+		invalid  bool
+	}{
+		{name: "payload", filter: "payload.country == 'VN' && payload.total > `100`", expected: true},
+		{name: "not matched", filter: "payload.country == 'US'", expected: false},
+		{name: "headers", filter: "headers.origin_model == 'order'", expected: true},
+		{name: "routing key", filter: "routing_key == 'order.created'", expected: true},
+		{name: "falsy result", filter: "payload.missing", expected: false},
+		{name: "invalid", filter: "payload.country ==", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rs, err := service.TestFilter(context.Background(), &schema.FilterTestParam{
+				Filter: test.filter, RoutingKey: "order.created", Payload: payload, Headers: headers})
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected error of invalid filter, got %+v", rs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rs.Matched != test.expected {
+				t.Fatalf("expected matched %t, got %t", test.expected, rs.Matched)
+			}
+		})
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	tests := []struct {
+		name          string
+		filter        string
+		subscriptions []schema.Subscription
+		error         string
+	}{
+		{name: "valid", filter: "payload.country == 'VN'",
+			subscriptions: []schema.Subscription{{Name: "billing", Filter: "payload.total > `0`"}, {Name: "search"}}},
+		{name: "invalid routing key filter", filter: "payload.country ==", error: "filter"},
+		{name: "invalid subscription filter",
+			subscriptions: []schema.Subscription{{Name: "search"}, {Name: "billing", Filter: "payload.total >"}},
+			error:         "subscription billing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateFilters(test.filter, test.subscriptions)
+			if test.error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected error of %s, got %v", test.error, err)
+			}
+		})
+	}
+}
@@ -11,7 +11,14 @@ import (
 
 type InService interface {
 	Consume()
+	// InFlight returns number of deliveries being handled
+	InFlight() int64
+	// Abort cancels API calls in flight, their deliveries are requeued
+	Abort()
 	List(ctx context.Context, query *schema.InMsgQueryParam) (*[]models.InMessage, *paging.Paging, error)
+	// Preview renders API requests of in message by its current routing key
+	// without sending them
+	Preview(ctx context.Context, id string) ([]schema.RequestPreview, error)
 	CronRetry() error
 	CronRetryPrevious() error
 }
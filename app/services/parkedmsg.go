@@ -0,0 +1,18 @@
+package services
+
+import (
+	"context"
+
+	"github.com/quangdangfit/gosdk/utils/paging"
+
+	"message-queue/app/models"
+	"message-queue/app/schema"
+)
+
+type ParkedService interface {
+	Consume()
+	Retrieve(ctx context.Context, id string) (*models.ParkedMessage, error)
+	List(ctx context.Context, query *schema.ParkedMsgQueryParam) (*[]models.ParkedMessage, *paging.Paging, error)
+	Requeue(ctx context.Context, id string) error
+	Purge(ctx context.Context, query *schema.ParkedMsgQueryParam) error
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"time"
 
 	"github.com/quangdangfit/gosdk/utils/paging"
 
@@ -14,4 +15,12 @@ type RoutingService interface {
 	List(ctx context.Context, query *schema.RoutingQueryParam) (*[]models.RoutingKey, *paging.Paging, error)
 	Create(ctx context.Context, body *schema.RoutingCreateParam) (*models.RoutingKey, error)
 	Update(ctx context.Context, id string, body *schema.RoutingUpdateParam) (*models.RoutingKey, error)
+	// RotateSecret adds a new signing secret, current secrets expire after
+	// overlap and expired ones are removed
+	RotateSecret(ctx context.Context, id string, overlap time.Duration) (*models.SigningSecret, error)
+	// TestFilter evaluates filter against a sample message without storing it
+	TestFilter(ctx context.Context, body *schema.FilterTestParam) (*schema.FilterTestResult, error)
+	// SyncBindings binds the consumer queue to active routing keys, unbinds
+	// inactive ones and removes bindings of keys which don't exist anymore
+	SyncBindings(ctx context.Context) error
 }
@@ -3,26 +3,99 @@ package config
 import (
 	"fmt"
 	"strings"
+	"testing"
 
 	"github.com/spf13/viper"
 )
 
 type Schema struct {
-	Mode      int `mapstructure:"mode"`
-	PageLimit int `mapstructure:"page_limit"`
-	AMQP      struct {
-		URL             string `mapstructure:"url"`
-		Host            string `mapstructure:"host"`
-		Port            string `mapstructure:"port"`
-		Vhost           string `mapstructure:"vhost"`
-		Username        string `mapstructure:"username"`
-		Password        string `mapstructure:"password"`
-		ExchangeName    string `mapstructure:"exchange_name"`
-		ExchangeType    string `mapstructure:"exchange_type"`
-		QueueName       string `mapstructure:"queue_name"`
-		ConsumerThreads int    `mapstructure:"consumer_threads"`
+	Mode            int    `mapstructure:"mode"`
+	PageLimit       int    `mapstructure:"page_limit"`
+	Broker          string `mapstructure:"broker"`
+	ShutdownTimeout int    `mapstructure:"shutdown_timeout"`
+	SyncInterval    int    `mapstructure:"sync_interval"`
+	AMQP            struct {
+		URL                string `mapstructure:"url"`
+		Host               string `mapstructure:"host"`
+		Port               string `mapstructure:"port"`
+		Vhost              string `mapstructure:"vhost"`
+		Username           string `mapstructure:"username"`
+		Password           string `mapstructure:"password"`
+		ExchangeName       string `mapstructure:"exchange_name"`
+		ExchangeType       string `mapstructure:"exchange_type"`
+		QueueName          string `mapstructure:"queue_name"`
+		ConsumerThreads    int    `mapstructure:"consumer_threads"`
+		Prefetch           int    `mapstructure:"prefetch"`
+		PublisherChannels  int    `mapstructure:"publisher_channels"`
+		DeadLetterExchange string `mapstructure:"dead_letter_exchange"`
+		ParkingQueue       string `mapstructure:"parking_queue"`
+		ManagementURL      string `mapstructure:"management_url"`
 	} `mapstructure:"amqp"`
 
+	Redis struct {
+		Addr          string `mapstructure:"addr"`
+		Password      string `mapstructure:"password"`
+		DB            int    `mapstructure:"db"`
+		Prefix        string `mapstructure:"prefix"`
+		MaxLen        int64  `mapstructure:"max_len"`
+		Consumer      string `mapstructure:"consumer"`
+		ClaimMinIdle  int    `mapstructure:"claim_min_idle"`
+		ClaimInterval int    `mapstructure:"claim_interval"`
+	} `mapstructure:"redis"`
+
+	NATS struct {
+		URL        string `mapstructure:"url"`
+		AckWait    int    `mapstructure:"ack_wait"`
+		MaxDeliver int    `mapstructure:"max_deliver"`
+		NakDelay   int    `mapstructure:"nak_delay"`
+		MaxAge     int    `mapstructure:"max_age"`
+	} `mapstructure:"nats"`
+
+	Kafka struct {
+		Brokers           []string `mapstructure:"brokers"`
+		Partitions        int      `mapstructure:"partitions"`
+		ReplicationFactor int      `mapstructure:"replication_factor"`
+	} `mapstructure:"kafka"`
+
+	Retry struct {
+		Mode        string `mapstructure:"mode"`
+		Delays      []uint `mapstructure:"delays"`
+		MaxAttempts uint   `mapstructure:"max_attempts"`
+	} `mapstructure:"retry"`
+
+	Breaker struct {
+		FailureThreshold int `mapstructure:"failure_threshold"`
+		OpenTimeout      int `mapstructure:"open_timeout"`
+		HalfOpenProbes   int `mapstructure:"half_open_probes"`
+	} `mapstructure:"breaker"`
+
+	Limiter struct {
+		Backend      string `mapstructure:"backend"`
+		Prefix       string `mapstructure:"prefix"`
+		LeaseTimeout int    `mapstructure:"lease_timeout"`
+	} `mapstructure:"limiter"`
+
+	Topology struct {
+		Exchanges []struct {
+			Name       string                 `mapstructure:"name"`
+			Kind       string                 `mapstructure:"kind"`
+			Durable    bool                   `mapstructure:"durable"`
+			AutoDelete bool                   `mapstructure:"auto_delete"`
+			Args       map[string]interface{} `mapstructure:"args"`
+		} `mapstructure:"exchanges"`
+		Queues []struct {
+			Name       string                 `mapstructure:"name"`
+			Durable    bool                   `mapstructure:"durable"`
+			AutoDelete bool                   `mapstructure:"auto_delete"`
+			Args       map[string]interface{} `mapstructure:"args"`
+		} `mapstructure:"queues"`
+		Bindings []struct {
+			Queue      string `mapstructure:"queue"`
+			Exchange   string `mapstructure:"exchange"`
+			RoutingKey string `mapstructure:"routing_key"`
+		} `mapstructure:"bindings"`
+	} `mapstructure:"topology"`
+
 	MongoDB struct {
 		Host     string `mapstructure:"host"`
 		Port     int    `mapstructure:"port"`
@@ -37,6 +110,11 @@ type Schema struct {
 var Config Schema
 
 func init() {
+	// Tests don't read a config file, they set the Config fields they need.
+	if testing.Testing() {
+		return
+	}
+
 	config := viper.New()
 	config.SetConfigName("config")
 	config.AddConfigPath(".")          // Look for config in current directory
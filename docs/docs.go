@@ -25,6 +25,65 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/api/v1/breakers": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "get state of circuit breaker of each API host",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Circuit Breakers"
+                ],
+                "summary": "get list circuit breakers",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/breakers/{host}/reset": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api closes circuit breaker of API host",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Circuit Breakers"
+                ],
+                "summary": "api reset circuit breaker",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API Host",
+                        "name": "host",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        },
         "/api/v1/cron/resend": {
             "post": {
                 "description": "api resend ` + "`" + `failed` + "`" + ` out messages",
@@ -76,6 +135,45 @@ var doc = `{
                 }
             }
         },
+        "/api/v1/filters/test": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api evaluates a filter expression against a sample message",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Routing Keys"
+                ],
+                "summary": "api test filter",
+                "parameters": [
+                    {
+                        "description": "Body",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/schema.FilterTestParam"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        },
         "/api/v1/in_messages": {
             "get": {
                 "security": [
@@ -142,6 +240,43 @@ var doc = `{
                 }
             }
         },
+        "/api/v1/in_messages/{id}/preview": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api renders API requests of in message without sending them",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "In Messages"
+                ],
+                "summary": "preview in message requests",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        },
         "/api/v1/out_messages": {
             "get": {
                 "security": [
@@ -287,14 +422,14 @@ var doc = `{
                 }
             }
         },
-        "/api/v1/routing_keys": {
+        "/api/v1/parked_messages": {
             "get": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "get list routing keys",
+                "description": "get list messages rejected to the parking queue",
                 "consumes": [
                     "application/json"
                 ],
@@ -302,23 +437,33 @@ var doc = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Routing Keys"
+                    "Parked Messages"
                 ],
-                "summary": "get list routing keys",
+                "summary": "get list parked messages",
                 "parameters": [
                     {
                         "type": "string",
-                        "name": "group",
+                        "name": "origin_code",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "name": "name",
+                        "name": "origin_model",
                         "in": "query"
                     },
                     {
-                        "type": "integer",
-                        "name": "value",
+                        "type": "string",
+                        "name": "queue",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "reason",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "routing_key",
                         "in": "query"
                     }
                 ],
@@ -337,13 +482,13 @@ var doc = `{
                     }
                 }
             },
-            "post": {
+            "delete": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "api create routing key",
+                "description": "api delete parked messages matched query, all of them if query is empty",
                 "consumes": [
                     "application/json"
                 ],
@@ -351,18 +496,34 @@ var doc = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Routing Keys"
+                    "Parked Messages"
                 ],
-                "summary": "create routing key",
+                "summary": "api purge parked messages",
                 "parameters": [
                     {
-                        "description": "Body",
-                        "name": "Body",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/schema.RoutingCreateParam"
-                        }
+                        "type": "string",
+                        "name": "origin_code",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "origin_model",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "queue",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "reason",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "routing_key",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -370,25 +531,19 @@ var doc = `{
                         "description": "OK",
                         "schema": {
                             "$ref": "#/definitions/app.Response"
-                        },
-                        "headers": {
-                            "Token": {
-                                "type": "string",
-                                "description": "qwerty"
-                            }
                         }
                     }
                 }
             }
         },
-        "/api/v1/routing_keys/{id}": {
+        "/api/v1/parked_messages/{id}": {
             "get": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "api retrieve routing key",
+                "description": "api retrieve parked message with its x-death headers",
                 "consumes": [
                     "application/json"
                 ],
@@ -396,13 +551,13 @@ var doc = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Routing Keys"
+                    "Parked Messages"
                 ],
-                "summary": "api retrieve routing key",
+                "summary": "api retrieve parked message",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Routing Key ID",
+                        "description": "Parked Message ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -416,14 +571,16 @@ var doc = `{
                         }
                     }
                 }
-            },
-            "put": {
+            }
+        },
+        "/api/v1/parked_messages/{id}/requeue": {
+            "post": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "api update routing key",
+                "description": "api publish parked message back with its routing key",
                 "consumes": [
                     "application/json"
                 ],
@@ -431,25 +588,16 @@ var doc = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Routing Keys"
+                    "Parked Messages"
                 ],
-                "summary": "api update routing key",
+                "summary": "api requeue parked message",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Routing Key ID",
+                        "description": "Parked Message ID",
                         "name": "id",
                         "in": "path",
                         "required": true
-                    },
-                    {
-                        "description": "Body",
-                        "name": "Body",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/schema.RoutingUpdateParam"
-                        }
                     }
                 ],
                 "responses": {
@@ -461,64 +609,418 @@ var doc = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "app.Response": {
-            "type": "object",
-            "properties": {
-                "code": {
-                    "type": "integer"
-                },
-                "data": {
-                    "type": "object"
-                },
-                "msg": {
-                    "type": "string"
-                }
-            }
-        },
-        "schema.InMsgQueryParam": {
-            "type": "object",
-            "properties": {
-                "origin_code": {
-                    "type": "string"
-                },
-                "origin_model": {
-                    "type": "string"
-                },
-                "routing_key.group": {
-                    "type": "string"
-                },
-                "routing_key.name": {
-                    "type": "string"
-                },
-                "routing_key.value": {
-                    "type": "integer"
-                },
-                "status": {
-                    "type": "string"
-                }
-            }
         },
-        "schema.OutMsgCreateParam": {
-            "type": "object",
-            "required": [
-                "payload",
-                "routing_key"
-            ],
-            "properties": {
-                "origin_code": {
-                    "type": "string",
-                    "example": "code"
-                },
-                "origin_model": {
-                    "type": "string",
-                    "example": "model"
-                },
-                "payload": {
-                    "type": "object"
-                },
+        "/api/v1/routing_keys": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "get list routing keys",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Routing Keys"
+                ],
+                "summary": "get list routing keys",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "name": "group",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "name": "value",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        },
+                        "headers": {
+                            "Token": {
+                                "type": "string",
+                                "description": "qwerty"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api create routing key",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Routing Keys"
+                ],
+                "summary": "create routing key",
+                "parameters": [
+                    {
+                        "description": "Body",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/schema.RoutingCreateParam"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        },
+                        "headers": {
+                            "Token": {
+                                "type": "string",
+                                "description": "qwerty"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/routing_keys/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api retrieve routing key",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Routing Keys"
+                ],
+                "summary": "api retrieve routing key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Routing Key ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api update routing key",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Routing Keys"
+                ],
+                "summary": "api update routing key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Routing Key ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Body",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/schema.RoutingUpdateParam"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/routing_keys/{id}/rotate_secret": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "api adds a new signing secret of routing key, current secrets",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Routing Keys"
+                ],
+                "summary": "api rotate signing secret of routing key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Routing Key ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Body",
+                        "name": "Body",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/schema.RotateSecretParam"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/health": {
+            "get": {
+                "description": "api returns broker connection state and in-flight deliveries,",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Health"
+                ],
+                "summary": "check broker connection",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/app.Response"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "app.Response": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "integer"
+                },
+                "data": {
+                    "type": "object"
+                },
+                "msg": {
+                    "type": "string"
+                }
+            }
+        },
+        "schema.FilterTestParam": {
+            "type": "object",
+            "required": [
+                "filter",
+                "payload"
+            ],
+            "properties": {
+                "filter": {
+                    "type": "string"
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": true
+                },
+                "payload": {
+                    "type": "object"
+                },
+                "routing_key": {
+                    "type": "string"
+                }
+            }
+        },
+        "schema.HTTPAuth": {
+            "type": "object",
+            "required": [
+                "type"
+            ],
+            "properties": {
+                "api_key": {
+                    "type": "string"
+                },
+                "client_id": {
+                    "type": "string"
+                },
+                "client_secret": {
+                    "type": "string"
+                },
+                "header": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "token": {
+                    "type": "string"
+                },
+                "token_url": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "schema.HTTPConfig": {
+            "type": "object",
+            "properties": {
+                "auth": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.HTTPAuth"
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "proxy": {
+                    "type": "string"
+                },
+                "timeout": {
+                    "type": "integer"
+                },
+                "tls": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.HTTPTLS"
+                }
+            }
+        },
+        "schema.HTTPTLS": {
+            "type": "object",
+            "properties": {
+                "ca": {
+                    "type": "string"
+                },
+                "cert": {
+                    "type": "string"
+                },
+                "insecure_skip_verify": {
+                    "type": "boolean"
+                },
+                "key": {
+                    "type": "string"
+                },
+                "server_name": {
+                    "type": "string"
+                }
+            }
+        },
+        "schema.InMsgQueryParam": {
+            "type": "object",
+            "properties": {
+                "origin_code": {
+                    "type": "string"
+                },
+                "origin_model": {
+                    "type": "string"
+                },
+                "routing_key.group": {
+                    "type": "string"
+                },
+                "routing_key.name": {
+                    "type": "string"
+                },
+                "routing_key.value": {
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "schema.OutMsgCreateParam": {
+            "type": "object",
+            "required": [
+                "payload",
+                "routing_key"
+            ],
+            "properties": {
+                "origin_code": {
+                    "type": "string",
+                    "example": "code"
+                },
+                "origin_model": {
+                    "type": "string",
+                    "example": "model"
+                },
+                "payload": {
+                    "type": "object"
+                },
                 "routing_key": {
                     "type": "string",
                     "example": "routing.key"
@@ -550,11 +1052,64 @@ var doc = `{
                 }
             }
         },
+        "schema.ParkedMsgQueryParam": {
+            "type": "object",
+            "properties": {
+                "origin_code": {
+                    "type": "string"
+                },
+                "origin_model": {
+                    "type": "string"
+                },
+                "queue": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "routing_key": {
+                    "type": "string"
+                }
+            }
+        },
+        "schema.RetryPolicy": {
+            "type": "object",
+            "properties": {
+                "backoff": {
+                    "type": "string"
+                },
+                "delay": {
+                    "type": "integer"
+                },
+                "max_attempts": {
+                    "type": "integer"
+                },
+                "max_delay": {
+                    "type": "integer"
+                },
+                "retry_network_errors": {
+                    "type": "boolean"
+                },
+                "retryable_statuses": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "schema.RotateSecretParam": {
+            "type": "object",
+            "properties": {
+                "overlap": {
+                    "description": "Overlap is seconds current secrets keep signing, default is a day",
+                    "type": "integer"
+                }
+            }
+        },
         "schema.RoutingCreateParam": {
             "type": "object",
             "required": [
-                "api_method",
-                "api_url",
                 "group",
                 "name",
                 "value"
@@ -566,14 +1121,63 @@ var doc = `{
                 "api_url": {
                     "type": "string"
                 },
+                "filter": {
+                    "type": "string"
+                },
                 "group": {
                     "type": "string"
                 },
+                "http": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.HTTPConfig"
+                },
+                "max_in_flight": {
+                    "type": "integer"
+                },
                 "name": {
                     "type": "string"
                 },
+                "payload_schema": {
+                    "description": "PayloadSchema is a JSON Schema document as text",
+                    "type": "string"
+                },
+                "prefetch": {
+                    "type": "integer"
+                },
+                "queue_mode": {
+                    "type": "string"
+                },
+                "rate_burst": {
+                    "type": "integer"
+                },
+                "rate_limit": {
+                    "type": "number"
+                },
+                "retry_delays": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "retry_policy": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.RetryPolicy"
+                },
+                "subscriptions": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/schema.Subscription"
+                    }
+                },
+                "transform": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.Transform"
+                },
                 "value": {
                     "type": "integer"
+                },
+                "workers": {
+                    "type": "integer"
                 }
             }
         },
@@ -594,20 +1198,137 @@ var doc = `{
         "schema.RoutingUpdateParam": {
             "type": "object",
             "properties": {
+                "active": {
+                    "type": "boolean"
+                },
                 "api_method": {
                     "type": "string"
                 },
                 "api_url": {
                     "type": "string"
                 },
+                "filter": {
+                    "description": "Filter is kept when it's not set, an empty one removes it",
+                    "type": "string"
+                },
                 "group": {
                     "type": "string"
                 },
+                "http": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.HTTPConfig"
+                },
+                "max_in_flight": {
+                    "type": "integer"
+                },
                 "name": {
                     "type": "string"
                 },
+                "payload_schema": {
+                    "description": "PayloadSchema is a JSON Schema document as text, it's kept when it's\nnot set and an empty one removes it",
+                    "type": "string"
+                },
+                "prefetch": {
+                    "type": "integer"
+                },
+                "queue_mode": {
+                    "type": "string"
+                },
+                "rate_burst": {
+                    "type": "integer"
+                },
+                "rate_limit": {
+                    "type": "number"
+                },
+                "retry_delays": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "retry_policy": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.RetryPolicy"
+                },
+                "subscriptions": {
+                    "description": "Subscriptions replace the current ones, an empty list removes them.\nSubscriptions without id keep the one of the current subscription with\nthe same name, or api url.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/schema.Subscription"
+                    }
+                },
+                "transform": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.Transform"
+                },
                 "value": {
                     "type": "integer"
+                },
+                "workers": {
+                    "type": "integer"
+                }
+            }
+        },
+        "schema.Subscription": {
+            "type": "object",
+            "required": [
+                "api_method",
+                "api_url",
+                "name"
+            ],
+            "properties": {
+                "api_method": {
+                    "type": "string"
+                },
+                "api_url": {
+                    "type": "string"
+                },
+                "filter": {
+                    "type": "string"
+                },
+                "http": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.HTTPConfig"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "retry_policy": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.RetryPolicy"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "transform": {
+                    "type": "object",
+                    "$ref": "#/definitions/schema.Transform"
+                }
+            }
+        },
+        "schema.Transform": {
+            "type": "object",
+            "properties": {
+                "body": {
+                    "type": "string"
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "path": {
+                    "type": "string"
+                },
+                "query": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
                 }
             }
         }
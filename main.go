@@ -1,75 +1,240 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/quangdangfit/gosdk/utils/logger"
+	"go.uber.org/dig"
 
 	"message-queue/app"
+	"message-queue/app/dbs"
 	"message-queue/app/grpc"
+	"message-queue/app/queue"
 	"message-queue/app/router"
 	"message-queue/app/services"
 	"message-queue/config"
 )
 
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	AbortTimeout           = 5 * time.Second
+)
+
 func main() {
+	dryRun := flag.Bool("dry-run", false, "print broker topology changes and exit")
+	flag.Parse()
+
 	// Build DIG container
 	container := app.BuildContainer()
 
+	// Declare broker topology
+	if *dryRun {
+		err := container.Invoke(printTopologyDiff)
+		if err != nil {
+			logger.Fatal("Failed to diff topology: ", err)
+		}
+		return
+	}
+
+	err := container.Invoke(func(broker queue.Broker, topology *queue.Topology) error {
+		return topology.Apply(broker)
+	})
+	if err != nil {
+		logger.Fatal("Failed to apply topology: ", err)
+	}
+
+	// Topology and bindings may be lost when the broker restarts, declare
+	// them again before subscriptions are resumed
+	container.Invoke(func(
+		broker queue.Broker,
+		topology *queue.Topology,
+		routingService services.RoutingService,
+	) {
+		topology.ReapplyOnReconnect(broker, func() error {
+			return routingService.SyncBindings(context.Background())
+		})
+	})
+
 	//Init server
 	e := router.Initialize(container)
 
 	// Start by mode
+	var server *http.Server
 	if config.Config.Mode == 0 || config.Config.Mode == 1 {
+		port := "8080"
+		server = &http.Server{Addr: ":" + port, Handler: e}
 		go func() {
-			port := "8080"
 			logger.Info("Listening at port: " + port)
-			err := e.Run(":" + port)
+			err := server.ListenAndServe()
 			if err != nil && err != http.ErrServerClosed {
 				logger.Fatal(err)
 			}
 		}()
 	}
 
+	var consumers sync.WaitGroup
+	stopSync := make(chan struct{})
 	if config.Config.Mode == 0 || config.Config.Mode == 2 {
 		container.Invoke(func(
 			inService services.InService,
+			parkedService services.ParkedService,
+			routingService services.RoutingService,
 		) {
-			go inService.Consume()
+			routingService.SyncBindings(context.Background())
+			if interval := config.Config.SyncInterval; interval > 0 {
+				go syncBindings(routingService, time.Duration(interval)*time.Second, stopSync)
+			}
+
+			consumers.Add(2)
+			go func() {
+				defer consumers.Done()
+				inService.Consume()
+			}()
+			go func() {
+				defer consumers.Done()
+				parkedService.Consume()
+			}()
 		})
 	}
 
 	// Run RPC for publishing
+	var listener net.Listener
 	container.Invoke(func(
 		outRPC *grpc.OutRPC,
 	) {
 		rpc.RegisterName("OutRPC", outRPC)
 
 		logger.Info("Listening RPC at port 1234!")
-		listener, err := net.Listen("tcp", ":1234")
+		listener, err = net.Listen("tcp", ":1234")
 		if err != nil {
 			logger.Fatal("ListenTCP error: ", err)
 		}
 
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				logger.Fatal("Accept error: ", err)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					// net.ErrClosed needs go 1.16
+					if strings.Contains(err.Error(), "use of closed network connection") {
+						return
+					}
+					logger.Error("Accept error: ", err)
+					continue
+				}
+				go rpc.ServeConn(conn)
 			}
-			go rpc.ServeConn(conn)
-		}
+		}()
 	})
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 10 seconds.
-	quit := make(chan os.Signal)
+	// Wait for interrupt signal to gracefully shutdown the server, in-flight
+	// deliveries have ShutdownTimeout seconds to finish
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	close(quit)
 	logger.Info("Shutting down")
+	close(stopSync)
+
+	timeout := time.Duration(config.Config.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdown(ctx, container, server, listener, &consumers)
+	logger.Info("Server exiting")
+}
+
+// shutdown stops accepting requests and deliveries, waits in-flight
+// deliveries until ctx is done, then aborts their API calls so they are
+// requeued, and closes broker and database connections. Deliveries which are
+// still not settled are redelivered by the broker.
+func shutdown(ctx context.Context, container *dig.Container, server *http.Server,
+	listener net.Listener, consumers *sync.WaitGroup) {
+
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("Failed to shutdown server: ", err)
+		}
+	}
+	if listener != nil {
+		listener.Close()
+	}
+
+	container.Invoke(func(
+		consumer queue.Consumer,
+		parking queue.Parking,
+		inService services.InService,
+		broker queue.Broker,
+		db dbs.IDatabase,
+	) {
+		consumer.Stop()
+		parking.Stop()
+
+		drained := make(chan struct{})
+		go func() {
+			consumers.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+			logger.Info("Consumers are drained")
+		case <-ctx.Done():
+			logger.Warnf("Shutdown timeout, abort %d in-flight deliveries", inService.InFlight())
+			inService.Abort()
+			select {
+			case <-drained:
+			case <-time.After(AbortTimeout):
+				logger.Warnf("%d in-flight deliveries are not requeued", inService.InFlight())
+			}
+		}
+
+		if err := broker.Close(); err != nil {
+			logger.Error("Failed to close broker: ", err)
+		}
+		db.Close()
+	})
+}
+
+// syncBindings resyncs queue bindings every interval until stop is closed.
+// Bindings of routing keys changed through another replica are bound here
+// too, kafka keeps bindings in process so replicas only see them this way.
+func syncBindings(routingService services.RoutingService, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := routingService.SyncBindings(context.Background()); err != nil {
+				logger.Error("Failed to sync bindings: ", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func printTopologyDiff(broker queue.Broker, topology *queue.Topology) error {
+	changes, err := topology.Diff(broker)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return broker.Close()
 }
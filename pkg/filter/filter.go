@@ -0,0 +1,95 @@
+// Package filter matches messages by JMESPath expressions, e.g.
+// `payload.country == 'VN' && headers.origin_model == 'order'`. Expressions
+// are evaluated against a document of the message with `routing_key`,
+// `payload` and `headers`, the message matches when the result is truthy:
+// not false, null, an empty string, an empty array or an empty object.
+package filter
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/pkg/errors"
+)
+
+var compiled sync.Map
+
+// Validate returns an error when expression is not a valid filter, empty
+// expression matches every message
+func Validate(expression string) error {
+	if expression == "" {
+		return nil
+	}
+
+	_, err := compile(expression)
+	return err
+}
+
+// Document returns the document which filters are evaluated against,
+// payload and headers are normalized to json values
+func Document(routingKey string, payload interface{}, headers interface{}) (interface{}, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"routing_key": routingKey,
+		"payload":     payload,
+		"headers":     headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var document interface{}
+	err = json.Unmarshal(data, &document)
+	return document, err
+}
+
+// Match reports document matches expression, empty expression matches every
+// document
+func Match(expression string, document interface{}) (bool, error) {
+	if expression == "" {
+		return true, nil
+	}
+
+	path, err := compile(expression)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := path.Search(document)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to evaluate filter")
+	}
+	return isTruthy(result), nil
+}
+
+func compile(expression string) (*jmespath.JMESPath, error) {
+	if path, ok := compiled.Load(expression); ok {
+		return path.(*jmespath.JMESPath), nil
+	}
+
+	path, err := jmespath.Compile(expression)
+	if err != nil {
+		return nil, errors.Wrapf(err, "filter %q is invalid", expression)
+	}
+	compiled.Store(expression, path)
+	return path, nil
+}
+
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map:
+		return rv.Len() > 0
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestIsTruthy(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected bool
+	}{
+		{value: nil, expected: false},
+		{value: false, expected: false},
+		{value: true, expected: true},
+		{value: "", expected: false},
+		{value: "VN", expected: true},
+		{value: []interface{}{}, expected: false},
+		{value: []interface{}{nil}, expected: true},
+		{value: map[string]interface{}{}, expected: false},
+		{value: map[string]interface{}{"id": 1}, expected: true},
+		{value: float64(0), expected: true}, // numbers are truthy like JMESPath
+		{value: float64(1), expected: true},
+	}
+	for _, test := range tests {
+		if got := isTruthy(test.value); got != test.expected {
+			t.Errorf("%#v: expected %t, got %t", test.value, test.expected, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{expression: "", valid: true},
+		{expression: "payload.country == 'VN'", valid: true},
+		{expression: "length(payload.items) > `1`", valid: true},
+		{expression: "payload.country ==", valid: false},
+		{expression: "payload.[country", valid: false},
+		{expression: "'unterminated", valid: false},
+	}
+	for _, test := range tests {
+		if err := Validate(test.expression); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t, got %v", test.expression, test.valid, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	document, err := Document("order.created",
+		map[string]interface{}{"country": "VN", "total": 120, "items": []string{"a", "b"}, "note": ""},
+		map[string]interface{}{"origin_model": "order", "origin_code": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		expected   bool
+	}{
+		{name: "empty", expression: "", expected: true},
+		{name: "equal", expression: "payload.country == 'VN'", expected: true},
+		{name: "not equal", expression: "payload.country == 'US'", expected: false},
+		{name: "number", expression: "payload.total > `100`", expected: true},
+		{name: "headers", expression: "headers.origin_model == 'order' && payload.country == 'VN'", expected: true},
+		{name: "routing key", expression: "starts_with(routing_key, 'order.')", expected: true},
+		{name: "missing field", expression: "payload.missing", expected: false},
+		{name: "empty string", expression: "payload.note", expected: false},
+		{name: "non empty array", expression: "payload.items", expected: true},
+		{name: "empty projection", expression: "payload.items[?@ == 'c']", expected: false},
+		{name: "object", expression: "payload", expected: true},
+		{name: "zero", expression: "length(payload.note)", expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched, err := Match(test.expression, document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matched != test.expected {
+				t.Fatalf("expected matched %t, got %t", test.expected, matched)
+			}
+		})
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	document, err := Document("order.created", map[string]interface{}{"country": "VN"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+	}{
+		{name: "invalid", expression: "payload.country =="},
+		{name: "evaluation", expression: "length(payload.missing)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matched, err := Match(test.expression, document); err == nil || matched {
+				t.Fatalf("expected error, got matched %t", matched)
+			}
+		})
+	}
+}
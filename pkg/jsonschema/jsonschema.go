@@ -0,0 +1,109 @@
+// Package jsonschema validates message payloads by JSON Schemas of routing
+// keys. Schemas are compiled once and cached by their source. References are
+// resolved within the schema only, remote and file `$ref`s are rejected so
+// routing keys can't make gomq fetch urls or read local files.
+package jsonschema
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+var (
+	ErrRemoteRef = errors.New("remote $ref is not allowed")
+)
+
+var compiled sync.Map
+
+// ValidationError has the errors of a payload which doesn't match its schema,
+// e.g. `country: Does not match pattern '^[A-Z]{2}$'`
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return "payload is invalid: " + strings.Join(e.Errors, "; ")
+}
+
+// Validate returns an error when schema is not a valid JSON Schema, empty
+// schema allows every payload
+func Validate(schema string) error {
+	if schema == "" {
+		return nil
+	}
+
+	_, err := compile(schema)
+	return err
+}
+
+// ValidatePayload returns a *ValidationError when payload doesn't match
+// schema, empty schema allows every payload
+func ValidatePayload(schema string, payload interface{}) error {
+	if schema == "" {
+		return nil
+	}
+
+	compiledSchema, err := compile(schema)
+	if err != nil {
+		return err
+	}
+
+	result, err := compiledSchema.Validate(gojsonschema.NewGoLoader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to validate payload")
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	validationErr := ValidationError{}
+	for _, resultErr := range result.Errors() {
+		validationErr.Errors = append(validationErr.Errors, resultErr.String())
+	}
+	return &validationErr
+}
+
+func compile(schema string) (*gojsonschema.Schema, error) {
+	if compiledSchema, ok := compiled.Load(schema); ok {
+		return compiledSchema.(*gojsonschema.Schema), nil
+	}
+
+	compiledSchema, err := gojsonschema.NewSchema(localLoader{gojsonschema.NewStringLoader(schema)})
+	if err != nil {
+		return nil, errors.Wrap(err, "schema is invalid")
+	}
+	compiled.Store(schema, compiledSchema)
+	return compiledSchema, nil
+}
+
+// localLoader loads the schema from its source, references out of the schema
+// are loaded by refLoader
+type localLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (l localLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return refLoaderFactory{}
+}
+
+type refLoaderFactory struct{}
+
+func (refLoaderFactory) New(source string) gojsonschema.JSONLoader {
+	return refLoader{gojsonschema.NewReferenceLoader(source)}
+}
+
+// refLoader refuses to load a referenced document
+type refLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (l refLoader) LoadJSON() (interface{}, error) {
+	return nil, errors.Wrapf(ErrRemoteRef, "%s", l.JsonSource())
+}
+
+func (l refLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return refLoaderFactory{}
+}
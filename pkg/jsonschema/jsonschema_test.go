@@ -0,0 +1,142 @@
+package jsonschema
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "country"],
+	"properties": {
+		"id": {"type": "string"},
+		"country": {"$ref": "#/definitions/country"},
+		"total": {"type": "number", "minimum": 0}
+	},
+	"definitions": {
+		"country": {"type": "string", "pattern": "^[A-Z]{2}$"}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		valid  bool
+	}{
+		{name: "empty", schema: "", valid: true},
+		{name: "local ref", schema: orderSchema, valid: true},
+		{name: "draft", schema: `{"$schema": "http://json-schema.org/draft-07/schema#", "type": "object"}`, valid: true},
+		{name: "invalid json", schema: `{"type": `, valid: false},
+		{name: "invalid type", schema: `{"type": "order"}`, valid: false},
+		{name: "missing ref", schema: `{"$ref": "#/definitions/missing"}`, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Validate(test.schema); (err == nil) != test.valid {
+				t.Fatalf("expected valid %t, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		payload interface{}
+		errors  []string
+	}{
+		{name: "empty schema", payload: map[string]interface{}{"id": 1}},
+		{name: "valid", schema: orderSchema,
+			payload: map[string]interface{}{"id": "1", "country": "VN", "total": 120}},
+		{name: "missing field", schema: orderSchema, payload: map[string]interface{}{"id": "1"},
+			errors: []string{"country is required"}},
+		{name: "invalid fields", schema: orderSchema,
+			payload: map[string]interface{}{"id": 1, "country": "Vietnam", "total": -1},
+			errors:  []string{"id: Invalid type", "country: Does not match pattern", "total: Must be greater than or equal to 0"}},
+		{name: "not an object", schema: orderSchema, payload: "order",
+			errors: []string{"Invalid type. Expected: object, given: string"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidatePayload(test.schema, test.payload)
+			if len(test.errors) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if len(validationErr.Errors) != len(test.errors) {
+				t.Fatalf("expected %d errors, got %v", len(test.errors), validationErr.Errors)
+			}
+			for _, expected := range test.errors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected %q in %s", expected, err)
+				}
+			}
+			if !strings.HasPrefix(err.Error(), "payload is invalid: ") {
+				t.Errorf("unexpected error %s", err)
+			}
+		})
+	}
+
+	// Schema errors aren't validation errors of the payload
+	err := ValidatePayload(`{"type": "order"}`, map[string]interface{}{})
+	var validationErr *ValidationError
+	if err == nil || errors.As(err, &validationErr) {
+		t.Fatalf("expected schema error, got %v", err)
+	}
+}
+
+func TestRemoteRefIsNotLoaded(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"type": "string"}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "jsonschema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "country.json")
+	if err := ioutil.WriteFile(file, []byte(`{"type": "string"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "http", schema: `{"properties": {"country": {"$ref": "` + server.URL + `/country.json"}}}`},
+		{name: "file", schema: `{"properties": {"country": {"$ref": "file://` + filepath.ToSlash(file) + `"}}}`},
+		{name: "id", schema: `{"$id": "` + server.URL + `/order.json", "properties": {"country": {"$ref": "country.json"}}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Validate(test.schema); !errors.Is(err, ErrRemoteRef) {
+				t.Fatalf("expected %s, got %v", ErrRemoteRef, err)
+			}
+			if err := ValidatePayload(test.schema, map[string]interface{}{"country": "VN"}); !errors.Is(err, ErrRemoteRef) {
+				t.Fatalf("expected %s, got %v", ErrRemoteRef, err)
+			}
+		})
+	}
+	if calls != 0 {
+		t.Fatalf("expected remote schema isn't fetched, got %d calls", calls)
+	}
+}
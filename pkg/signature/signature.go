@@ -0,0 +1,88 @@
+// Package signature signs API calls of gomq and verifies them on the
+// receiving side. The signature header has the timestamp and a HMAC-SHA256
+// signature of `<timestamp>.<body>` for each active secret of the routing
+// key, e.g. `t=1600000000,v1=5257a8...,v1=a1b2c3...`, so receivers keep
+// verifying while secrets are rotated.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Header           = "Gomq-Signature"
+	Scheme           = "v1"
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidHeader    = errors.New("signature header is invalid")
+	ErrNoValidSignature = errors.New("no signature matches the secrets")
+	ErrTimestampExpired = errors.New("signature timestamp is out of tolerance")
+)
+
+// Sign returns the signature header of body signed by secrets at timestamp
+func Sign(body []byte, timestamp time.Time, secrets ...string) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	parts := []string{"t=" + unix}
+	for _, secret := range secrets {
+		parts = append(parts, Scheme+"="+compute(unix, body, secret))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Verify checks header is signed by one of secrets over body, and its
+// timestamp is within tolerance of now to reject replayed calls. Zero
+// tolerance skips the timestamp check.
+func Verify(header string, body []byte, tolerance time.Duration, secrets ...string) error {
+	var unix string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) != 2 {
+			return ErrInvalidHeader
+		}
+		switch pair[0] {
+		case "t":
+			unix = pair[1]
+		case Scheme:
+			signatures = append(signatures, pair[1])
+		}
+	}
+
+	timestamp, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidHeader
+	}
+	if tolerance > 0 {
+		age := time.Since(time.Unix(timestamp, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrTimestampExpired
+		}
+	}
+
+	for _, secret := range secrets {
+		expected := compute(unix, body, secret)
+		for _, signature := range signatures {
+			if hmac.Equal([]byte(expected), []byte(signature)) {
+				return nil
+			}
+		}
+	}
+	return ErrNoValidSignature
+}
+
+func compute(unix string, body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
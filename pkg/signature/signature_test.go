@@ -0,0 +1,109 @@
+package signature
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var body = []byte(`{"id": "1"}`)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Now()
+	header := Sign(body, now, "secret")
+
+	if !strings.HasPrefix(header, "t="+strconv.FormatInt(now.Unix(), 10)+","+Scheme+"=") {
+		t.Fatalf("unexpected header %s", header)
+	}
+	if err := Verify(header, body, DefaultTolerance, "secret"); err != nil {
+		t.Fatalf("expected valid signature, got %v", err)
+	}
+	if err := Verify(header, body, DefaultTolerance, "other"); err != ErrNoValidSignature {
+		t.Fatalf("expected %s with other secret, got %v", ErrNoValidSignature, err)
+	}
+	if err := Verify(header, []byte(`{"id": "2"}`), DefaultTolerance, "secret"); err != ErrNoValidSignature {
+		t.Fatalf("expected %s with other body, got %v", ErrNoValidSignature, err)
+	}
+
+	// The timestamp is signed with the body
+	forged := strings.Replace(header, "t="+strconv.FormatInt(now.Unix(), 10),
+		"t="+strconv.FormatInt(now.Unix()+1, 10), 1)
+	if err := Verify(forged, body, DefaultTolerance, "secret"); err != ErrNoValidSignature {
+		t.Fatalf("expected %s with changed timestamp, got %v", ErrNoValidSignature, err)
+	}
+}
+
+func TestVerifyDuringRotation(t *testing.T) {
+	header := Sign(body, time.Now(), "new", "old")
+	if n := strings.Count(header, Scheme+"="); n != 2 {
+		t.Fatalf("expected 2 signatures, got %s", header)
+	}
+
+	// Receivers which know either secret verify the call
+	tests := [][]string{{"new"}, {"old"}, {"unknown", "old"}, {"new", "old"}}
+	for _, secrets := range tests {
+		if err := Verify(header, body, DefaultTolerance, secrets...); err != nil {
+			t.Errorf("secrets %v: expected valid signature, got %v", secrets, err)
+		}
+	}
+	if err := Verify(header, body, DefaultTolerance, "unknown"); err != ErrNoValidSignature {
+		t.Fatalf("expected %s, got %v", ErrNoValidSignature, err)
+	}
+	if err := Verify(header, body, DefaultTolerance); err != ErrNoValidSignature {
+		t.Fatalf("expected %s without secrets, got %v", ErrNoValidSignature, err)
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	tests := []struct {
+		name      string
+		age       time.Duration
+		tolerance time.Duration
+		expected  error
+	}{
+		{name: "recent", age: time.Minute, tolerance: DefaultTolerance},
+		{name: "expired", age: 10 * time.Minute, tolerance: DefaultTolerance, expected: ErrTimestampExpired},
+		{name: "future", age: -10 * time.Minute, tolerance: DefaultTolerance, expected: ErrTimestampExpired},
+		{name: "without tolerance", age: 24 * time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := Sign(body, time.Now().Add(-test.age), "secret")
+			if err := Verify(header, body, test.tolerance, "secret"); err != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformedHeader(t *testing.T) {
+	valid := Sign(body, time.Now(), "secret")
+	signature := strings.SplitN(valid, ",", 2)[1]
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{name: "empty", header: ""},
+		{name: "without pairs", header: "signature"},
+		{name: "without timestamp", header: signature},
+		{name: "invalid timestamp", header: "t=now," + signature},
+		{name: "without signature", header: "t=" + strconv.FormatInt(time.Now().Unix(), 10)},
+		{name: "other scheme only", header: strings.Replace(valid, Scheme+"=", "v0=", 1)},
+		{name: "empty part", header: valid + ","},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Verify(test.header, body, DefaultTolerance, "secret"); err != ErrInvalidHeader {
+				t.Fatalf("expected %s, got %v", ErrInvalidHeader, err)
+			}
+		})
+	}
+
+	// Spaces and unknown schemes are allowed
+	header := strings.Replace(valid, ",", ", v0=unknown, ", 1)
+	if err := Verify(header, body, DefaultTolerance, "secret"); err != nil {
+		t.Fatalf("expected valid signature of %s, got %v", header, err)
+	}
+}